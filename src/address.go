@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	ensChanges = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_ens_changes_total",
+		Help: "The total number of ENS names of filters found resolving to a new address",
+	})
+	ensErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_ens_errors_total",
+		Help: "The total number of ENS names of filters that failed to resolve again",
+	})
+)
+
+// Brings an address into the EIP-55 checksummed form transactions carry.
+// Addresses in all lower or all upper case are taken as they are, mixed case
+// has to be a valid checksum, a typo in it would match nothing.
+func normalizeAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	a, ok := parseAddress(address)
+	if !ok || !strings.HasPrefix(strings.ToLower(address), "0x") {
+		return "", fmt.Errorf("invalid address %q, use 0x and 40 hex digits", address)
+	}
+	digits := address[2:]
+	if digits != strings.ToLower(digits) && digits != strings.ToUpper(digits) && "0x"+digits != a.Hex() {
+		return "", fmt.Errorf("address %q fails its EIP-55 checksum, check it for typos or give it in lower case", address)
+	}
+	return a.Hex(), nil
+}
+
+// Whether the filter names an ENS name, like vitalik.eth, instead of an address
+func isENSName(s string) bool {
+	return strings.Contains(s, ".") && !strings.HasPrefix(strings.ToLower(s), "0x")
+}
+
+// The ENS registry, at the same address on mainnet and the test networks
+var ensRegistry = common.HexToAddress("0x00000000000C2E074eC69A0dFb2997BA6C7d2e1e")
+
+var (
+	ensResolverSelector = []byte{0x01, 0x78, 0xb8, 0xbf} // resolver(bytes32)
+	ensAddrSelector     = []byte{0x3b, 0x3b, 0x57, 0xde} // addr(bytes32)
+)
+
+// Resolves ENS names through the node, the ingesting instance shares its
+// connection, API only replicas connect on the first name
+var (
+	ensMu     sync.Mutex
+	ensLookup func(name string) (common.Address, error)
+)
+
+func SetENSClient(client *ethclient.Client) {
+	ensMu.Lock()
+	defer ensMu.Unlock()
+	ensLookup = func(name string) (common.Address, error) {
+		return resolveENS(client, name)
+	}
+}
+
+func ensResolver() (func(name string) (common.Address, error), error) {
+	ensMu.Lock()
+	defer ensMu.Unlock()
+	if ensLookup != nil {
+		return ensLookup, nil
+	}
+	projectID, networkName := os.Getenv("SNOOPY_PROJECT_ID"), os.Getenv("SNOOPY_NETWORK_NAME")
+	if os.Getenv("SNOOPY_NODE_URL") == "" && (projectID == "" || networkName == "") {
+		return nil, fmt.Errorf("no node to resolve ENS names with")
+	}
+	client, err := ethclient.Dial(nodeURL(projectID, networkName))
+	if err != nil {
+		return nil, err
+	}
+	ensLookup = func(name string) (common.Address, error) {
+		return resolveENS(client, name)
+	}
+	return ensLookup, nil
+}
+
+// The checksummed address the ENS name resolves to
+func ResolveENS(name string) (string, error) {
+	lookup, err := ensResolver()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve ENS name %q: %w", name, err)
+	}
+	a, err := lookup(strings.ToLower(name))
+	if err != nil {
+		return "", fmt.Errorf("resolving ENS name %q: %w", name, err)
+	}
+	if a == (common.Address{}) {
+		return "", fmt.Errorf("ENS name %q does not resolve to an address", name)
+	}
+	return a.Hex(), nil
+}
+
+// The node of an ENS name as of EIP-137
+func ensNamehash(name string) common.Hash {
+	var node common.Hash
+	if name == "" {
+		return node
+	}
+	labels := strings.Split(name, ".")
+	for n := len(labels) - 1; n >= 0; n-- {
+		node = crypto.Keccak256Hash(node.Bytes(), crypto.Keccak256([]byte(labels[n])))
+	}
+	return node
+}
+
+// Asks the registry for the resolver of the name and the resolver for its address
+func resolveENS(client *ethclient.Client, name string) (common.Address, error) {
+	node := ensNamehash(name)
+	call := func(to common.Address, selector []byte) (common.Address, error) {
+		res, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &to, Data: append(append([]byte{}, selector...), node.Bytes()...)}, nil)
+		apiCallsProcessed.Inc()
+		if err != nil {
+			return common.Address{}, err
+		}
+		if len(res) < 32 {
+			return common.Address{}, fmt.Errorf("short reply from %s", to.Hex())
+		}
+		return common.BytesToAddress(res[:32]), nil
+	}
+	resolver, err := call(ensRegistry, ensResolverSelector)
+	if err != nil || resolver == (common.Address{}) {
+		return common.Address{}, err
+	}
+	return call(resolver, ensAddrSelector)
+}
+
+// Resolves the ENS names of the filters again and moves the filters whose
+// names point to a new address. A name failing to resolve keeps its address.
+func ReresolveENS() {
+	filters, err := store.Filters()
+	if err != nil {
+		log.Print(err) // Log error and try again next time
+		return
+	}
+	for _, id := range sortedIds(filters) {
+		if len(filters[id].ENS) == 0 {
+			continue
+		}
+		filter := *filters[id]
+		filter.Logs = append([]LogCriteria(nil), filter.Logs...)
+		var changed bool
+		for _, field := range filter.addressFields() {
+			name := filter.ENS[field.name]
+			if name == "" {
+				continue
+			}
+			address, err := ResolveENS(name)
+			if err != nil {
+				log.Print(err) // Log error and keep the address
+				ensErrors.Inc()
+				continue
+			}
+			if address != *field.value {
+				log.Println("ENS: " + name + " moved from " + *field.value + " to " + address + ", updating filter " + fmt.Sprint(id))
+				*field.value = address
+				changed = true
+				ensChanges.Inc()
+			}
+		}
+		if changed {
+			filter.Revision = time.Now().UnixNano()
+			if err := store.StoreFilter(filter); err != nil {
+				log.Print(err) // Log error and try again next time
+			}
+		}
+	}
+}
+
+// Brings the addresses of filters stored before addresses were normalized
+// into their checksummed form, so lookups by address find them. Filters
+// stored before revisions get one, so matching can reuse their criteria.
+func NormalizeStoredFilters() {
+	filters, err := store.Filters()
+	if err != nil {
+		log.Print(err) // Log error and continue with the filters as they are
+		return
+	}
+	var normalized int
+	for _, id := range sortedIds(filters) {
+		filter := *filters[id]
+		filter.Logs = append([]LogCriteria(nil), filter.Logs...)
+		var changed bool
+		for _, field := range filter.addressFields() {
+			if a, ok := parseAddress(*field.value); ok && a.Hex() != *field.value {
+				*field.value = a.Hex()
+				changed = true
+			}
+		}
+		if !changed && filter.Revision != 0 {
+			continue
+		}
+		filter.Revision = time.Now().UnixNano()
+		if err := store.StoreFilter(filter); err != nil {
+			log.Print(err) // Log error and continue
+			continue
+		}
+		if changed {
+			normalized++
+		}
+	}
+	if normalized > 0 {
+		log.Println("Normalized the addresses of " + fmt.Sprint(normalized) + " filters")
+	}
+}
+
+// Re-resolves the ENS names of the filters every SNOOPY_ENS_INTERVAL, by
+// default hourly, 0 turns it off
+func reresolveENSRun() {
+	interval := time.Hour
+	if v := os.Getenv("SNOOPY_ENS_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Print(err) // Log error and use the default
+		} else {
+			interval = d
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	for range time.Tick(interval) {
+		ReresolveENS()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	for in, want := range map[string]string{
+		"0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266":   "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+		"0XF39FD6E51AAD88F6F4CE6AB8827279CFFFB92266":   "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+		" 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266 ": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+	} {
+		address, err := normalizeAddress(in)
+		assert.Nil(t, err, in)
+		assert.Equal(t, want, address, in)
+	}
+	for in, msg := range map[string]string{
+		"0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92267": `address "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92267" fails its EIP-55 checksum, check it for typos or give it in lower case`,
+		"f39fd6e51aad88f6f4ce6ab8827279cfffb92266":   `invalid address "f39fd6e51aad88f6f4ce6ab8827279cfffb92266", use 0x and 40 hex digits`,
+		"0xf39fd6e51aad88f6f4ce6ab8827279cfffb9226":  `invalid address "0xf39fd6e51aad88f6f4ce6ab8827279cfffb9226", use 0x and 40 hex digits`,
+	} {
+		_, err := normalizeAddress(in)
+		assert.EqualError(t, err, msg, in)
+	}
+}
+
+func TestENSNamehash(t *testing.T) {
+	assert.Equal(t, common.Hash{}, ensNamehash(""))
+	assert.Equal(t, "0x93cdeb708b7545dc668eb9280176169d1c33cfd8ed6f04690a0bcc88a93fc4ae", ensNamehash("eth").Hex())
+	assert.Equal(t, "0xde9b09fd7c5f901e23a3f19fecc54828e9c848539801e86591bd9801b019f84f", ensNamehash("foo.eth").Hex())
+}
+
+// Resolves names from the map instead of the node
+func testENS(names map[string]string) func() {
+	ensMu.Lock()
+	saved := ensLookup
+	ensLookup = func(name string) (common.Address, error) {
+		address, ok := names[name]
+		if !ok {
+			return common.Address{}, fmt.Errorf("no resolver")
+		}
+		return common.HexToAddress(address), nil
+	}
+	ensMu.Unlock()
+	return func() {
+		ensMu.Lock()
+		ensLookup = saved
+		ensMu.Unlock()
+	}
+}
+
+func TestFilterENS(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	names := map[string]string{"treasury.eth": "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266", "usdt.eth": "0xdac17f958d2ee523a2206206994597c13d831ec7"}
+	defer testENS(names)()
+
+	added, err := AddFilterCriteria(Filters{From: "Treasury.eth", Logs: []LogCriteria{{Address: "usdt.eth"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", added.From)
+	assert.Equal(t, "0xdAC17F958D2ee523a2206206994597C13D831ec7", added.Logs[0].Address)
+	assert.Equal(t, map[string]string{"From": "treasury.eth", "Logs.0.Address": "usdt.eth"}, added.ENS)
+	_, err = AddFilterCriteria(Filters{TxTo: "missing.eth"})
+	assert.EqualError(t, err, `To: resolving ENS name "missing.eth": no resolver`)
+
+	// A name moving to another address moves the filter, one that fails keeps it
+	names["treasury.eth"] = "0x70997970c51812dc3a010c7d01b50e0d17dc79c8"
+	delete(names, "usdt.eth")
+	ReresolveENS()
+	filter, _ := store.FilterById(added.Id)
+	assert.Equal(t, "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", filter.From)
+	assert.Equal(t, "0xdAC17F958D2ee523a2206206994597C13D831ec7", filter.Logs[0].Address)
+	assert.Equal(t, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", added.From)
+}
+
+func TestFilterAddENSRequest(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	defer testENS(map[string]string{"treasury.eth": "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266"})()
+	ensMu.Lock()
+	resolve := ensLookup
+	var lookups int
+	ensLookup = func(name string) (common.Address, error) {
+		lookups++
+		return resolve(name)
+	}
+	ensMu.Unlock()
+	a := App{}
+
+	w := httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"from": "treasury.eth", "minValue": "1ether"}`)))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, lookups)
+	var added Filters
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &added))
+	assert.Equal(t, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", added.From)
+
+	for _, body := range []string{`{"from": "missing.eth"}`, `{"deployer": "0x1234"}`, `{"to": "missing.eth"}`} {
+		w = httptest.NewRecorder()
+		a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(body)))
+		assert.Equal(t, 400, w.Code, body)
+	}
+	n, _ := store.NumFilters()
+	assert.Equal(t, 1, n)
+}
+
+func TestNormalizeStoredFilters(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	store.StoreFilter(Filters{Id: 1, TxTo: "0xdac17f958d2ee523a2206206994597c13d831ec7", Logs: []LogCriteria{{Topics: []string{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"}}}})
+	store.StoreFilter(Filters{Id: 2, TxTo: "0x0"})
+	NormalizeStoredFilters()
+	filters, _ := store.FiltersByTxTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(filters))
+	filter, _ := store.FilterById(2)
+	assert.Equal(t, "0x0", filter.TxTo)
+}
+
+func TestFilterAddressRequests(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	a := App{}
+
+	w := httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0x00000000219ab540356cbb839cbe05303d7705fa"}`)))
+	assert.Equal(t, 200, w.Code)
+	var filters []Filters
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &filters))
+	assert.Equal(t, "0x00000000219ab540356cBB839Cbe05303d7705Fa", filters[0].TxTo)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterToRequest(w, httptest.NewRequest("POST", "/filterto", strings.NewReader(`{"to": "0x00000000219AB540356CBB839CBE05303D7705FA"}`)))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &filters))
+	assert.Equal(t, 1, len(filters))
+
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"from": "0x00000000219ab540356cBB839Cbe05303d7705FA", "minValue": "1ether"}`)))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "From: address")
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"deployer": "0x1234"}`)))
+	assert.Equal(t, 400, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopContractCreatorRequest(w, httptest.NewRequest("POST", "/contractcreator", strings.NewReader(`{"creator": "0x1234"}`)))
+	assert.Equal(t, 400, w.Code)
+}
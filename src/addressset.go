@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math/bits"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	addressSetAddresses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_address_set_addresses",
+		Help: "The number of addresses in the address set",
+	}, []string{"set"})
+	addressSetBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_address_set_bytes",
+		Help: "The estimated memory held by the address set",
+	}, []string{"set"})
+)
+
+// Bloom filter sizing, about 0.8% of the addresses not in a set get past the
+// bloom filter to the exact lookup
+const (
+	addressSetBitsPerAddress = 10
+	addressSetHashes         = 7
+)
+
+// A fixed set of addresses matched against every transaction. Most addresses
+// looked up are not in the set, a bloom filter turns those away before the
+// exact lookup. Lookups take the same time at any size, in any case and
+// without allocating.
+type AddressSet struct {
+	bloom []uint64
+	exact map[common.Address]struct{}
+}
+
+// A set of the valid addresses among the given ones, in any case, with or
+// without 0x
+func NewAddressSet(addresses []string) *AddressSet {
+	parsed := make([]common.Address, 0, len(addresses))
+	for _, address := range addresses {
+		if a, ok := parseAddress(address); ok {
+			parsed = append(parsed, a)
+		}
+	}
+	return newAddressSet(parsed)
+}
+
+func newAddressSet(addresses []common.Address) *AddressSet {
+	s := &AddressSet{exact: make(map[common.Address]struct{}, len(addresses))}
+	for _, a := range addresses {
+		s.exact[a] = struct{}{}
+	}
+	words := (len(s.exact)*addressSetBitsPerAddress + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	s.bloom = make([]uint64, words)
+	for a := range s.exact {
+		h1, h2 := addressHashes(a)
+		for i := uint64(0); i < addressSetHashes; i++ {
+			bit := s.bit(h1 + i*h2)
+			s.bloom[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return s
+}
+
+// Whether the address is in the set, false for anything not an address
+func (s *AddressSet) Contains(address string) bool {
+	if s == nil || len(s.exact) == 0 {
+		return false
+	}
+	a, ok := parseAddress(address)
+	return ok && s.ContainsAddress(a)
+}
+
+func (s *AddressSet) ContainsAddress(a common.Address) bool {
+	if s == nil || len(s.exact) == 0 || !s.mayContain(a) {
+		return false
+	}
+	_, ok := s.exact[a]
+	return ok
+}
+
+// Whether the bloom filter lets the address through
+func (s *AddressSet) mayContain(a common.Address) bool {
+	h1, h2 := addressHashes(a)
+	for i := uint64(0); i < addressSetHashes; i++ {
+		bit := s.bit(h1 + i*h2)
+		if s.bloom[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *AddressSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.exact)
+}
+
+// Estimated memory of the bloom filter and the exact set, the map buckets of
+// 8 addresses are taken as filled to the average load factor of 6.5
+func (s *AddressSet) Bytes() int {
+	if s == nil {
+		return 0
+	}
+	const bucket = 8 + 8*common.AddressLength + 8 // Top hashes, keys and the overflow pointer
+	buckets := 1
+	for float64(len(s.exact)) > 6.5*float64(buckets) {
+		buckets *= 2
+	}
+	return len(s.bloom)*8 + buckets*bucket
+}
+
+// Sets the metrics of the named set
+func (s *AddressSet) report(name string) {
+	addressSetAddresses.WithLabelValues(name).Set(float64(s.Len()))
+	addressSetBytes.WithLabelValues(name).Set(float64(s.Bytes()))
+}
+
+func forgetAddressSet(name string) {
+	addressSetAddresses.DeleteLabelValues(name)
+	addressSetBytes.DeleteLabelValues(name)
+}
+
+// Maps the hash onto a bit of the bloom filter without a modulo
+func (s *AddressSet) bit(h uint64) uint64 {
+	hi, _ := bits.Mul64(h, uint64(len(s.bloom))*64)
+	return hi
+}
+
+// Two independent hashes of the address for double hashing. Most addresses
+// are random already, the mixing spreads vanity and precompile addresses.
+func addressHashes(a common.Address) (uint64, uint64) {
+	var h1, h2 uint64 = 0xcbf29ce484222325, 0x9e3779b97f4a7c15
+	for _, b := range a {
+		h1 = (h1 ^ uint64(b)) * 0x100000001b3
+		h2 = (h2 ^ uint64(b)) * 0xff51afd7ed558ccd
+	}
+	h2 ^= h2 >> 33
+	return h1, h2 | 1
+}
+
+// Decodes a hex address without allocating
+func parseAddress(s string) (common.Address, bool) {
+	var a common.Address
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		s = s[2:]
+	}
+	if len(s) != 2*common.AddressLength {
+		return a, false
+	}
+	for i := range a {
+		hi, ok1 := hexNibble(s[2*i])
+		lo, ok2 := hexNibble(s[2*i+1])
+		if !ok1 || !ok2 {
+			return a, false
+		}
+		a[i] = hi<<4 | lo
+	}
+	return a, true
+}
+
+func hexNibble(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
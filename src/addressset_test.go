@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Random addresses, the same for every run
+func testAddresses(seed int64, n int) []common.Address {
+	r := rand.New(rand.NewSource(seed))
+	addresses := make([]common.Address, n)
+	for i := range addresses {
+		r.Read(addresses[i][:])
+	}
+	return addresses
+}
+
+func TestAddressSet(t *testing.T) {
+	s := NewAddressSet([]string{"0x90F79bf6EB2c4f870365E785982E1f101E93b906", "15d34aaf54267db7d7c367839aaf71a00a2c6a65", "0x0", "vitalik.eth"})
+	assert.Equal(t, 2, s.Len())
+	assert.True(t, s.Contains("0x90f79bf6eb2c4f870365e785982e1f101e93b906"))
+	assert.True(t, s.Contains("0X15D34AAF54267DB7D7C367839AAF71A00A2C6A65"))
+	assert.False(t, s.Contains("0x0"))
+	assert.False(t, s.Contains("0x70997970C51812dc3A010C7d01b50e0d17dc79C8"))
+	var none *AddressSet
+	assert.False(t, none.Contains("0x90F79bf6EB2c4f870365E785982E1f101E93b906"))
+	assert.False(t, NewAddressSet(nil).Contains("0x90F79bf6EB2c4f870365E785982E1f101E93b906"))
+
+	// No false negatives and few addresses past the bloom filter
+	in, out := testAddresses(1, 100000), testAddresses(2, 100000)
+	s = newAddressSet(in)
+	var passed int
+	for n := range in {
+		assert.True(t, s.ContainsAddress(in[n]))
+		if s.mayContain(out[n]) {
+			passed++
+		}
+	}
+	assert.Less(t, passed, 2000)
+	assert.Less(t, s.Bytes(), 64*len(in))
+}
+
+func TestFilterIndex(t *testing.T) {
+	status := uint64(1)
+	filters := map[int]*Filters{
+		1: {TxTo: "0xdac17f958d2ee523a2206206994597c13d831ec7"},
+		2: {From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", MinValue: "1"},
+		3: {Logs: []LogCriteria{{Address: "0x6B175474E89094C44Da98b954EedeAC495271d0F"}}},
+		4: {Match: "any", TxTo: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", ReceiptStatus: &status},
+		5: {TxTo: "0x0"},
+		6: {Deployer: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"},
+	}
+	ix := NewFilterIndex(filters)
+	assert.Equal(t, []int{4, 5}, ix.scan)
+	subjects := []FilterSubject{
+		{Tx: &Tx{TxFrom: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxValueWei: ether(1), TxReceiptStatus: 1}},
+		{Tx: &Tx{TxFrom: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", TxTo: "0x0", TxContractCreation: true}, Contract: &Contract{Creator: "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266"}},
+		{Tx: &Tx{TxTo: "0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC"}, Internal: []InternalTx{{From: "0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC", To: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}},
+			Logs: []*types.Log{{Address: common.HexToAddress("0x6B175474E89094C44Da98b954EedeAC495271d0F")}}},
+	}
+	for n, s := range subjects {
+		var want []int
+		for _, id := range sortedIds(filters) {
+			if filters[id].Matches(s) {
+				want = append(want, id)
+			}
+		}
+		assert.Equal(t, want, ix.Match(s), fmt.Sprint(n))
+	}
+	assert.Equal(t, []int{1, 2, 4}, ix.Match(subjects[0]))
+}
+
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// Lookups take the same time at every size, bytes/address is the estimate
+// of Bytes and heap-bytes/address what the set took from the heap
+func BenchmarkAddressSetContains(b *testing.B) {
+	for _, size := range []int{1000, 100000, 1000000} {
+		in := testAddresses(1, size)
+		lookups := make([]string, 1024)
+		for n, a := range testAddresses(2, len(lookups)) {
+			lookups[n] = strings.ToLower(a.Hex())
+		}
+		for n := 0; n < len(lookups); n += 16 {
+			lookups[n] = in[n/16].Hex() // Some hits
+		}
+		before := heapAlloc()
+		s := newAddressSet(in)
+		heap := heapAlloc() - before
+		runtime.KeepAlive(in)
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				s.Contains(lookups[n%len(lookups)])
+			}
+			b.ReportMetric(float64(s.Bytes())/float64(size), "bytes/address")
+			b.ReportMetric(float64(heap)/float64(size), "heap-bytes/address")
+		})
+		runtime.KeepAlive(s)
+	}
+}
+
+// A filter on a watchlist of up to a million addresses against a transaction
+// with internal transfers
+func BenchmarkWatchlistFilterMatch(b *testing.B) {
+	saved := store
+	defer func() { store = saved }()
+	for _, size := range []int{1000, 100000, 1000000} {
+		store = NewMemoryStore()
+		addresses := make(map[string]string, size)
+		for _, a := range testAddresses(1, size) {
+			addresses[strings.ToLower(a.Hex())] = ""
+		}
+		store.StoreWatchlist(Watchlist{Name: "exchanges", Addresses: addresses, Revision: 1})
+		watchlists, _ := loadWatchlists()
+		filters := map[int]*Filters{1: {Watchlist: "exchanges", MinValue: "1000000000000000000"}}
+		ix := NewFilterIndex(filters)
+		other := testAddresses(2, 4)
+		s := FilterSubject{
+			Tx:         &Tx{TxFrom: other[0].Hex(), TxTo: other[1].Hex(), TxValueWei: ether(2)},
+			Internal:   []InternalTx{{From: other[1].Hex(), To: other[2].Hex()}, {From: other[2].Hex(), To: other[3].Hex()}},
+			Watchlists: watchlists,
+		}
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				ix.Match(s)
+				WatchlistMatches(watchlists, &s)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var addressBalance = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "snoopy_address_balance_wei",
+	Help: "The current native balance of watched addresses",
+}, []string{"address"})
+
+type Balance struct {
+	Id          int    `json:"Id,omitempty"`
+	Address     string `json:"Address,omitempty"`
+	BlockId     int    `json:"BlockId,omitempty"`
+	BlockNumber uint64 `json:"BlockNumber,omitempty"`
+	Balance     string `json:"Balance,omitempty"` // Wei in decimal
+}
+
+var balanceMu sync.RWMutex
+var balanceById map[int]*Balance = make(map[int]*Balance)
+var balancesByAddress map[string][]*Balance = make(map[string][]*Balance)
+
+func BalanceStore(balance Balance) {
+	balanceMu.Lock()
+	defer balanceMu.Unlock()
+	balance.Id = len(balanceById) + 1
+	balanceById[balance.Id] = &balance
+	balancesByAddress[balance.Address] = append(balancesByAddress[balance.Address], &balance)
+}
+
+func BalanceHistory(address string) []*Balance {
+	balanceMu.RLock()
+	defer balanceMu.RUnlock()
+	return append([]*Balance(nil), balancesByAddress[address]...)
+}
+
+// Latest known balance of every watched address
+func CurrentBalances() map[string]*Balance {
+	balanceMu.RLock()
+	defer balanceMu.RUnlock()
+	current := make(map[string]*Balance)
+	for address, balances := range balancesByAddress {
+		if len(balances) > 0 {
+			current[address] = balances[len(balances)-1]
+		}
+	}
+	return current
+}
+
+// Addresses we have filters for, receivers and deployers alike
+func WatchedAddresses() *AddressSet {
+	var addresses []string
+	filters, err := store.Filters()
+	if err != nil {
+		log.Print(err)
+	}
+	for _, filter := range filters {
+		addresses = append(addresses, filter.TxTo, filter.Deployer, filter.From)
+	}
+	watched := NewAddressSet(addresses)
+	watched.report("watched")
+	return watched
+}
+
+// Looks up the balance of every touched watched address as of the processed block
+func snoopBalances(client *ethclient.Client, touched map[string]bool, blockId int, blockNumber *big.Int) {
+	watched := WatchedAddresses()
+	for address := range touched {
+		if !watched.Contains(address) {
+			continue
+		}
+		balance, err := client.BalanceAt(context.Background(), common.HexToAddress(address), blockNumber)
+		apiCallsProcessed.Inc()
+		if err != nil {
+			log.Print(err) // Log error and continue
+			continue
+		}
+		BalanceStore(Balance{Address: address, BlockId: blockId, BlockNumber: blockNumber.Uint64(), Balance: balance.String()})
+		wei, _ := new(big.Float).SetInt(balance).Float64()
+		addressBalance.WithLabelValues(address).Set(wei)
+		log.Println("Balance: " + address + " " + balance.String() + " at #" + blockNumber.String())
+	}
+}
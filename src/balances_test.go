@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBalanceStore(t *testing.T) {
+	BalanceStore(Balance{Address: "0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC", BlockId: 1, BlockNumber: 12232778, Balance: "1000000000000000000"})
+	BalanceStore(Balance{Address: "0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC", BlockId: 2, BlockNumber: 12232779, Balance: "25000000000000000000"})
+	assert.Equal(t, 2, len(BalanceHistory("0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC")))
+	assert.Equal(t, "25000000000000000000", CurrentBalances()["0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC"].Balance)
+}
+
+func TestWatchedAddresses(t *testing.T) {
+	AddFilter("0x90F79bf6EB2c4f870365E785982E1f101E93b906")
+	AddContractFilter("0x15d34AAf54267DB7D7c367839AAf71A00a2C6A65", "")
+	watched := WatchedAddresses()
+	assert.Equal(t, true, watched.Contains("0x90F79bf6EB2c4f870365E785982E1f101E93b906"))
+	assert.Equal(t, true, watched.Contains("0x15d34aaf54267db7d7c367839aaf71a00a2c6a65"))
+	assert.Equal(t, false, watched.Contains("0x0"))
+}
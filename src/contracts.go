@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+type Contract struct {
+	Id              int    `json:"Id,omitempty"`
+	Address         string `json:"Address,omitempty"`
+	Creator         string `json:"Creator,omitempty"`
+	CreationTxHash  string `json:"CreationTxHash,omitempty"`
+	CreationBlockId int    `json:"CreationBlockId,omitempty"`
+	CreationBlock   uint64 `json:"CreationBlock,omitempty"`
+	BytecodeHash    string `json:"BytecodeHash,omitempty"`
+}
+
+// Contracts are kept in memory by the ingesting instance only, they are not
+// part of the store and start out empty after a restart
+var contractMu sync.RWMutex
+var lastContractId int
+var contractById map[int]*Contract = make(map[int]*Contract)
+var contractByAddress map[string]*Contract = make(map[string]*Contract)
+var contractsByCreator map[string][]*Contract = make(map[string][]*Contract)
+var contractsByBytecodeHash map[string][]*Contract = make(map[string][]*Contract)
+
+// Stores the contract by address, a contract stored again (a block processed
+// twice) keeps its id and replaces the one stored. Whether it is new.
+func ContractStore(contract Contract) bool {
+	contractMu.Lock()
+	defer contractMu.Unlock()
+	existing, found := contractByAddress[contract.Address]
+	if found {
+		contract.Id = existing.Id
+		removeContract(existing)
+	} else if contract.Id == 0 {
+		lastContractId++
+		contract.Id = lastContractId
+	} else if contract.Id > lastContractId {
+		lastContractId = contract.Id
+	}
+	contractById[contract.Id] = &contract
+	contractByAddress[contract.Address] = &contract
+	contractsByCreator[contract.Creator] = append(contractsByCreator[contract.Creator], &contract)
+	contractsByBytecodeHash[contract.BytecodeHash] = append(contractsByBytecodeHash[contract.BytecodeHash], &contract)
+	return !found
+}
+
+func removeContract(contract *Contract) {
+	delete(contractById, contract.Id)
+	delete(contractByAddress, contract.Address)
+	memoryIndexRemove(contractsByCreator, contract.Creator, contract)
+	memoryIndexRemove(contractsByBytecodeHash, contract.BytecodeHash, contract)
+}
+
+// Drops the contracts created in blocks from number on, for a reorg.
+// Returns how many were dropped.
+func DeleteContractsFrom(number uint64) int {
+	contractMu.Lock()
+	defer contractMu.Unlock()
+	var dropped int
+	for _, contract := range contractById {
+		if contract.CreationBlock >= number {
+			removeContract(contract)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func Contracts() map[int]*Contract {
+	contractMu.RLock()
+	defer contractMu.RUnlock()
+	contracts := make(map[int]*Contract, len(contractById))
+	for id, contract := range contractById {
+		contracts[id] = contract
+	}
+	return contracts
+}
+
+func ContractByAddress(address string) *Contract {
+	contractMu.RLock()
+	defer contractMu.RUnlock()
+	return contractByAddress[address]
+}
+
+func ContractsByCreator(creator string) []*Contract {
+	contractMu.RLock()
+	defer contractMu.RUnlock()
+	return append([]*Contract(nil), contractsByCreator[creator]...)
+}
+
+// Fetches the runtime code deployed at address and records the contract,
+// the returned contract is what ended up in the contracts store.
+func snoopContractCreation(client *ethclient.Client, address common.Address, creator string, txHash string, blockId int, blockNumber *big.Int) *Contract {
+	var codeHash string
+	code, err := client.CodeAt(context.Background(), address, blockNumber)
+	if err != nil {
+		log.Print(err) // Log error and continue, store what we know
+	} else {
+		codeHash = crypto.Keccak256Hash(code).Hex()
+	}
+	apiCallsProcessed.Inc()
+	cContract := Contract{Address: address.Hex(), Creator: creator, CreationTxHash: txHash, CreationBlockId: blockId, CreationBlock: blockNumber.Uint64(), BytecodeHash: codeHash}
+	if ContractStore(cContract) {
+		contractsCreated.Inc()
+	}
+	return ContractByAddress(cContract.Address)
+}
+
+// A filter firing on contracts deployed by deployer or with the bytecode hash
+func contractFilter(deployer string, bytecodeHash string) Filters {
+	filter := Filters{Deployer: deployer, BytecodeHash: bytecodeHash}
+	if deployer != "" && bytecodeHash != "" {
+		filter.Match = "any"
+	}
+	return filter
+}
+
+func AddContractFilter(deployer string, bytecodeHash string) bool {
+	if deployer == "" && bytecodeHash == "" {
+		return false
+	}
+	if _, err := AddFilterCriteria(contractFilter(deployer, bytecodeHash)); err != nil {
+		log.Print(err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContractStore(t *testing.T) {
+	cContractRow := Contract{Id: 1, Address: "0x5FbDB2315678afecb367f032d93F642f64180aa3", Creator: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", CreationTxHash: "0x8f0f2b9e2d3cb0a4c4f1f8c6b5d3a4e0f0f1c0a5b3d2e1f0a9b8c7d6e5f4a3b2", CreationBlock: 12232778, BytecodeHash: "0x1f3b1b9a2bd0c0dba40e67c0a4f8a1d7e1c6c5a0e2c1e3b1d8f6c5a4b3c2d1e0"}
+	ContractStore(cContractRow)
+	assert.Equal(t, "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", ContractByAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3").Creator)
+	assert.Equal(t, 1, len(ContractsByCreator("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")))
+
+	// Stored again when its block is processed twice, listed once
+	cContractRow.Id = 0
+	assert.False(t, ContractStore(cContractRow))
+	assert.Equal(t, 1, len(ContractsByCreator("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")))
+	assert.Equal(t, 1, ContractByAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3").Id)
+	cContractRow.BytecodeHash = "0xabcdef"
+	ContractStore(cContractRow)
+	contractMu.RLock()
+	assert.Equal(t, 0, len(contractsByBytecodeHash["0x1f3b1b9a2bd0c0dba40e67c0a4f8a1d7e1c6c5a0e2c1e3b1d8f6c5a4b3c2d1e0"]))
+	assert.Equal(t, 1, len(contractsByBytecodeHash["0xabcdef"]))
+	contractMu.RUnlock()
+
+	// Contracts of reorged blocks are dropped
+	assert.Equal(t, 0, DeleteContractsFrom(12232779))
+	assert.Equal(t, 1, DeleteContractsFrom(12232778))
+	assert.Nil(t, ContractByAddress("0x5FbDB2315678afecb367f032d93F642f64180aa3"))
+	assert.Equal(t, 0, len(ContractsByCreator("0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266")))
+	assert.True(t, ContractStore(cContractRow))
+}
+
+func TestContractFilter(t *testing.T) {
+	cContract := Contract{Address: "0xe7f1725E7734CE288F8367e1Bb143E90bb3F0512", Creator: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", BytecodeHash: "0xabcdef"}
+	assert.Equal(t, false, matchStoredFilters(FilterSubject{Contract: &cContract}))
+	assert.Equal(t, false, AddContractFilter("", ""))
+	assert.Equal(t, true, AddContractFilter("0x70997970C51812dc3A010C7d01b50e0d17dc79C8", ""))
+	assert.Equal(t, true, matchStoredFilters(FilterSubject{Contract: &cContract}))
+	assert.Equal(t, true, AddContractFilter("", "0xABCDEF"))
+	filters, _ := store.FiltersByBytecodeHash("0xabcdef")
+	assert.Equal(t, 1, len(filters))
+	assert.Equal(t, false, matchStoredFilters(FilterSubject{}))
+}
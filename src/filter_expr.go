@@ -0,0 +1,859 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+)
+
+// Filter expressions are a small CEL-like language over the transaction and
+// its logs, e.g. tx.value > 10e18 && tx.to in ["0x...", "0x..."]. They are
+// parsed and type checked once when the filter is added, an expression that
+// refers to log is evaluated for every log of the transaction and matches
+// when it holds for any of them. watchlist("name") is the named watchlist as
+// it is when the transaction is matched, addresses are looked up in it with in.
+type FilterExpr struct {
+	Source     string
+	root       *exprNode
+	usesLog    bool
+	watchlists []string // Names passed to watchlist()
+}
+
+// A syntax or type error and the column it was found at
+type FilterExprError struct {
+	Column int
+	Msg    string
+}
+
+func (e *FilterExprError) Error() string {
+	return fmt.Sprintf("expression: %s at column %d", e.Msg, e.Column)
+}
+
+func exprErrorf(pos int, format string, args ...interface{}) error {
+	return &FilterExprError{Column: pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Expressions longer than this are refused
+const filterExprMaxLen = 4096
+
+type exprType struct {
+	kind string
+	elem *exprType
+}
+
+var (
+	exprBool      = &exprType{kind: "bool"}
+	exprInt       = &exprType{kind: "int"}
+	exprString    = &exprType{kind: "string"}
+	exprAddress   = &exprType{kind: "address"}
+	exprTx        = &exprType{kind: "tx"}
+	exprLog       = &exprType{kind: "log"}
+	exprWatchlist = &exprType{kind: "watchlist"}
+)
+
+func exprList(elem *exprType) *exprType {
+	return &exprType{kind: "list", elem: elem}
+}
+
+func (t *exprType) String() string {
+	if t.kind == "list" {
+		if t.elem == nil {
+			return "list"
+		}
+		return "list(" + t.elem.String() + ")"
+	}
+	return t.kind
+}
+
+// Strings and addresses, mostly hex, compare without regard to case
+func (t *exprType) textual() bool {
+	return t.kind == "string" || t.kind == "address"
+}
+
+func exprComparable(a *exprType, b *exprType) bool {
+	switch {
+	case a.textual() && b.textual():
+		return true
+	case a.kind == "list" && b.kind == "list":
+		return a.elem == nil || b.elem == nil || exprComparable(a.elem, b.elem)
+	}
+	return a.kind == b.kind && a.kind != "tx" && a.kind != "log" && a.kind != "watchlist"
+}
+
+// Fields of the tx and log variables
+var exprFields = map[string]map[string]*exprType{
+	"tx": {
+		"hash":             exprString,
+		"from":             exprAddress,
+		"to":               exprAddress,
+		"value":            exprInt,
+		"gas":              exprInt,
+		"gasPrice":         exprInt,
+		"nonce":            exprInt,
+		"status":           exprInt,
+		"index":            exprInt,
+		"blockNumber":      exprInt,
+		"blockTime":        exprInt,
+		"input":            exprString,
+		"selector":         exprString,
+		"contractCreation": exprBool,
+		"contractAddress":  exprAddress,
+	},
+	"log": {
+		"address": exprAddress,
+		"topics":  exprList(exprString),
+		"data":    exprString,
+		"index":   exprInt,
+	},
+}
+
+type exprNode struct {
+	op    string
+	pos   int
+	name  string
+	value interface{}
+	args  []*exprNode
+	typ   *exprType
+	// Calls written as receiver.name(...)
+	method bool
+}
+
+type exprToken struct {
+	kind string
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", ".", "?", ":"}
+
+func lexFilterExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	n := 0
+	for n < len(src) {
+		c := src[n]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			n++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := n
+			for n < len(src) && (src[n] == '_' || src[n] >= 'a' && src[n] <= 'z' || src[n] >= 'A' && src[n] <= 'Z' || src[n] >= '0' && src[n] <= '9') {
+				n++
+			}
+			tokens = append(tokens, exprToken{"ident", src[start:n], start})
+		case c >= '0' && c <= '9':
+			start := n
+			if strings.HasPrefix(src[n:], "0x") || strings.HasPrefix(src[n:], "0X") {
+				n += 2
+				for n < len(src) && strings.IndexByte("0123456789abcdefABCDEF", src[n]) >= 0 {
+					n++
+				}
+			} else {
+				for n < len(src) && src[n] >= '0' && src[n] <= '9' {
+					n++
+				}
+				if n+1 < len(src) && src[n] == '.' && src[n+1] >= '0' && src[n+1] <= '9' {
+					n++
+					for n < len(src) && src[n] >= '0' && src[n] <= '9' {
+						n++
+					}
+				}
+				if n < len(src) && (src[n] == 'e' || src[n] == 'E') {
+					n++
+					if n < len(src) && (src[n] == '+' || src[n] == '-') {
+						n++
+					}
+					for n < len(src) && src[n] >= '0' && src[n] <= '9' {
+						n++
+					}
+				}
+			}
+			tokens = append(tokens, exprToken{"number", src[start:n], start})
+		case c == '"' || c == '\'':
+			start := n
+			var text strings.Builder
+			n++
+			for {
+				if n >= len(src) {
+					return nil, exprErrorf(start, "unterminated string")
+				}
+				if src[n] == c {
+					n++
+					break
+				}
+				if src[n] == '\\' && n+1 < len(src) {
+					n++
+					switch src[n] {
+					case 'n':
+						text.WriteByte('\n')
+					case 't':
+						text.WriteByte('\t')
+					case '\\', '"', '\'':
+						text.WriteByte(src[n])
+					default:
+						return nil, exprErrorf(n-1, "unknown escape \\%c", src[n])
+					}
+					n++
+					continue
+				}
+				text.WriteByte(src[n])
+				n++
+			}
+			tokens = append(tokens, exprToken{"string", text.String(), start})
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[n:], op) {
+					tokens = append(tokens, exprToken{"op", op, n})
+					n += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, exprErrorf(n, "unexpected character %q", c)
+			}
+		}
+	}
+	return append(tokens, exprToken{"eof", "", len(src)}), nil
+}
+
+type exprParser struct {
+	tokens []exprToken
+	n      int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.n]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.n]
+	if t.kind != "eof" {
+		p.n++
+	}
+	return t
+}
+
+func (p *exprParser) expect(op string) error {
+	t := p.next()
+	if t.kind != "op" || t.text != op {
+		return exprErrorf(t.pos, "expected %s, found %s", op, t.describe())
+	}
+	return nil
+}
+
+func (t exprToken) describe() string {
+	if t.kind == "eof" {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "in": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5,
+}
+
+func (p *exprParser) binaryOp() (string, int) {
+	t := p.peek()
+	if t.kind == "op" || (t.kind == "ident" && t.text == "in") {
+		if prec, ok := exprPrecedence[t.text]; ok {
+			return t.text, prec
+		}
+	}
+	return "", 0
+}
+
+// cond ? a : b binds loosest
+func (p *exprParser) parseExpr() (*exprNode, error) {
+	cond, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == "op" && t.text == "?" {
+		p.next()
+		then, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		otherwise, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNode{op: "?:", pos: t.pos, args: []*exprNode{cond, then, otherwise}}, nil
+	}
+	return cond, nil
+}
+
+func (p *exprParser) parseBinary(minPrec int) (*exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec := p.binaryOp()
+		if prec < minPrec || prec == 0 {
+			return left, nil
+		}
+		t := p.next()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &exprNode{op: op, pos: t.pos, args: []*exprNode{left, right}}
+	}
+}
+
+func (p *exprParser) parseUnary() (*exprNode, error) {
+	if t := p.peek(); t.kind == "op" && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		op := "!"
+		if t.text == "-" {
+			op = "neg"
+		}
+		return &exprNode{op: op, pos: t.pos, args: []*exprNode{operand}}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parseArgs(close string) ([]*exprNode, error) {
+	var args []*exprNode
+	if t := p.peek(); t.kind == "op" && t.text == close {
+		p.next()
+		return args, nil
+	}
+	for {
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		t := p.next()
+		if t.kind == "op" && t.text == close {
+			return args, nil
+		}
+		if t.kind != "op" || t.text != "," {
+			return nil, exprErrorf(t.pos, "expected , or %s, found %s", close, t.describe())
+		}
+	}
+}
+
+func (p *exprParser) parsePostfix() (*exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == "op" && t.text == ".":
+			p.next()
+			name := p.next()
+			if name.kind != "ident" {
+				return nil, exprErrorf(name.pos, "expected a field or method name, found %s", name.describe())
+			}
+			if next := p.peek(); next.kind == "op" && next.text == "(" {
+				p.next()
+				args, err := p.parseArgs(")")
+				if err != nil {
+					return nil, err
+				}
+				node = &exprNode{op: "call", pos: name.pos, name: name.text, args: append([]*exprNode{node}, args...), method: true}
+			} else {
+				node = &exprNode{op: "member", pos: name.pos, name: name.text, args: []*exprNode{node}}
+			}
+		case t.kind == "op" && t.text == "[":
+			p.next()
+			index, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &exprNode{op: "index", pos: t.pos, args: []*exprNode{node, index}}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (*exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "number":
+		v, err := parseExprNumber(t.text)
+		if err != nil {
+			return nil, exprErrorf(t.pos, "%s", err)
+		}
+		return &exprNode{op: "lit", pos: t.pos, value: v, typ: exprInt}, nil
+	case "string":
+		return &exprNode{op: "lit", pos: t.pos, value: t.text, typ: exprString}, nil
+	case "ident":
+		switch t.text {
+		case "true", "false":
+			return &exprNode{op: "lit", pos: t.pos, value: t.text == "true", typ: exprBool}, nil
+		}
+		if next := p.peek(); next.kind == "op" && next.text == "(" {
+			p.next()
+			args, err := p.parseArgs(")")
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{op: "call", pos: t.pos, name: t.text, args: args}, nil
+		}
+		return &exprNode{op: "ident", pos: t.pos, name: t.text}, nil
+	case "op":
+		switch t.text {
+		case "(":
+			node, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			args, err := p.parseArgs("]")
+			if err != nil {
+				return nil, err
+			}
+			return &exprNode{op: "list", pos: t.pos, args: args}, nil
+		}
+	}
+	return nil, exprErrorf(t.pos, "unexpected %s", t.describe())
+}
+
+// Numbers are exact integers, 10e18 and 1.5e9 are fine, 0.5 is not
+func parseExprNumber(text string) (*big.Int, error) {
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		v, ok := new(big.Int).SetString(text[2:], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid number %s", text)
+		}
+		return v, nil
+	}
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %s", text)
+	}
+	if !r.IsInt() {
+		return nil, fmt.Errorf("number %s is not a whole number", text)
+	}
+	return r.Num(), nil
+}
+
+// A function or method, the receiver of a method is its first argument
+type exprFunction struct {
+	method bool
+	args   []func(*exprType) bool
+	result *exprType
+	call   func(args []interface{}) interface{}
+}
+
+var exprFunctions = map[string]exprFunction{
+	"size": {
+		args:   []func(*exprType) bool{func(t *exprType) bool { return t.textual() || t.kind == "list" }},
+		result: exprInt,
+		call: func(args []interface{}) interface{} {
+			if list, ok := args[0].([]interface{}); ok {
+				return big.NewInt(int64(len(list)))
+			}
+			return big.NewInt(int64(len(args[0].(string))))
+		},
+	},
+	"startsWith": exprStringMethod(strings.HasPrefix),
+	"endsWith":   exprStringMethod(strings.HasSuffix),
+	"contains":   exprStringMethod(strings.Contains),
+}
+
+func exprStringMethod(fn func(string, string) bool) exprFunction {
+	textual := func(t *exprType) bool { return t.textual() }
+	return exprFunction{
+		method: true,
+		args:   []func(*exprType) bool{textual, textual},
+		result: exprBool,
+		call: func(args []interface{}) interface{} {
+			return fn(strings.ToLower(args[0].(string)), strings.ToLower(args[1].(string)))
+		},
+	}
+}
+
+// Sets the type of every node, reporting the first mismatch
+func (e *FilterExpr) check(n *exprNode) error {
+	for _, arg := range n.args {
+		if err := e.check(arg); err != nil {
+			return err
+		}
+	}
+	operand := func(i int) *exprType { return n.args[i].typ }
+	switch n.op {
+	case "lit":
+	case "ident":
+		switch n.name {
+		case "tx":
+			n.typ = exprTx
+		case "log":
+			n.typ = exprLog
+			e.usesLog = true
+		default:
+			return exprErrorf(n.pos, "unknown identifier %s, use tx or log", n.name)
+		}
+	case "member":
+		fields, ok := exprFields[operand(0).kind]
+		if !ok {
+			return exprErrorf(n.pos, "%s has no fields", operand(0))
+		}
+		if n.typ = fields[n.name]; n.typ == nil {
+			return exprErrorf(n.pos, "unknown field %s.%s", operand(0), n.name)
+		}
+	case "index":
+		if operand(0).kind != "list" {
+			return exprErrorf(n.pos, "cannot index %s", operand(0))
+		}
+		if operand(1) != exprInt {
+			return exprErrorf(n.args[1].pos, "list index is %s, not int", operand(1))
+		}
+		if operand(0).elem == nil {
+			// An empty list, there is nothing to index
+			return exprErrorf(n.pos, "cannot index an empty list")
+		}
+		n.typ = operand(0).elem
+	case "list":
+		var elem *exprType
+		for _, arg := range n.args {
+			switch {
+			case elem == nil:
+				elem = arg.typ
+			case !exprComparable(elem, arg.typ):
+				return exprErrorf(arg.pos, "list mixes %s and %s", elem, arg.typ)
+			case elem.kind != arg.typ.kind:
+				elem = exprString
+			}
+		}
+		n.typ = exprList(elem)
+	case "call":
+		if n.name == "watchlist" && !n.method {
+			if len(n.args) != 1 || n.args[0].op != "lit" || operand(0) != exprString {
+				return exprErrorf(n.pos, "watchlist takes a name in quotes")
+			}
+			e.watchlists = append(e.watchlists, n.args[0].value.(string))
+			n.typ = exprWatchlist
+			break
+		}
+		fn, ok := exprFunctions[n.name]
+		if !ok || (fn.method && !n.method) {
+			return exprErrorf(n.pos, "unknown function %s", n.name)
+		}
+		if len(n.args) != len(fn.args) {
+			receiver := 0
+			if n.method {
+				receiver = 1
+			}
+			return exprErrorf(n.pos, "%s takes %d arguments, got %d", n.name, len(fn.args)-receiver, len(n.args)-receiver)
+		}
+		for i, accepts := range fn.args {
+			if !accepts(operand(i)) {
+				return exprErrorf(n.args[i].pos, "%s does not take %s", n.name, operand(i))
+			}
+		}
+		n.typ = fn.result
+	case "!":
+		if operand(0) != exprBool {
+			return exprErrorf(n.pos, "! needs bool, not %s", operand(0))
+		}
+		n.typ = exprBool
+	case "neg":
+		if operand(0) != exprInt {
+			return exprErrorf(n.pos, "- needs int, not %s", operand(0))
+		}
+		n.typ = exprInt
+	case "&&", "||":
+		if operand(0) != exprBool || operand(1) != exprBool {
+			return exprErrorf(n.pos, "%s needs bool operands, not %s and %s", n.op, operand(0), operand(1))
+		}
+		n.typ = exprBool
+	case "==", "!=":
+		if !exprComparable(operand(0), operand(1)) {
+			return exprErrorf(n.pos, "cannot compare %s %s %s", operand(0), n.op, operand(1))
+		}
+		n.typ = exprBool
+	case "<", "<=", ">", ">=":
+		if !(operand(0) == exprInt && operand(1) == exprInt) && !(operand(0).textual() && operand(1).textual()) {
+			return exprErrorf(n.pos, "cannot compare %s %s %s", operand(0), n.op, operand(1))
+		}
+		n.typ = exprBool
+	case "in":
+		if operand(1) == exprWatchlist {
+			if !operand(0).textual() {
+				return exprErrorf(n.pos, "cannot look for %s in %s", operand(0), operand(1))
+			}
+			n.typ = exprBool
+			break
+		}
+		if operand(1).kind != "list" {
+			return exprErrorf(n.pos, "in needs a list or watchlist on the right, not %s", operand(1))
+		}
+		if operand(1).elem != nil && !exprComparable(operand(0), operand(1).elem) {
+			return exprErrorf(n.pos, "cannot look for %s in %s", operand(0), operand(1))
+		}
+		n.typ = exprBool
+	case "+":
+		if !(operand(0) == exprInt && operand(1) == exprInt) && !(operand(0) == exprString && operand(1) == exprString) {
+			return exprErrorf(n.pos, "cannot add %s and %s", operand(0), operand(1))
+		}
+		n.typ = operand(0)
+	case "-", "*", "/", "%":
+		if operand(0) != exprInt || operand(1) != exprInt {
+			return exprErrorf(n.pos, "%s needs int operands, not %s and %s", n.op, operand(0), operand(1))
+		}
+		n.typ = exprInt
+	case "?:":
+		if operand(0) != exprBool {
+			return exprErrorf(n.pos, "condition is %s, not bool", operand(0))
+		}
+		if !exprComparable(operand(1), operand(2)) {
+			return exprErrorf(n.pos, "branches are %s and %s", operand(1), operand(2))
+		}
+		n.typ = operand(1)
+	}
+	return nil
+}
+
+// Parses and type checks an expression, it has to be bool
+func CompileFilterExpr(src string) (*FilterExpr, error) {
+	if len(src) > filterExprMaxLen {
+		return nil, fmt.Errorf("expression: longer than %d characters", filterExprMaxLen)
+	}
+	tokens, err := lexFilterExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, exprErrorf(t.pos, "unexpected %s", t.describe())
+	}
+	e := &FilterExpr{Source: src, root: root}
+	if err := e.check(root); err != nil {
+		return nil, err
+	}
+	if root.typ != exprBool {
+		return nil, exprErrorf(root.pos, "expression is %s, not bool", root.typ)
+	}
+	return e, nil
+}
+
+// Compiled expressions by source, filters are matched against every transaction
+var filterExprCache sync.Map
+
+func cachedFilterExpr(src string) (*FilterExpr, error) {
+	if e, ok := filterExprCache.Load(src); ok {
+		return e.(*FilterExpr), nil
+	}
+	e, err := CompileFilterExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	filterExprCache.Store(src, e)
+	return e, nil
+}
+
+func exprTxFields(s *FilterSubject) map[string]interface{} {
+	tx := s.Tx
+	selector := ""
+	if len(s.Input) >= 4 {
+		selector = "0x" + hex.EncodeToString(s.Input[:4])
+	}
+	return map[string]interface{}{
+		"hash":             tx.TxHash,
+		"from":             tx.TxFrom,
+		"to":               tx.TxTo,
+		"value":            tx.ValueWei(),
+		"gas":              new(big.Int).SetUint64(tx.TxGas),
+		"gasPrice":         new(big.Int).SetUint64(tx.TxGasPrice),
+		"nonce":            new(big.Int).SetUint64(tx.TxNonce),
+		"status":           new(big.Int).SetUint64(tx.TxReceiptStatus),
+		"index":            new(big.Int).SetUint64(tx.TxIndex),
+		"blockNumber":      new(big.Int).SetUint64(tx.TxBlockNumber),
+		"blockTime":        new(big.Int).SetUint64(tx.TxBlockTime),
+		"input":            "0x" + hex.EncodeToString(s.Input),
+		"selector":         selector,
+		"contractCreation": tx.TxContractCreation,
+		"contractAddress":  tx.TxContractAddress,
+	}
+}
+
+// Whether the expression holds for the transaction, or for any of its logs
+// when it refers to log. Errors while evaluating, like an index out of
+// range, do not match.
+func (e *FilterExpr) Matches(s *FilterSubject) bool {
+	if s.Tx == nil {
+		return false
+	}
+	// $ cannot start an identifier, the watchlists are out of reach of expressions
+	vars := map[string]interface{}{"tx": exprTxFields(s), "$watchlists": s.Watchlists}
+	if !e.usesLog {
+		v, err := e.root.eval(vars)
+		return err == nil && v.(bool)
+	}
+	for _, l := range s.Logs {
+		topics := make([]interface{}, len(l.Topics))
+		for n, topic := range l.Topics {
+			topics[n] = topic.Hex()
+		}
+		vars["log"] = map[string]interface{}{
+			"address": l.Address.Hex(),
+			"topics":  topics,
+			"data":    "0x" + hex.EncodeToString(l.Data),
+			"index":   big.NewInt(int64(l.Index)),
+		}
+		if v, err := e.root.eval(vars); err == nil && v.(bool) {
+			return true
+		}
+	}
+	return false
+}
+
+func exprEqual(a interface{}, b interface{}) bool {
+	switch a := a.(type) {
+	case *big.Int:
+		return a.Cmp(b.(*big.Int)) == 0
+	case string:
+		return strings.EqualFold(a, b.(string))
+	case []interface{}:
+		list := b.([]interface{})
+		if len(a) != len(list) {
+			return false
+		}
+		for n := range a {
+			if !exprEqual(a[n], list[n]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func (n *exprNode) eval(vars map[string]interface{}) (interface{}, error) {
+	switch n.op {
+	case "lit":
+		return n.value, nil
+	case "ident":
+		return vars[n.name], nil
+	case "&&", "||":
+		left, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if left.(bool) == (n.op == "||") {
+			return left, nil
+		}
+		return n.args[1].eval(vars)
+	case "?:":
+		cond, err := n.args[0].eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		if cond.(bool) {
+			return n.args[1].eval(vars)
+		}
+		return n.args[2].eval(vars)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	textual := func(i int) bool {
+		return n.args[i].typ.textual()
+	}
+	switch n.op {
+	case "member":
+		return args[0].(map[string]interface{})[n.name], nil
+	case "index":
+		list, i := args[0].([]interface{}), args[1].(*big.Int)
+		if !i.IsInt64() || i.Int64() < 0 || i.Int64() >= int64(len(list)) {
+			return nil, fmt.Errorf("index %s out of range", i)
+		}
+		return list[i.Int64()], nil
+	case "list":
+		return args, nil
+	case "call":
+		if n.name == "watchlist" && !n.method {
+			watchlists, _ := vars["$watchlists"].(map[string]*Watchlist)
+			return watchlists[args[0].(string)], nil
+		}
+		return exprFunctions[n.name].call(args), nil
+	case "!":
+		return !args[0].(bool), nil
+	case "neg":
+		return new(big.Int).Neg(args[0].(*big.Int)), nil
+	case "==":
+		return exprEqual(args[0], args[1]), nil
+	case "!=":
+		return !exprEqual(args[0], args[1]), nil
+	case "<", "<=", ">", ">=":
+		var c int
+		if textual(0) {
+			c = strings.Compare(strings.ToLower(args[0].(string)), strings.ToLower(args[1].(string)))
+		} else {
+			c = args[0].(*big.Int).Cmp(args[1].(*big.Int))
+		}
+		switch n.op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	case "in":
+		if watchlist, ok := args[1].(*Watchlist); ok {
+			return watchlist.Contains(args[0].(string)), nil
+		}
+		for _, v := range args[1].([]interface{}) {
+			if exprEqual(args[0], v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "+":
+		if textual(0) {
+			return args[0].(string) + args[1].(string), nil
+		}
+		return new(big.Int).Add(args[0].(*big.Int), args[1].(*big.Int)), nil
+	case "-":
+		return new(big.Int).Sub(args[0].(*big.Int), args[1].(*big.Int)), nil
+	case "*":
+		return new(big.Int).Mul(args[0].(*big.Int), args[1].(*big.Int)), nil
+	case "/", "%":
+		a, b := args[0].(*big.Int), args[1].(*big.Int)
+		if b.Sign() == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if n.op == "/" {
+			return new(big.Int).Quo(a, b), nil
+		}
+		return new(big.Int).Rem(a, b), nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
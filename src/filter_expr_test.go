@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterExprMatches(t *testing.T) {
+	s := FilterSubject{
+		Tx:    &Tx{TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxFrom: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxValueWei: ether(12), TxGasPrice: 30e9, TxReceiptStatus: 1, TxBlockNumber: 12232752},
+		Input: common.FromHex("0xa9059cbb00000000000000000000000070997970c51812dc3a010c7d01b50e0d17dc79c8"),
+		Logs: []*types.Log{
+			{Address: common.HexToAddress("0x6B175474E89094C44Da98b954EedeAC495271d0F"), Topics: []common.Hash{common.HexToHash("0x8c5be1e5ebec7d5bd14f71427d1e84f3dd0314c0f7b2291e5b200ac8c7c3b925")}},
+			{Address: common.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7"), Topics: []common.Hash{common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"), common.HexToHash("0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266")}, Index: 7},
+		},
+	}
+	for expr, want := range map[string]bool{
+		`tx.value > 10e18`: true,
+		`tx.value > 10e18 && tx.to in ["0xdac17f958d2ee523a2206206994597c13d831ec7"]`:                                   true,
+		`tx.value >= 12.5e18 || tx.status == 0`:                                                                         false,
+		`tx.from == "0xF39FD6E51AAD88F6F4CE6AB8827279CFFFB92266"`:                                                       true,
+		`!(tx.to in []) && tx.selector == "0xa9059cbb"`:                                                                 true,
+		`tx.input.startsWith("0xA9059CBB") && size(tx.input) == 74`:                                                     true,
+		`tx.gasPrice * 21000 < 1e15`:                                                                                    true,
+		`tx.value / 0 > 1`:                                                                                              false,
+		`tx.blockNumber % 2 == 0 ? tx.contractCreation : tx.value > 0`:                                                  false,
+		`log.address == tx.to && log.topics[0] == "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"`: true,
+		`log.topics[1].endsWith(tx.from.contains("f39f") ? "2266" : "x") && log.index == 7`:                             true,
+		`log.topics[2] == tx.from`:                                                                                      false,
+		`size(log.topics) > 2`:                                                                                          false,
+		`tx.hash.contains('\'')`:                                                                                        false,
+	} {
+		e, err := CompileFilterExpr(expr)
+		if !assert.Nil(t, err, expr) {
+			continue
+		}
+		assert.Equal(t, want, e.Matches(&s), expr)
+	}
+	e, _ := CompileFilterExpr(`log.address != ""`)
+	assert.False(t, e.Matches(&FilterSubject{Tx: s.Tx}))
+	assert.False(t, e.Matches(&FilterSubject{Logs: s.Logs}))
+}
+
+func TestFilterExprErrors(t *testing.T) {
+	for expr, want := range map[string]string{
+		`tx.value > "10"`:            "expression: cannot compare int > string at column 10",
+		`tx.valu > 1`:                "expression: unknown field tx.valu at column 4",
+		`value > 1`:                  "expression: unknown identifier value, use tx or log at column 1",
+		`tx.value`:                   "expression: expression is int, not bool at column 4",
+		`tx.value > 0.5`:             "expression: number 0.5 is not a whole number at column 12",
+		`tx.to in "0x0"`:             "expression: in needs a list or watchlist on the right, not string at column 7",
+		`tx.to in [1, "0x0"]`:        "expression: list mixes int and string at column 14",
+		`tx.value > 1 &&`:            "expression: unexpected end of expression at column 16",
+		`(tx.value > 1`:              "expression: expected ), found end of expression at column 14",
+		`tx.value > 1 # 2`:           "expression: unexpected character '#' at column 14",
+		`tx.hash == "0x`:             "expression: unterminated string at column 12",
+		`lower(tx.hash) == ""`:       "expression: unknown function lower at column 1",
+		`startsWith(tx.hash, "0x")`:  "expression: unknown function startsWith at column 1",
+		`tx.hash.startsWith()`:       "expression: startsWith takes 1 arguments, got 0 at column 9",
+		`size(tx.value) > 0`:         "expression: size does not take int at column 9",
+		`log.topics["0"] == ""`:      "expression: list index is string, not int at column 12",
+		`tx.status == 1 ? 1 : "one"`: "expression: branches are int and string at column 16",
+		`tx == tx`:                   "expression: cannot compare tx == tx at column 4",
+		`[][0] == 1`:                 "expression: cannot index an empty list at column 3",
+		`(true ? [] : [1])[0] == 1`:  "expression: cannot index an empty list at column 18",
+		`size([][0]) > 0`:            "expression: cannot index an empty list at column 8",
+		`[][0]`:                      "expression: cannot index an empty list at column 3",
+	} {
+		_, err := CompileFilterExpr(expr)
+		if assert.NotNil(t, err, expr) {
+			assert.Equal(t, want, err.Error(), expr)
+		}
+	}
+}
+
+func TestFilterExpression(t *testing.T) {
+	f := Filters{Expression: `tx.value > 10e18`}
+	assert.Nil(t, f.normalize())
+	assert.True(t, f.Matches(FilterSubject{Tx: &Tx{TxValueWei: ether(11)}}))
+	assert.False(t, f.Matches(FilterSubject{Tx: &Tx{TxValueWei: ether(10)}}))
+	f = Filters{Expression: `tx.value > 10e18`, From: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", Match: "any"}
+	assert.Nil(t, f.normalize())
+	assert.True(t, f.Matches(FilterSubject{Tx: &Tx{TxFrom: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"}}))
+	f = Filters{Expression: `tx.value >`}
+	assert.NotNil(t, f.normalize())
+}
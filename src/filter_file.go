@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	filterFileReloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_filter_file_reloads_total",
+		Help: "The total number of filter file versions applied to the filters",
+	})
+	filterFileErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_filter_file_errors_total",
+		Help: "The total number of filter file versions rejected, the filters stay as they were",
+	})
+)
+
+// Parses a YAML or JSON filter file, either a list of filters or a document
+// with the list under filters. Each filter takes the fields of /filteradd and
+// a name that is unique within the file. A filter that does not check rejects
+// the whole file.
+func ParseFilterFile(data []byte) ([]Filters, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		doc = m["filters"]
+	}
+	// Through JSON so the file reads like the API requests
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var requests []ProcessSnoopFilterAddRequest
+	if err := json.Unmarshal(raw, &requests); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(requests))
+	filters := make([]Filters, 0, len(requests))
+	for n, pr := range requests {
+		if pr.Name == "" {
+			return nil, fmt.Errorf("filter %d has no name", n)
+		}
+		if names[pr.Name] {
+			return nil, fmt.Errorf("filter name %q is used more than once", pr.Name)
+		}
+		names[pr.Name] = true
+		filter, err := pr.filter()
+		if err == nil {
+			err = filter.normalize()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", pr.Name, err)
+		}
+		filter.ReadOnly = true
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// Brings the read-only filters of the store in line with the filters of the
+// file by name. Changed filters keep their id, new ones are run over the
+// history, filters added through the API are left alone.
+func ReconcileFileFilters(filters []Filters) error {
+	stored, err := store.Filters()
+	if err != nil {
+		return err
+	}
+	managed := make(map[string]*Filters)
+	for _, id := range sortedIds(stored) {
+		filter := stored[id]
+		if !filter.ReadOnly {
+			continue
+		}
+		if _, ok := managed[filter.Name]; ok {
+			// Added twice by instances loading the same file at once
+			if err := store.DeleteFilter(id); err != nil {
+				return err
+			}
+			continue
+		}
+		managed[filter.Name] = filter
+	}
+	for _, filter := range filters {
+		existing, ok := managed[filter.Name]
+		delete(managed, filter.Name)
+		if ok {
+			filter.Id = existing.Id
+			// Counted matches, a deactivation and the revision stay while the
+			// filter is the same
+			filter.MatchCount, filter.DeactivatedBlock, filter.Revision = existing.MatchCount, existing.DeactivatedBlock, existing.Revision
+			if sameFilter(filter, *existing) {
+				continue
+			}
+			filter.MatchCount, filter.DeactivatedBlock = 0, 0
+		} else {
+			id, err := store.NextFilterId()
+			if err != nil {
+				return err
+			}
+			filter.Id = id
+		}
+		filter.Revision = time.Now().UnixNano()
+		if err := store.StoreFilter(filter); err != nil {
+			return err
+		}
+		s, _ := json.Marshal(filter)
+		if ok {
+			log.Println("Updated Filter: " + string(s))
+			continue
+		}
+		log.Println("Added Filter: " + string(s))
+		if _, err := BackfillFilter(&filter); err != nil {
+			log.Print(err) // Log error and keep the filter
+		}
+	}
+	names := make([]string, 0, len(managed))
+	for name := range managed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := store.DeleteFilter(managed[name].Id); err != nil {
+			return err
+		}
+		FilterStatsForget(managed[name].Id)
+		log.Println("Deleted Filter " + fmt.Sprint(managed[name].Id) + " " + name)
+	}
+	return nil
+}
+
+// Compared as stored, an empty list and no list are the same
+func sameFilter(a, b Filters) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	return err == nil && bytes.Equal(x, y)
+}
+
+type filterFile struct {
+	path string
+	// Content last applied and last rejected
+	sum    [sha256.Size]byte
+	failed [sha256.Size]byte
+}
+
+// Applies the file if its content changed since the last load. A file that
+// cannot be read or parsed leaves the filters as they are, a rejected version
+// is not tried again.
+func (ff *filterFile) load() error {
+	data, err := os.ReadFile(ff.path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if sum == ff.sum || sum == ff.failed {
+		return nil
+	}
+	filters, err := ParseFilterFile(data)
+	if err != nil {
+		ff.failed = sum
+		return fmt.Errorf("%s: %w", ff.path, err)
+	}
+	if err := ReconcileFileFilters(filters); err != nil {
+		return err
+	}
+	ff.sum = sum
+	filterFileReloads.Inc()
+	log.Println("Loaded " + fmt.Sprint(len(filters)) + " filters from " + ff.path)
+	return nil
+}
+
+// Loads the filter file and checks it for changes every
+// SNOOPY_FILTER_FILE_INTERVAL, 0 loads it once. The file is polled rather
+// than watched as a mounted ConfigMap is updated by swapping a symlink.
+func WatchFilterFile(path string) {
+	ff := &filterFile{path: path}
+	if err := ff.load(); err != nil {
+		log.Print(err) // Log error and retry with the next check
+		filterFileErrors.Inc()
+	}
+	interval := 30 * time.Second
+	if v := os.Getenv("SNOOPY_FILTER_FILE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Print(err) // Log error and use the default
+		} else {
+			interval = d
+		}
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := ff.load(); err != nil {
+				log.Print(err) // Log error and keep the filters
+				filterFileErrors.Inc()
+			}
+		}
+	}()
+}
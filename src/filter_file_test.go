@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testFilterFile = `
+filters:
+  - name: hot-wallet-failed
+    from: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+    minValue: 5ether
+    receiptStatus: 0
+  - name: usdt-transfers
+    methodSelector: "0xA9059CBB"
+    logs:
+      - address: "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+`
+
+func TestParseFilterFile(t *testing.T) {
+	filters, err := ParseFilterFile([]byte(testFilterFile))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(filters))
+	assert.Equal(t, "hot-wallet-failed", filters[0].Name)
+	assert.Equal(t, "5000000000000000000", filters[0].MinValue)
+	assert.Equal(t, "0xa9059cbb", filters[1].MethodSelector)
+	assert.True(t, filters[1].ReadOnly)
+
+	// JSON and a bare list read the same
+	filters, err = ParseFilterFile([]byte(`[{"name": "usdt", "to": "0xdAC17F958D2ee523a2206206994597C13D831ec7"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, "0xdAC17F958D2ee523a2206206994597C13D831ec7", filters[0].TxTo)
+	filters, err = ParseFilterFile([]byte(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(filters))
+
+	for file, want := range map[string]string{
+		`[{"to": "0x0"}]`: "filter 0 has no name",
+		`[{"name": "a", "to": "0x0"}, {"name": "a", "to": "0x1"}]`: `filter name "a" is used more than once`,
+		`[{"name": "a", "methodSelector": "transfer"}]`:            `filter "a": invalid method selector "transfer", use four bytes like 0xa9059cbb`,
+	} {
+		_, err := ParseFilterFile([]byte(file))
+		if assert.NotNil(t, err, file) {
+			assert.Equal(t, want, err.Error(), file)
+		}
+	}
+	_, err = ParseFilterFile([]byte("filters: [name: a"))
+	assert.NotNil(t, err)
+}
+
+func TestReconcileFileFilters(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	assert.True(t, AddFilter("0xdAC17F958D2ee523a2206206994597C13D831ec7"))
+	path := filepath.Join(t.TempDir(), "filters.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(testFilterFile), 0644))
+	ff := &filterFile{path: path}
+	assert.Nil(t, ff.load())
+	filters, _ := store.Filters()
+	assert.Equal(t, 3, len(filters))
+	assert.Equal(t, "hot-wallet-failed", filters[2].Name)
+	revision := filters[2].Revision
+	assert.NotZero(t, revision)
+
+	// Changed filters keep their id and get a new revision, removed ones are deleted
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Replace(testFilterFile, "5ether", "6ether", 1)[:strings.Index(testFilterFile, "  - name: usdt")]), 0644))
+	assert.Nil(t, ff.load())
+	filters, _ = store.Filters()
+	assert.Equal(t, 2, len(filters))
+	assert.Equal(t, "6000000000000000000", filters[2].MinValue)
+	assert.NotEqual(t, revision, filters[2].Revision)
+	assert.False(t, filters[1].ReadOnly)
+
+	// A broken file leaves the filters alone
+	assert.Nil(t, os.WriteFile(path, []byte(`[{"name": "a"}]`), 0644))
+	assert.NotNil(t, ff.load())
+	assert.Nil(t, ff.load())
+	n, _ := store.NumFilters()
+	assert.Equal(t, 2, n)
+
+	// Loading into a store that has the filters keeps their ids
+	files, _ := ParseFilterFile([]byte(testFilterFile))
+	assert.Nil(t, ReconcileFileFilters(files))
+	assert.Nil(t, ReconcileFileFilters(files))
+	filters, _ = store.Filters()
+	assert.Equal(t, 3, len(filters))
+	assert.Equal(t, "5000000000000000000", filters[2].MinValue)
+	assert.Equal(t, "usdt-transfers", filters[4].Name)
+
+	// A deactivation and the revision survive loading the same filter again
+	expired := *filters[4]
+	expired.DeactivatedBlock = 100
+	assert.Nil(t, store.StoreFilter(expired))
+	assert.Nil(t, ReconcileFileFilters(files))
+	filter, _ := store.FilterById(4)
+	assert.Equal(t, uint64(100), filter.DeactivatedBlock)
+	assert.Equal(t, expired.Revision, filter.Revision)
+}
+
+func TestFileFiltersReadOnly(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	filters, _ := ParseFilterFile([]byte(testFilterFile))
+	assert.Nil(t, ReconcileFileFilters(filters))
+	a := App{}
+	w := httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 1, "to": "0x0"}`)))
+	assert.Equal(t, 403, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterDeleteIdRequest(w, httptest.NewRequest("POST", "/filterdelete", strings.NewReader(`{"id": 2}`)))
+	assert.Equal(t, 403, w.Code)
+	n, _ := store.NumFilters()
+	assert.Equal(t, 2, n)
+}
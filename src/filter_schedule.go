@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var filterDeactivations = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "snoopy_filter_deactivations_total",
+	Help: "The total number of filters deactivated for running past ValidUntil or reaching MaxMatches",
+}, []string{"state"})
+
+// Lifecycle states of a filter as /filters reports them
+const (
+	FilterScheduled = "scheduled" // Before ValidFrom
+	FilterActive    = "active"
+	FilterExpired   = "expired"   // Past ValidUntil
+	FilterExhausted = "exhausted" // Reached MaxMatches
+)
+
+// A block number or a time bounding when a filter is active, given as a
+// number or a string. Block numbers are kept as digits, times in RFC 3339 UTC.
+type FilterBound string
+
+func (b *FilterBound) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*b = FilterBound(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*b = FilterBound(n)
+	return nil
+}
+
+// The block number or the unix time of the bound, one of them is set
+func (b FilterBound) parse() (number uint64, t uint64, err error) {
+	s := strings.TrimSpace(string(b))
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, 0, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil || parsed.Unix() <= 0 {
+		return 0, 0, fmt.Errorf("invalid bound %q, use a block number or a time like 2022-10-19T12:00:00Z", string(b))
+	}
+	return 0, uint64(parsed.Unix()), nil
+}
+
+// Whether a block with the number and time comes before the bound
+func (b FilterBound) before(number uint64, t uint64) bool {
+	n, bt, err := b.parse()
+	if err != nil {
+		return false
+	}
+	if bt > 0 {
+		return t < bt
+	}
+	return number < n
+}
+
+// Whether a block with the number and time comes after the bound
+func (b FilterBound) after(number uint64, t uint64) bool {
+	n, bt, err := b.parse()
+	if err != nil {
+		return false
+	}
+	if bt > 0 {
+		return t > bt
+	}
+	return number > n
+}
+
+// Checks the bounds and MaxMatches and brings the bounds into the form they
+// are kept in
+func (f *Filters) normalizeSchedule() error {
+	bounds := []struct {
+		name  string
+		value *FilterBound
+	}{{"ValidFrom", &f.ValidFrom}, {"ValidUntil", &f.ValidUntil}}
+	for _, bound := range bounds {
+		if strings.TrimSpace(string(*bound.value)) == "" {
+			*bound.value = ""
+			continue
+		}
+		n, t, err := bound.value.parse()
+		if err != nil {
+			return fmt.Errorf("%s: %w", bound.name, err)
+		}
+		if t > 0 {
+			*bound.value = FilterBound(time.Unix(int64(t), 0).UTC().Format(time.RFC3339))
+		} else {
+			*bound.value = FilterBound(strconv.FormatUint(n, 10))
+		}
+	}
+	if f.ValidFrom != "" && f.ValidUntil != "" {
+		fromNumber, fromTime, _ := f.ValidFrom.parse()
+		untilNumber, untilTime, _ := f.ValidUntil.parse()
+		if (fromTime > 0) == (untilTime > 0) && (fromTime > untilTime || fromNumber > untilNumber) {
+			return fmt.Errorf("ValidFrom is after ValidUntil")
+		}
+	}
+	if f.MaxMatches < 0 {
+		return fmt.Errorf("invalid MaxMatches %d, use a positive count or leave it out", f.MaxMatches)
+	}
+	return nil
+}
+
+// The lifecycle state of the filter at a block with the number and time
+func (f *Filters) State(number uint64, t uint64) string {
+	switch {
+	case f.MaxMatches > 0 && f.MatchCount >= f.MaxMatches:
+		return FilterExhausted
+	case f.DeactivatedBlock > 0 || f.ValidUntil.after(number, t):
+		return FilterExpired
+	case f.ValidFrom.before(number, t):
+		return FilterScheduled
+	}
+	return FilterActive
+}
+
+// The block number and time the API reports lifecycle states at, the last
+// stored block and the current time
+func filterClock() (number uint64, t uint64) {
+	if id, err := store.LastBlockId(); err == nil && id > 0 {
+		if block, err := store.BlockById(id); err == nil && block != nil {
+			number = block.BlockNumber
+		}
+	}
+	return number, uint64(time.Now().Unix())
+}
+
+// Whether the filter compiled into c matches the subject at the block, within
+// its bounds and MaxMatches. The match is counted in the filter.
+func (f *Filters) takes(c *compiledFilter, s FilterSubject, number uint64) bool {
+	if f.State(number, s.Tx.TxBlockTime) != FilterActive || !c.matches(&s) {
+		return false
+	}
+	if f.MaxMatches > 0 {
+		f.MatchCount++
+	}
+	return true
+}
+
+// Deactivates the filter at the block if it expired or reached MaxMatches
+func (f *Filters) deactivate(number uint64, t uint64) {
+	state := f.State(number, t)
+	if f.DeactivatedBlock > 0 || (state != FilterExpired && state != FilterExhausted) {
+		return
+	}
+	f.DeactivatedBlock = number
+	filterDeactivations.WithLabelValues(state).Inc()
+	log.Println("Deactivated Filter " + fmt.Sprint(f.Id) + ": " + state + " at #" + fmt.Sprint(number))
+}
+
+// The filters a block is matched against. Filters that expired are
+// deactivated and those with MaxMatches counted, Store writes both back once
+// the block is processed.
+type FilterSchedule struct {
+	// The filters active at the block
+	Active  map[int]*Filters
+	filters map[int]*Filters
+	number  uint64
+	time    uint64
+	matches map[int]int64
+	expired []int
+}
+
+func NewFilterSchedule(filters map[int]*Filters, number uint64, t uint64) *FilterSchedule {
+	fs := &FilterSchedule{Active: make(map[int]*Filters, len(filters)), filters: filters, number: number, time: t, matches: make(map[int]int64)}
+	for _, id := range sortedIds(filters) {
+		filter := filters[id]
+		switch filter.State(number, t) {
+		case FilterActive:
+			fs.Active[id] = filter
+		case FilterExpired:
+			if filter.DeactivatedBlock == 0 {
+				fs.expired = append(fs.expired, id)
+			}
+		}
+	}
+	return fs
+}
+
+// Counts the matches of a transaction, dropping the filters that already
+// reached MaxMatches in the block
+func (fs *FilterSchedule) Take(ids []int) []int {
+	var taken []int
+	for _, id := range ids {
+		filter := fs.Active[id]
+		if filter.MaxMatches > 0 {
+			if filter.MatchCount+fs.matches[id] >= filter.MaxMatches {
+				continue
+			}
+			fs.matches[id]++
+		}
+		taken = append(taken, id)
+	}
+	return taken
+}
+
+// Writes the match counts and deactivations of the block. A filter changed
+// through the API while the block was processed is left as it is now.
+func (fs *FilterSchedule) Store() {
+	ids := append([]int(nil), fs.expired...)
+	for id := range fs.matches {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		stored, err := store.FilterById(id)
+		if err != nil {
+			log.Print(err) // Log error and try again with the next block
+			continue
+		}
+		if stored == nil || !sameFilter(*stored, *fs.filters[id]) {
+			continue // Deleted or replaced since
+		}
+		filter := *stored
+		filter.MatchCount += fs.matches[id]
+		filter.deactivate(fs.number, fs.time)
+		if err := store.StoreFilter(filter); err != nil {
+			log.Print(err) // Log error and try again with the next block
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterScheduleNormalize(t *testing.T) {
+	var pr ProcessSnoopFilterAddRequest
+	assert.Nil(t, json.Unmarshal([]byte(`{"from": "0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266", "validFrom": 15537394, "validUntil": "2022-10-19T14:00:00+02:00", "maxMatches": 3}`), &pr))
+	filter, err := pr.filter()
+	assert.Nil(t, err)
+	assert.Nil(t, filter.normalize())
+	assert.Equal(t, FilterBound("15537394"), filter.ValidFrom)
+	assert.Equal(t, FilterBound("2022-10-19T12:00:00Z"), filter.ValidUntil)
+	assert.Equal(t, int64(3), filter.MaxMatches)
+	assert.False(t, pr.legacy())
+
+	for _, c := range []struct {
+		filter Filters
+		msg    string
+	}{
+		{Filters{TxTo: "0x0", ValidUntil: "tomorrow"}, `ValidUntil: invalid bound "tomorrow", use a block number or a time like 2022-10-19T12:00:00Z`},
+		{Filters{TxTo: "0x0", ValidFrom: "200", ValidUntil: "100"}, "ValidFrom is after ValidUntil"},
+		{Filters{TxTo: "0x0", ValidFrom: "2022-10-20T00:00:00Z", ValidUntil: "2022-10-19T00:00:00Z"}, "ValidFrom is after ValidUntil"},
+		{Filters{TxTo: "0x0", MaxMatches: -1}, "invalid MaxMatches -1, use a positive count or leave it out"},
+	} {
+		assert.EqualError(t, c.filter.normalize(), c.msg)
+	}
+	// A block number and a time do not compare
+	assert.Nil(t, (&Filters{TxTo: "0x0", ValidFrom: "2022-10-20T00:00:00Z", ValidUntil: "100"}).normalize())
+}
+
+func TestFilterState(t *testing.T) {
+	filter := Filters{ValidFrom: "100", ValidUntil: "2022-10-19T12:00:00Z", MaxMatches: 2}
+	assert.Equal(t, FilterScheduled, filter.State(99, 1666180800))
+	assert.Equal(t, FilterActive, filter.State(100, 1666180800))
+	assert.Equal(t, FilterExpired, filter.State(100, 1666180801))
+	filter.MatchCount = 2
+	assert.Equal(t, FilterExhausted, filter.State(100, 1666180800))
+	assert.Equal(t, FilterExpired, (&Filters{DeactivatedBlock: 100}).State(99, 0))
+	assert.Equal(t, FilterActive, (&Filters{}).State(0, 0))
+}
+
+func TestFilterSchedule(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	for _, filter := range []Filters{
+		{Id: 1, TxTo: "0x0", ValidUntil: "99"},
+		{Id: 2, TxTo: "0x0", ValidFrom: "101"},
+		{Id: 3, TxTo: "0x0", MaxMatches: 2},
+		{Id: 4, TxTo: "0x0", MaxMatches: 5},
+		{Id: 5, TxTo: "0x0"},
+	} {
+		assert.Nil(t, store.StoreFilter(filter))
+	}
+	filters, _ := store.Filters()
+	schedule := NewFilterSchedule(filters, 100, 1666180800)
+	assert.Equal(t, []int{3, 4, 5}, sortedIds(schedule.Active))
+	assert.Equal(t, []int{3, 4, 5}, schedule.Take([]int{3, 4, 5}))
+	assert.Equal(t, []int{3, 4}, schedule.Take([]int{3, 4}))
+	assert.Equal(t, []int{4, 5}, schedule.Take([]int{3, 4, 5}))
+
+	// A filter replaced while the block was processed is left alone
+	assert.Nil(t, store.StoreFilter(Filters{Id: 4, TxTo: "0x0", MaxMatches: 10}))
+	schedule.Store()
+	for id, want := range map[int]Filters{
+		1: {Id: 1, TxTo: "0x0", ValidUntil: "99", DeactivatedBlock: 100},
+		2: {Id: 2, TxTo: "0x0", ValidFrom: "101"},
+		3: {Id: 3, TxTo: "0x0", MaxMatches: 2, MatchCount: 2, DeactivatedBlock: 100},
+		4: {Id: 4, TxTo: "0x0", MaxMatches: 10},
+		5: {Id: 5, TxTo: "0x0"},
+	} {
+		filter, _ := store.FilterById(id)
+		assert.Equal(t, want, *filter, id)
+	}
+	filters, _ = store.Filters()
+	assert.Equal(t, []int{2, 4, 5}, sortedIds(NewFilterSchedule(filters, 101, 1666180812).Active))
+}
+
+func TestUpdateExhaustedFilter(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	assert.Nil(t, store.StoreBlock(Block{Id: 1, BlockHash: "0xb1", BlockNumber: 100}))
+	assert.Nil(t, store.StoreFilter(Filters{Id: 1, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", MaxMatches: 2, MatchCount: 2, DeactivatedBlock: 90}))
+	a := App{}
+
+	// New criteria under the same MaxMatches keep the filter exhausted
+	w := httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 1, "to": "0xA090e606E30bD747d4E6245a1517EbE430F0057e", "maxMatches": 2}`)))
+	assert.Equal(t, 200, w.Code)
+	var updated FilterWithStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, FilterExhausted, updated.State)
+	filter, _ := store.FilterById(1)
+	assert.Equal(t, "0xA090e606E30bD747d4E6245a1517EbE430F0057e", filter.TxTo)
+	assert.Equal(t, int64(2), filter.MatchCount)
+	assert.Equal(t, uint64(100), filter.DeactivatedBlock)
+
+	// Raising MaxMatches brings it back with the matches counted so far
+	w = httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 1, "to": "0xA090e606E30bD747d4E6245a1517EbE430F0057e", "maxMatches": 5}`)))
+	assert.Equal(t, 200, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, FilterActive, updated.State)
+	filter, _ = store.FilterById(1)
+	assert.Equal(t, int64(2), filter.MatchCount)
+	assert.Equal(t, uint64(0), filter.DeactivatedBlock)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 2, "to": "0xA090e606E30bD747d4E6245a1517EbE430F0057e"}`)))
+	assert.Equal(t, 404, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 1, "to": "missing"}`)))
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestBackfillFilterSchedule(t *testing.T) {
+	defer testHistory(t)()
+	// The hot wallet sent three transactions over 5 ETH, two in block 100
+	added, err := AddFilterCriteria(Filters{From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", MinValue: "5ether", MaxMatches: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), added.MatchCount)
+	assert.Equal(t, uint64(100), added.DeactivatedBlock)
+	stored, _ := store.FilterById(added.Id)
+	assert.Equal(t, FilterExhausted, stored.State(101, 0))
+	tx, _ := store.TxByHash("0x03")
+	assert.Nil(t, tx)
+
+	run := DryRunFilter(&Filters{From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", ValidFrom: "101"}, 0)
+	assert.Equal(t, 1, run.Matches)
+	assert.Equal(t, "0x03", run.Txs[0].TxHash)
+}
+
+func TestFilterScheduleRequests(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	assert.Nil(t, store.StoreBlock(Block{Id: 1, BlockHash: "0xb1", BlockNumber: 15537394}))
+	a := App{}
+
+	w := httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "validFrom": 15537400}`)))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "validUntil": "2022-10-19T12:00:00Z"}`)))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "maxMatches": 1}`)))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "validUntil": "soon"}`)))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	a.snoopFiltersRequest(w, httptest.NewRequest("GET", "/filters", nil))
+	var filters map[int]FilterWithStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &filters))
+	assert.Equal(t, FilterScheduled, filters[1].State)
+	assert.Equal(t, FilterExpired, filters[2].State)
+	assert.Equal(t, FilterActive, filters[3].State)
+	assert.Equal(t, int64(1), filters[3].MaxMatches)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterUpdateRequest(w, httptest.NewRequest("POST", "/filterupdate", strings.NewReader(`{"id": 3, "to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "validFrom": 15537400}`)))
+	assert.Equal(t, 200, w.Code)
+	var updated FilterWithStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &updated))
+	assert.Equal(t, 3, updated.Id)
+	assert.Equal(t, FilterScheduled, updated.State)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	filterMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "snoopy_filter_matches_total",
+		Help: "The total number of transactions matched by the filter",
+	}, []string{"id", "name"})
+	filterMatchedValue = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "snoopy_filter_matched_value_eth_total",
+		Help: "The total value of the transactions matched by the filter, in ETH",
+	}, []string{"id", "name"})
+)
+
+// Matches of a filter counted by this instance since it started
+type FilterStats struct {
+	Matches        int64  `json:"Matches"`
+	LastMatchBlock uint64 `json:"LastMatchBlock,omitempty"`
+	LastMatchTime  uint64 `json:"LastMatchTime,omitempty"`
+	// Total value of the matched transactions in wei as a decimal string
+	MatchedValue string `json:"MatchedValue,omitempty"`
+	value        *big.Int
+	name         string // Label of the metrics
+}
+
+// A filter as the API returns it, with its lifecycle state and matches
+type FilterWithStats struct {
+	Filters
+	State string      `json:"State"`
+	Stats FilterStats `json:"Stats"`
+}
+
+var (
+	filterStatsMu sync.RWMutex
+	filterStats   = make(map[int]*FilterStats)
+)
+
+// Counts a transaction matched by the filter
+func FilterStatsRecord(filter *Filters, tx *Tx) {
+	filterStatsMu.Lock()
+	defer filterStatsMu.Unlock()
+	id := fmt.Sprint(filter.Id)
+	stats := filterStats[filter.Id]
+	if stats == nil {
+		stats = &FilterStats{value: new(big.Int), name: filter.Name}
+		filterStats[filter.Id] = stats
+	}
+	if stats.name != filter.Name {
+		// Renamed, the series continue under the new name
+		filterMatches.DeletePartialMatch(prometheus.Labels{"id": id})
+		filterMatchedValue.DeletePartialMatch(prometheus.Labels{"id": id})
+		stats.name = filter.Name
+	}
+	stats.Matches++
+	// Backfilled matches can be older than the last one
+	if tx.TxBlockNumber >= stats.LastMatchBlock {
+		stats.LastMatchBlock, stats.LastMatchTime = tx.TxBlockNumber, tx.TxBlockTime
+	}
+	value := tx.ValueWei()
+	stats.value.Add(stats.value, value)
+	stats.MatchedValue = stats.value.String()
+	filterMatches.WithLabelValues(id, filter.Name).Inc()
+	eth, _ := new(big.Float).Quo(new(big.Float).SetInt(value), big.NewFloat(1e18)).Float64()
+	filterMatchedValue.WithLabelValues(id, filter.Name).Add(eth)
+}
+
+// Matches of the filter, zero if it has none
+func FilterStatsOf(id int) FilterStats {
+	filterStatsMu.RLock()
+	defer filterStatsMu.RUnlock()
+	if stats := filterStats[id]; stats != nil {
+		return *stats
+	}
+	return FilterStats{}
+}
+
+// Drops the matches and metrics of a deleted filter
+func FilterStatsForget(id int) {
+	filterStatsMu.Lock()
+	defer filterStatsMu.Unlock()
+	delete(filterStats, id)
+	filterMatches.DeletePartialMatch(prometheus.Labels{"id": fmt.Sprint(id)})
+	filterMatchedValue.DeletePartialMatch(prometheus.Labels{"id": fmt.Sprint(id)})
+}
+
+// The filter with its state at the block number and time, see filterClock
+func withStats(filter *Filters, number uint64, t uint64) FilterWithStats {
+	return FilterWithStats{Filters: *filter, State: filter.State(number, t), Stats: FilterStatsOf(filter.Id)}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterStatsRecord(t *testing.T) {
+	saved := filterStats
+	filterStats = make(map[int]*FilterStats)
+	defer func() { filterStats = saved }()
+	filter := Filters{Id: 901, Name: "hot-wallet", From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"}
+	FilterStatsRecord(&filter, &Tx{TxBlockNumber: 101, TxBlockTime: 1651499052, TxValueWei: ether(20)})
+	FilterStatsRecord(&filter, &Tx{TxBlockNumber: 100, TxBlockTime: 1651499040, TxValue: 5e17})
+	stats := FilterStatsOf(901)
+	assert.Equal(t, int64(2), stats.Matches)
+	assert.Equal(t, uint64(101), stats.LastMatchBlock)
+	assert.Equal(t, uint64(1651499052), stats.LastMatchTime)
+	assert.Equal(t, "20500000000000000000", stats.MatchedValue)
+	assert.Equal(t, float64(2), testutil.ToFloat64(filterMatches.WithLabelValues("901", "hot-wallet")))
+	assert.InDelta(t, 20.5, testutil.ToFloat64(filterMatchedValue.WithLabelValues("901", "hot-wallet")), 1e-9)
+
+	// A renamed filter keeps its stats, the metrics move to the new name
+	filter.Name = "treasury"
+	FilterStatsRecord(&filter, &Tx{TxBlockNumber: 102})
+	assert.Equal(t, int64(3), FilterStatsOf(901).Matches)
+	assert.Equal(t, float64(1), testutil.ToFloat64(filterMatches.WithLabelValues("901", "treasury")))
+	assert.Equal(t, 0, filterMatches.DeletePartialMatch(prometheus.Labels{"id": "901", "name": "hot-wallet"}))
+
+	FilterStatsForget(901)
+	assert.Equal(t, FilterStats{}, FilterStatsOf(901))
+	assert.Equal(t, 0, filterMatchedValue.DeletePartialMatch(prometheus.Labels{"id": "901"}))
+}
+
+func TestFilterStatsRequests(t *testing.T) {
+	savedStore, savedStats := store, filterStats
+	store, filterStats = NewMemoryStore(), make(map[int]*FilterStats)
+	defer func() { store, filterStats = savedStore, savedStats }()
+	added, err := AddFilterCriteria(Filters{Name: "usdt", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	assert.Nil(t, err)
+	assert.Nil(t, store.StoreFilter(Filters{Id: added.Id + 1, TxTo: "0x0"}))
+	FilterStatsRecord(added, &Tx{TxBlockNumber: 12232752, TxValueWei: ether(1)})
+	a := App{}
+
+	w := httptest.NewRecorder()
+	a.snoopFilterIdRequest(w, httptest.NewRequest("POST", "/filterid", strings.NewReader(`{"id": 1}`)))
+	var filter FilterWithStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &filter))
+	assert.Equal(t, "usdt", filter.Name)
+	assert.Equal(t, FilterStats{Matches: 1, LastMatchBlock: 12232752, MatchedValue: "1000000000000000000"}, filter.Stats)
+
+	w = httptest.NewRecorder()
+	a.snoopFiltersRequest(w, httptest.NewRequest("GET", "/filters", nil))
+	var filters map[int]FilterWithStats
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &filters))
+	assert.Equal(t, int64(1), filters[1].Stats.Matches)
+	assert.Equal(t, int64(0), filters[2].Stats.Matches)
+	assert.Contains(t, w.Body.String(), `"Stats":{"Matches":0}`)
+
+	assert.True(t, DeleteFilter(1))
+	assert.Equal(t, int64(0), FilterStatsOf(1).Matches)
+}
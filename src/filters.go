@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// A log emitted by the transaction, an empty address or topic matches any
+type LogCriteria struct {
+	Address string   `json:"Address,omitempty"`
+	Topics  []string `json:"Topics,omitempty"`
+}
+
+func (c LogCriteria) matches(l *types.Log) bool {
+	if c.Address != "" && !strings.EqualFold(c.Address, l.Address.Hex()) {
+		return false
+	}
+	for n, topic := range c.Topics {
+		if topic == "" {
+			continue
+		}
+		if n >= len(l.Topics) || !strings.EqualFold(topic, l.Topics[n].Hex()) {
+			return false
+		}
+	}
+	return true
+}
+
+// What filters are matched against, a transaction with the input and logs of
+// its receipt, the contract it deployed and its traced internal transfers.
+// Criteria on a part that is missing do not match.
+type FilterSubject struct {
+	Tx       *Tx
+	Input    []byte
+	Logs     []*types.Log
+	Contract *Contract
+	Internal []InternalTx
+	// By name, as they were when the subject was matched
+	Watchlists map[string]*Watchlist
+}
+
+type filterCriterion func(s *FilterSubject) bool
+
+// The criteria set on the filter
+func (f *Filters) criteria() []filterCriterion {
+	var c []filterCriterion
+	if f.TxTo != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			if s.Tx != nil && strings.EqualFold(s.Tx.TxTo, f.TxTo) {
+				return true
+			}
+			for _, itx := range s.Internal {
+				if strings.EqualFold(itx.To, f.TxTo) || strings.EqualFold(itx.From, f.TxTo) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if f.From != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Tx != nil && strings.EqualFold(s.Tx.TxFrom, f.From)
+		})
+	}
+	if f.Watchlist != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			watchlist := s.Watchlists[f.Watchlist]
+			if s.Tx != nil && (watchlist.Contains(s.Tx.TxFrom) || watchlist.Contains(s.Tx.TxTo)) {
+				return true
+			}
+			for _, itx := range s.Internal {
+				if watchlist.Contains(itx.To) || watchlist.Contains(itx.From) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if f.Deployer != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Contract != nil && strings.EqualFold(s.Contract.Creator, f.Deployer)
+		})
+	}
+	if f.BytecodeHash != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Contract != nil && s.Contract.BytecodeHash != "" && strings.EqualFold(s.Contract.BytecodeHash, f.BytecodeHash)
+		})
+	}
+	if f.MinValue != "" || f.MaxValue != "" {
+		min, _ := new(big.Int).SetString(f.MinValue, 10)
+		max, _ := new(big.Int).SetString(f.MaxValue, 10)
+		c = append(c, func(s *FilterSubject) bool {
+			if s.Tx == nil {
+				return false
+			}
+			v := s.Tx.ValueWei()
+			return (min == nil || v.Cmp(min) >= 0) && (max == nil || v.Cmp(max) <= 0)
+		})
+	}
+	if f.MinGasPrice > 0 || f.MaxGasPrice > 0 {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Tx != nil && s.Tx.TxGasPrice >= f.MinGasPrice && (f.MaxGasPrice == 0 || s.Tx.TxGasPrice <= f.MaxGasPrice)
+		})
+	}
+	if f.ReceiptStatus != nil {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Tx != nil && s.Tx.TxReceiptStatus == *f.ReceiptStatus
+		})
+	}
+	if f.MethodSelector != "" {
+		c = append(c, func(s *FilterSubject) bool {
+			return len(s.Input) >= 4 && "0x"+hex.EncodeToString(s.Input[:4]) == f.MethodSelector
+		})
+	}
+	if f.ContractCreation != nil {
+		c = append(c, func(s *FilterSubject) bool {
+			return s.Tx != nil && s.Tx.TxContractCreation == *f.ContractCreation
+		})
+	}
+	for _, criteria := range f.Logs {
+		criteria := criteria
+		c = append(c, func(s *FilterSubject) bool {
+			for _, l := range s.Logs {
+				if criteria.matches(l) {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	if f.Expression != "" {
+		expr, err := cachedFilterExpr(f.Expression)
+		c = append(c, func(s *FilterSubject) bool {
+			return err == nil && expr.Matches(s)
+		})
+	}
+	return c
+}
+
+// The criteria of a filter built once for matching many subjects
+type compiledFilter struct {
+	filter   *Filters // A copy, the criteria read it
+	anyOf    bool
+	criteria []filterCriterion
+}
+
+func compileFilter(f *Filters) *compiledFilter {
+	c := *f
+	return &compiledFilter{filter: &c, anyOf: c.Match == "any", criteria: c.criteria()}
+}
+
+func (c *compiledFilter) matches(s *FilterSubject) bool {
+	if len(c.criteria) == 0 {
+		return false
+	}
+	for _, criterion := range c.criteria {
+		if criterion(s) == c.anyOf {
+			return c.anyOf
+		}
+	}
+	return !c.anyOf
+}
+
+// Whether all criteria of the filter hold for the subject, or any of them
+// with Match any. A filter without criteria matches nothing.
+func (f *Filters) Matches(s FilterSubject) bool {
+	return compileFilter(f).matches(&s)
+}
+
+// Ids of the filters matching the subject in ascending order
+func MatchFilters(filters map[int]*Filters, s FilterSubject) []int {
+	return NewFilterIndex(filters).Match(s)
+}
+
+// Filters by an address they require, so a transaction is only matched
+// against the filters on addresses it touches and those without one
+type FilterIndex struct {
+	filters   map[int]*compiledFilter
+	addresses *AddressSet
+	byAddress map[common.Address][]int
+	scan      []int // Matched against every subject
+}
+
+// The index ingestion last matched against
+var (
+	filterIndexMu sync.Mutex
+	filterIndex   *FilterIndex
+)
+
+// An index of the filters that reuses the last one while the filters keep
+// their revisions, and the compiled criteria of every filter that kept its
+// revision. Filters without a revision are compiled every time.
+func loadFilterIndex(filters map[int]*Filters) *FilterIndex {
+	filterIndexMu.Lock()
+	defer filterIndexMu.Unlock()
+	if filterIndex != nil && filterIndex.builtFrom(filters) {
+		return filterIndex
+	}
+	filterIndex = newFilterIndex(filters, filterIndex)
+	return filterIndex
+}
+
+func NewFilterIndex(filters map[int]*Filters) *FilterIndex {
+	return newFilterIndex(filters, nil)
+}
+
+func newFilterIndex(filters map[int]*Filters, previous *FilterIndex) *FilterIndex {
+	ix := &FilterIndex{filters: make(map[int]*compiledFilter, len(filters)), byAddress: make(map[common.Address][]int)}
+	var keys []common.Address
+	for _, id := range sortedIds(filters) {
+		filter := filters[id]
+		if previous != nil && previous.current(id, filter) {
+			ix.filters[id] = previous.filters[id]
+		} else {
+			ix.filters[id] = compileFilter(filter)
+		}
+		key, ok := parseAddress(filter.requiredAddress())
+		if !ok {
+			ix.scan = append(ix.scan, id)
+			continue
+		}
+		ix.byAddress[key] = append(ix.byAddress[key], id)
+		keys = append(keys, key)
+	}
+	ix.addresses = newAddressSet(keys)
+	ix.addresses.report("filters")
+	return ix
+}
+
+// Whether the filter was compiled into the index at its revision
+func (ix *FilterIndex) current(id int, filter *Filters) bool {
+	compiled := ix.filters[id]
+	return compiled != nil && filter.Revision != 0 && compiled.filter.Revision == filter.Revision
+}
+
+// Whether the index holds exactly the filters, each at its revision
+func (ix *FilterIndex) builtFrom(filters map[int]*Filters) bool {
+	if len(ix.filters) != len(filters) {
+		return false
+	}
+	for id, filter := range filters {
+		if !ix.current(id, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// An address every match of the filter touches, if it has one
+func (f *Filters) requiredAddress() string {
+	switch {
+	case f.Match == "any":
+		return ""
+	case f.TxTo != "":
+		return f.TxTo
+	case f.From != "":
+		return f.From
+	case f.Deployer != "":
+		return f.Deployer
+	}
+	for _, criteria := range f.Logs {
+		if criteria.Address != "" {
+			return criteria.Address
+		}
+	}
+	return ""
+}
+
+// Ids of the filters matching the subject in ascending order
+func (ix *FilterIndex) Match(s FilterSubject) []int {
+	candidates := append([]int(nil), ix.scan...)
+	touch := func(address string) {
+		if a, ok := parseAddress(address); ok && ix.addresses.ContainsAddress(a) {
+			candidates = append(candidates, ix.byAddress[a]...)
+		}
+	}
+	if s.Tx != nil {
+		touch(s.Tx.TxFrom)
+		touch(s.Tx.TxTo)
+	}
+	for _, itx := range s.Internal {
+		touch(itx.From)
+		touch(itx.To)
+	}
+	if s.Contract != nil {
+		touch(s.Contract.Creator)
+	}
+	for _, l := range s.Logs {
+		if ix.addresses.ContainsAddress(l.Address) {
+			candidates = append(candidates, ix.byAddress[l.Address]...)
+		}
+	}
+	sort.Ints(candidates)
+	var ids []int
+	for n, id := range candidates {
+		if n > 0 && candidates[n-1] == id {
+			continue // Touched more than once
+		}
+		if ix.filters[id].matches(&s) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Checks the criteria and brings amounts, selectors, hashes and topics into
+// the form they are matched in
+func (f *Filters) normalize() error {
+	switch strings.ToLower(f.Match) {
+	case "", "all":
+		f.Match = ""
+	case "any":
+		f.Match = "any"
+	default:
+		return fmt.Errorf("invalid match %q, use all or any", f.Match)
+	}
+	for _, field := range f.addressFields() {
+		value := strings.TrimSpace(*field.value)
+		switch {
+		case value == "":
+		case value == "0x0" && field.name == "To":
+			// Contract creations, they have no recipient
+		case isENSName(value):
+			address, err := ResolveENS(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", field.name, err)
+			}
+			if f.ENS == nil {
+				f.ENS = make(map[string]string)
+			}
+			f.ENS[field.name] = strings.ToLower(value)
+			*field.value = address
+		default:
+			address, err := normalizeAddress(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", field.name, err)
+			}
+			*field.value = address
+		}
+	}
+	for _, v := range []*string{&f.MinValue, &f.MaxValue} {
+		if *v != "" {
+			wei, err := parseWei(*v)
+			if err != nil {
+				return err
+			}
+			*v = wei.String()
+		}
+	}
+	if f.MaxGasPrice > 0 && f.MinGasPrice > f.MaxGasPrice {
+		return fmt.Errorf("MinGasPrice is above MaxGasPrice")
+	}
+	if f.ReceiptStatus != nil && *f.ReceiptStatus > 1 {
+		return fmt.Errorf("invalid receipt status %d, use 1 for succeeded or 0 for failed", *f.ReceiptStatus)
+	}
+	if f.MethodSelector != "" {
+		selector, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(f.MethodSelector), "0x"))
+		if err != nil || len(selector) != 4 {
+			return fmt.Errorf("invalid method selector %q, use four bytes like 0xa9059cbb", f.MethodSelector)
+		}
+		f.MethodSelector = "0x" + hex.EncodeToString(selector)
+	}
+	f.BytecodeHash = strings.ToLower(f.BytecodeHash)
+	for n := range f.Logs {
+		criteria := &f.Logs[n]
+		if len(criteria.Topics) > 4 {
+			return fmt.Errorf("log criteria %d has more than 4 topics", n)
+		}
+		empty := criteria.Address == ""
+		for i, topic := range criteria.Topics {
+			if topic == "" {
+				continue
+			}
+			hash, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(topic), "0x"))
+			if err != nil || len(hash) != 32 {
+				return fmt.Errorf("invalid topic %q in log criteria %d", topic, n)
+			}
+			criteria.Topics[i] = "0x" + hex.EncodeToString(hash)
+			empty = false
+		}
+		if empty {
+			return fmt.Errorf("log criteria %d needs an address or a topic", n)
+		}
+	}
+	if f.Expression != "" {
+		if _, err := cachedFilterExpr(f.Expression); err != nil {
+			return err
+		}
+	}
+	if names := f.watchlists(); len(names) > 0 {
+		watchlists, err := store.Watchlists()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if watchlists[name] == nil {
+				return fmt.Errorf("unknown watchlist %q", name)
+			}
+		}
+	}
+	if len(f.criteria()) == 0 {
+		return fmt.Errorf("filter has no criteria")
+	}
+	return f.normalizeSchedule()
+}
+
+type filterAddressField struct {
+	name  string // As in the API and the keys of ENS
+	value *string
+}
+
+// The fields of the filter holding an address
+func (f *Filters) addressFields() []filterAddressField {
+	fields := []filterAddressField{{"To", &f.TxTo}, {"From", &f.From}, {"Deployer", &f.Deployer}}
+	for n := range f.Logs {
+		fields = append(fields, filterAddressField{fmt.Sprintf("Logs.%d.Address", n), &f.Logs[n].Address})
+	}
+	return fields
+}
+
+// Names of the watchlists the filter and its expression refer to
+func (f *Filters) watchlists() []string {
+	var names []string
+	if f.Watchlist != "" {
+		names = append(names, f.Watchlist)
+	}
+	if f.Expression != "" {
+		if expr, err := cachedFilterExpr(f.Expression); err == nil {
+			names = append(names, expr.watchlists...)
+		}
+	}
+	return names
+}
+
+// Criteria of a filter that do not check out
+type FilterError struct {
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	return e.Msg
+}
+
+// Checks and stores a filter under a new id and runs it over the history.
+// The criteria are normalized here only, a *FilterError if they are invalid.
+func AddFilterCriteria(filter Filters) (*Filters, error) {
+	if err := filter.normalize(); err != nil {
+		return nil, &FilterError{Msg: err.Error()}
+	}
+	id, err := store.NextFilterId()
+	if err != nil {
+		return nil, err
+	}
+	filter.Id = id
+	filter.Revision = time.Now().UnixNano()
+	if err := store.StoreFilter(filter); err != nil {
+		return nil, err
+	}
+	if _, err := BackfillFilter(&filter); err != nil {
+		log.Print(err) // Log error and keep the filter
+	}
+	return &filter, nil
+}
+
+// Returned for filters from the filter file, the file is their only source
+var errFilterReadOnly = errors.New("filter is read only")
+
+// Replaces the criteria of the stored filter with the id, nil if there is
+// none. The criteria are normalized here, a *FilterError if they are invalid.
+// The matches counted towards MaxMatches are kept, so an update does not
+// renew the budget. A deactivation is not: the filter is deactivated again
+// right away if it is still expired or exhausted with the new bounds and
+// MaxMatches, raising them brings it back.
+func UpdateFilterCriteria(id int, filter Filters) (*Filters, error) {
+	if err := filter.normalize(); err != nil {
+		return nil, &FilterError{Msg: err.Error()}
+	}
+	// Ingestion and backfills count matches on the stored filter
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	existing, err := store.FilterById(id)
+	if err != nil || existing == nil {
+		return nil, err
+	}
+	if existing.ReadOnly {
+		return nil, errFilterReadOnly
+	}
+	filter.Id = id
+	filter.Revision = time.Now().UnixNano()
+	filter.MatchCount = existing.MatchCount
+	filter.deactivate(filterClock())
+	if err := store.StoreFilter(filter); err != nil {
+		return nil, err
+	}
+	return &filter, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func matchStoredFilters(s FilterSubject) bool {
+	filters, _ := store.Filters()
+	return len(MatchFilters(filters, s)) > 0
+}
+
+func TestFilterMatches(t *testing.T) {
+	failed, succeeded := uint64(0), uint64(1)
+	creation := true
+	hotWallet := Filters{From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", MinValue: "5ether", ReceiptStatus: &failed}
+	transfer := Filters{MethodSelector: "0xA9059CBB", Logs: []LogCriteria{{Address: "0xdAC17F958D2ee523a2206206994597C13D831ec7", Topics: []string{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"}}}}
+	either := Filters{TxTo: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", ContractCreation: &creation, Match: "ANY"}
+	gas := Filters{MinGasPrice: 30e9, MaxGasPrice: 50e9, ReceiptStatus: &succeeded}
+	for _, f := range []*Filters{&hotWallet, &transfer, &either, &gas} {
+		assert.Nil(t, f.normalize())
+	}
+	assert.Equal(t, "5000000000000000000", hotWallet.MinValue)
+	assert.Equal(t, "0xa9059cbb", transfer.MethodSelector)
+
+	tx := Tx{TxFrom: "0xF39FD6E51AAD88F6F4CE6AB8827279CFFFB92266", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxValueWei: ether(6), TxGasPrice: 40e9}
+	assert.True(t, hotWallet.Matches(FilterSubject{Tx: &tx}))
+	assert.False(t, gas.Matches(FilterSubject{Tx: &tx}))
+	tx.TxReceiptStatus = 1
+	assert.False(t, hotWallet.Matches(FilterSubject{Tx: &tx}))
+	assert.True(t, gas.Matches(FilterSubject{Tx: &tx}))
+	tx.TxReceiptStatus, tx.TxValueWei = 0, ether(5)
+	assert.True(t, hotWallet.Matches(FilterSubject{Tx: &tx}))
+	tx.TxValueWei = ""
+	assert.False(t, hotWallet.Matches(FilterSubject{Tx: &tx}))
+
+	input := common.FromHex("0xa9059cbb00000000000000000000000070997970c51812dc3a010c7d01b50e0d17dc79c8")
+	logs := []*types.Log{{Address: common.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7"), Topics: []common.Hash{common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")}}}
+	assert.True(t, transfer.Matches(FilterSubject{Tx: &tx, Input: input, Logs: logs}))
+	assert.False(t, transfer.Matches(FilterSubject{Tx: &tx, Input: input}))
+	assert.False(t, transfer.Matches(FilterSubject{Tx: &tx, Input: input[:3], Logs: logs}))
+
+	assert.False(t, either.Matches(FilterSubject{Tx: &tx}))
+	assert.True(t, either.Matches(FilterSubject{Tx: &tx, Internal: []InternalTx{{From: tx.TxTo, To: "0x70997970c51812dc3a010c7d01b50e0d17dc79c8"}}}))
+	assert.True(t, either.Matches(FilterSubject{Tx: &Tx{TxTo: "0x0", TxContractCreation: true}}))
+
+	assert.Equal(t, []int{0}, MatchFilters(map[int]*Filters{0: &hotWallet, 1: &transfer, 2: &either, 3: &gas}, FilterSubject{Tx: &Tx{TxFrom: tx.TxFrom, TxValueWei: ether(10), TxGasPrice: 30e9}}))
+	assert.False(t, (&Filters{}).Matches(FilterSubject{Tx: &tx}))
+}
+
+func TestLoadFilterIndex(t *testing.T) {
+	saved := filterIndex
+	filterIndex = nil
+	defer func() { filterIndex = saved }()
+	tx := Tx{TxFrom: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxValueWei: ether(10)}
+	filters := map[int]*Filters{
+		1: {Id: 1, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", Revision: 1},
+		2: {Id: 2, MinValue: ether(5), Revision: 1},
+	}
+	ix := loadFilterIndex(filters)
+	assert.Equal(t, []int{1, 2}, ix.Match(FilterSubject{Tx: &tx}))
+
+	// Copies read from the store again at the same revisions
+	again := map[int]*Filters{1: {Id: 1, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", Revision: 1}, 2: {Id: 2, MinValue: ether(5), Revision: 1}}
+	assert.Same(t, ix, loadFilterIndex(again))
+
+	// A new revision is compiled, the other filter is reused
+	again[2] = &Filters{Id: 2, MinValue: ether(20), Revision: 2}
+	rebuilt := loadFilterIndex(again)
+	assert.NotSame(t, ix, rebuilt)
+	assert.Same(t, ix.filters[1], rebuilt.filters[1])
+	assert.Equal(t, []int{1}, rebuilt.Match(FilterSubject{Tx: &tx}))
+
+	// Filters without a revision are never taken as unchanged
+	delete(again, 2)
+	again[3] = &Filters{Id: 3, From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"}
+	ix = loadFilterIndex(again)
+	assert.NotSame(t, ix, loadFilterIndex(again))
+	assert.Equal(t, []int{1, 3}, ix.Match(FilterSubject{Tx: &tx}))
+}
+
+func TestFilterNormalize(t *testing.T) {
+	status := uint64(2)
+	for _, f := range []Filters{
+		{},
+		{Match: "all"},
+		{TxTo: "0x0", Match: "none"},
+		{MinValue: "-1ether"},
+		{MinGasPrice: 50, MaxGasPrice: 30},
+		{ReceiptStatus: &status},
+		{MethodSelector: "0xa9059c"},
+		{Logs: []LogCriteria{{Topics: []string{"", ""}}}},
+		{Logs: []LogCriteria{{Topics: []string{"0xddf252ad"}}}},
+		{Logs: []LogCriteria{{Address: "0x0", Topics: []string{"", "", "", "", ""}}}},
+	} {
+		assert.NotNil(t, f.normalize(), f)
+	}
+}
+
+func TestFilterAddRequest(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	a := App{}
+	w := httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"from": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", "minValue": "5ether", "receiptStatus": 0}`)))
+	assert.Equal(t, 200, w.Code)
+	var added Filters
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &added))
+	assert.Equal(t, "5000000000000000000", added.MinValue)
+	assert.Equal(t, uint64(0), *added.ReceiptStatus)
+	stored, _ := store.FilterById(added.Id)
+	assert.Equal(t, added, *stored)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"to": "0x0", "minGasPrice": "1.5gwei", "match": "any"}`)))
+	assert.Equal(t, 200, w.Code)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &added))
+	assert.Equal(t, uint64(1500000000), added.MinGasPrice)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"methodSelector": "transfer"}`)))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid method selector")
+	w = httptest.NewRecorder()
+	a.snoopFilterAddToRequest(w, httptest.NewRequest("POST", "/filteradd", strings.NewReader(`{"expression": "tx.value > \"10\""}`)))
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), "string at column 10")
+	n, _ := store.NumFilters()
+	assert.Equal(t, 2, n)
+}
+
+// Ids are not reused after a delete and deleting or replacing one of several
+// filters on an address leaves the others in the index
+func testFilterIds(t *testing.T, s Store) {
+	usdt := "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+	var ids []int
+	for n := 0; n < 3; n++ {
+		id, err := s.NextFilterId()
+		assert.Nil(t, err)
+		assert.Nil(t, s.StoreFilter(Filters{Id: id, TxTo: usdt, MinGasPrice: uint64(n)}))
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []int{ids[0], ids[0] + 1, ids[0] + 2}, ids)
+	assert.Nil(t, s.DeleteFilter(ids[2]))
+	next, _ := s.NextFilterId()
+	assert.Equal(t, ids[2]+1, next)
+	assert.Nil(t, s.DeleteFilter(ids[0]))
+	filters, _ := s.FiltersByTxTo(usdt)
+	assert.Equal(t, 1, len(filters))
+	assert.Equal(t, ids[1], filters[0].Id)
+
+	assert.Nil(t, s.StoreFilter(Filters{Id: ids[1], From: usdt}))
+	filters, _ = s.FiltersByTxTo(usdt)
+	assert.Equal(t, 0, len(filters))
+	n, _ := s.NumFilters()
+	assert.Equal(t, 1, n)
+	filter, _ := s.FilterById(ids[1])
+	assert.Equal(t, usdt, filter.From)
+	assert.Nil(t, s.DeleteFilter(ids[0]))
+
+	// Ids stored from elsewhere are not handed out again
+	assert.Nil(t, s.StoreFilter(Filters{Id: next + 10, TxTo: usdt}))
+	next, _ = s.NextFilterId()
+	assert.Equal(t, ids[2]+12, next)
+}
+
+func TestMemoryStoreFilterIds(t *testing.T) {
+	testFilterIds(t, NewMemoryStore())
+}
+
+func TestBoltStoreFilterIds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snoopy.db")
+	b, err := NewBoltStore(path)
+	assert.Nil(t, err)
+	testFilterIds(t, b)
+	b.Close()
+	b, err = NewBoltStore(path)
+	assert.Nil(t, err)
+	defer b.Close()
+	next, _ := b.NextFilterId()
+	assert.Equal(t, 16, next)
+}
+
+func TestJournaledStoreFilterIds(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{FsyncAlways: true})
+	assert.Nil(t, err)
+	testFilterIds(t, j)
+	id, _ := j.NextFilterId()
+	assert.Nil(t, j.Compact())
+	j.Close()
+	j, err = NewJournaledStore(NewMemoryStore(), dir, JournalOptions{FsyncAlways: true})
+	assert.Nil(t, err)
+	defer j.Close()
+	next, _ := j.NextFilterId()
+	assert.Equal(t, id+1, next)
+}
+
+func TestFilterIdRequests(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	a := App{}
+	request := func(handler func(http.ResponseWriter, *http.Request), body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		return w
+	}
+	assert.True(t, AddFilter("0xdAC17F958D2ee523a2206206994597C13D831ec7"))
+	assert.True(t, AddFilter("0xdAC17F958D2ee523a2206206994597C13D831ec7"))
+
+	w := request(a.snoopFilterIdRequest, `{"id": 2}`)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"Id":2`)
+	assert.Equal(t, 404, request(a.snoopFilterIdRequest, `{"id": 3}`).Code)
+	assert.Equal(t, 400, request(a.snoopFilterIdRequest, `{}`).Code)
+
+	w = request(a.snoopFilterUpdateRequest, `{"id": 2, "to": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "minValue": "1ether"}`)
+	assert.Equal(t, 200, w.Code)
+	filter, _ := store.FilterById(2)
+	assert.Equal(t, "1000000000000000000", filter.MinValue)
+	filters, _ := store.FiltersByTxTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 2, len(filters))
+	assert.Equal(t, 404, request(a.snoopFilterUpdateRequest, `{"id": 3, "to": "0x0"}`).Code)
+	assert.Equal(t, 400, request(a.snoopFilterUpdateRequest, `{"id": 2}`).Code)
+
+	assert.Equal(t, 200, request(a.snoopFilterDeleteIdRequest, `{"id": 1}`).Code)
+	assert.Equal(t, 404, request(a.snoopFilterDeleteIdRequest, `{"id": 1}`).Code)
+	filters, _ = store.FiltersByTxTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(filters))
+	assert.True(t, AddFilter("0x0"))
+	filter, _ = store.FilterById(3)
+	assert.Equal(t, "0x0", filter.TxTo)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	historyBlocksHeld = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snoopy_history_blocks",
+		Help: "The number of recent blocks held with all their transactions for new filters and dry runs",
+	})
+	backfilledTxs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_backfilled_txs_total",
+		Help: "The total number of transactions stored by new filters run over the history",
+	})
+)
+
+// A processed block with every transaction, matched or not, as the filters
+// saw it
+type HistoryBlock struct {
+	BlockHash   string
+	BlockNumber uint64
+	Subjects    []FilterSubject
+}
+
+// Blocks held, SNOOPY_HISTORY_BLOCKS, 0 keeps none
+var historySize = historySizeFromEnv()
+
+var (
+	historyMu sync.RWMutex
+	history   []*HistoryBlock // Ascending by number
+)
+
+func historySizeFromEnv() int {
+	v := os.Getenv("SNOOPY_HISTORY_BLOCKS")
+	if v == "" {
+		return 128
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Print("invalid SNOOPY_HISTORY_BLOCKS " + v + ", using 128") // Log error and use the default
+		return 128
+	}
+	return n
+}
+
+// Adds a processed block, replacing the blocks at and above its number that
+// a reorg or a duplicate left behind, and drops the oldest beyond the size
+func HistoryRecord(hb HistoryBlock) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	for len(history) > 0 && history[len(history)-1].BlockNumber >= hb.BlockNumber {
+		history = history[:len(history)-1]
+	}
+	if historySize > 0 {
+		history = append(history, &hb)
+	}
+	if len(history) > historySize {
+		history = append([]*HistoryBlock(nil), history[len(history)-historySize:]...)
+	}
+	historyBlocksHeld.Set(float64(len(history)))
+}
+
+// The last n blocks of the history, all of them with n 0. Held blocks are not
+// changed, the slice is the caller's.
+func HistoryBlocks(n int) []*HistoryBlock {
+	historyMu.RLock()
+	defer historyMu.RUnlock()
+	if n <= 0 || n > len(history) {
+		n = len(history)
+	}
+	return append([]*HistoryBlock(nil), history[len(history)-n:]...)
+}
+
+// What a filter would have matched in the last blocks of the history
+type FilterDryRun struct {
+	Blocks    int    `json:"Blocks"`
+	FromBlock uint64 `json:"FromBlock,omitempty"`
+	ToBlock   uint64 `json:"ToBlock,omitempty"`
+	Matches   int    `json:"Matches"`
+	// Ids are set on transactions that were stored when the block was processed
+	Txs []*Tx `json:"Txs"`
+}
+
+// Runs the filter over the last n blocks of the history without storing
+// anything, against the watchlists as they are now
+func DryRunFilter(filter *Filters, n int) FilterDryRun {
+	watchlists, err := loadWatchlists()
+	if err != nil {
+		log.Print(err) // Log error and continue without watchlists
+	}
+	blocks := HistoryBlocks(n)
+	run := FilterDryRun{Blocks: len(blocks), Txs: []*Tx{}}
+	// Counts its matches towards MaxMatches, the filter is the caller's
+	proposed := *filter
+	compiled := compileFilter(filter)
+	if len(blocks) > 0 {
+		run.FromBlock, run.ToBlock = blocks[0].BlockNumber, blocks[len(blocks)-1].BlockNumber
+	}
+	for _, hb := range blocks {
+		for _, s := range hb.Subjects {
+			s.Watchlists = watchlists
+			if proposed.takes(compiled, s, hb.BlockNumber) {
+				tx := *s.Tx
+				tx.TxWatchlists = WatchlistMatches(watchlists, &s)
+				run.Txs = append(run.Txs, &tx)
+			}
+		}
+	}
+	run.Matches = len(run.Txs)
+	return run
+}
+
+// Runs a new filter over the history blocks still in the store, within its
+// bounds and MaxMatches. Transactions it matches that were dropped are stored
+// with their block, the matches are counted in BlockFilterMatches, the
+// rollups, towards MaxMatches and, for the transactions it stores, in the
+// filter stats. Revert reasons are not replayed for them. Watchlists are
+// taken as they are now. Returns the number of transactions stored.
+func BackfillFilter(filter *Filters) (int, error) {
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
+	watchlists, err := loadWatchlists()
+	if err != nil {
+		return 0, err
+	}
+	var backfilled int
+	counted, deactivated := filter.MatchCount, filter.DeactivatedBlock
+	compiled := compileFilter(filter)
+	for _, hb := range HistoryBlocks(0) {
+		var matched []FilterSubject
+		for _, s := range hb.Subjects {
+			s.Watchlists = watchlists
+			if filter.takes(compiled, s, hb.BlockNumber) {
+				matched = append(matched, s)
+			}
+		}
+		if len(matched) > 0 {
+			filter.deactivate(hb.BlockNumber, matched[len(matched)-1].Tx.TxBlockTime)
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		blocks, err := store.BlocksByHash(hb.BlockHash)
+		if err != nil {
+			return backfilled, err
+		}
+		if len(blocks) == 0 {
+			continue // Evicted or reorged since
+		}
+		old := *blocks[0]
+		block := old
+		block.BlockFilterMatches = make(map[int]int, len(old.BlockFilterMatches)+1)
+		for id, n := range old.BlockFilterMatches {
+			block.BlockFilterMatches[id] = n
+		}
+		block.BlockFilterMatches[filter.Id] = len(matched)
+		var txs []Tx
+		for _, s := range matched {
+			if stored, err := store.TxByHash(s.Tx.TxHash); err != nil {
+				return backfilled, err
+			} else if stored != nil {
+				continue
+			}
+			FilterStatsRecord(filter, s.Tx)
+			if last, err := store.LastTxId(); err == nil && last > lastTxId {
+				lastTxId = last
+			}
+			lastTxId++
+			tx := *s.Tx
+			tx.Id, tx.TxBlockId = lastTxId, block.Id
+			tx.TxWatchlists = WatchlistMatches(watchlists, &s)
+			txs = append(txs, tx)
+			for _, itx := range s.Internal {
+				itx.TxHash = tx.TxHash
+				itx.TxBlockId = block.Id
+				itx.TxBlockNumber = tx.TxBlockNumber
+				InternalTxStore(itx)
+			}
+		}
+		if err := store.StoreBlockTxs(block, txs); err != nil {
+			return backfilled, err
+		}
+		if block.BlockRolledUp {
+			if err := RollupBlock(old, -1); err != nil {
+				return backfilled, err
+			}
+			if err := RollupBlock(block, 1); err != nil {
+				return backfilled, err
+			}
+		}
+		backfilled += len(txs)
+	}
+	if filter.MatchCount != counted || filter.DeactivatedBlock != deactivated {
+		// Matches over the history count towards MaxMatches, added to the
+		// filter as it is now unless it was deleted or replaced meanwhile
+		stored, err := store.FilterById(filter.Id)
+		if err != nil {
+			return backfilled, err
+		}
+		if stored != nil && stored.Revision == filter.Revision {
+			updated := *stored
+			updated.MatchCount += filter.MatchCount - counted
+			if updated.DeactivatedBlock == 0 {
+				updated.DeactivatedBlock = filter.DeactivatedBlock
+			}
+			if err := store.StoreFilter(updated); err != nil {
+				return backfilled, err
+			}
+		}
+	}
+	if backfilled > 0 {
+		backfilledTxs.Add(float64(backfilled))
+		log.Println("Backfilled filter " + fmt.Sprint(filter.Id) + ": " + fmt.Sprint(backfilled) + " txs")
+	}
+	return backfilled, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Two blocks of the hot wallet, only the first transaction matched a filter
+// when they were processed
+func testHistory(t *testing.T) func() {
+	savedStore, savedHistory, savedSize, savedTxId, savedStats := store, history, historySize, lastTxId, filterStats
+	store, history, historySize, lastTxId, filterStats = NewMemoryStore(), nil, 128, 0, make(map[int]*FilterStats)
+	now := uint64(time.Now().Unix())
+	wallet := "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+	txs := []*Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 100, TxBlockTime: now, TxHash: "0x01", TxFrom: wallet, TxTo: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", TxValueWei: ether(20), TxReceiptStatus: 1},
+		{TxBlockId: 1, TxBlockNumber: 100, TxBlockTime: now, TxIndex: 1, TxHash: "0x02", TxFrom: wallet, TxValueWei: ether(6)},
+		{TxBlockId: 2, TxBlockNumber: 101, TxBlockTime: now + 12, TxHash: "0x03", TxFrom: wallet, TxValueWei: ether(7)},
+		{TxBlockId: 2, TxBlockNumber: 101, TxBlockTime: now + 12, TxIndex: 1, TxHash: "0x04", TxFrom: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", TxValueWei: ether(8)},
+	}
+	blocks := []Block{
+		{Id: 1, BlockHash: "0xb1", BlockNumber: 100, BlockTime: now, BlockNumTransactions: 2, BlockFilterMatches: map[int]int{1: 1}, BlockRolledUp: true},
+		{Id: 2, BlockHash: "0xb2", BlockNumber: 101, BlockTime: now + 12, BlockNumTransactions: 2, BlockRolledUp: true},
+	}
+	assert.Nil(t, store.StoreFilter(Filters{Id: 1, TxTo: txs[0].TxTo}))
+	assert.Nil(t, store.StoreBlockTxs(blocks[0], []Tx{*txs[0]}))
+	assert.Nil(t, store.StoreBlockTxs(blocks[1], nil))
+	lastTxId = 1
+	for _, block := range blocks {
+		assert.Nil(t, RollupBlock(block, 1))
+	}
+	HistoryRecord(HistoryBlock{BlockHash: "0xb1", BlockNumber: 100, Subjects: []FilterSubject{{Tx: txs[0]}, {Tx: txs[1]}}})
+	HistoryRecord(HistoryBlock{BlockHash: "0xb2", BlockNumber: 101, Subjects: []FilterSubject{{Tx: txs[2]}, {Tx: txs[3]}}})
+	return func() {
+		store, history, historySize, lastTxId, filterStats = savedStore, savedHistory, savedSize, savedTxId, savedStats
+	}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	defer testHistory(t)()
+	historySize = 3
+	for n := uint64(102); n < 105; n++ {
+		HistoryRecord(HistoryBlock{BlockNumber: n})
+	}
+	blocks := HistoryBlocks(0)
+	assert.Equal(t, 3, len(blocks))
+	assert.Equal(t, uint64(102), blocks[0].BlockNumber)
+	assert.Equal(t, 2, len(HistoryBlocks(2)))
+
+	// Another block at a height drops the blocks from it on
+	HistoryRecord(HistoryBlock{BlockHash: "0xother", BlockNumber: 103})
+	blocks = HistoryBlocks(0)
+	assert.Equal(t, 2, len(blocks))
+	assert.Equal(t, "0xother", blocks[1].BlockHash)
+
+	historySize = 0
+	HistoryRecord(HistoryBlock{BlockNumber: 104})
+	assert.Equal(t, 0, len(HistoryBlocks(0)))
+}
+
+func TestBackfillFilter(t *testing.T) {
+	defer testHistory(t)()
+	added, err := AddFilterCriteria(Filters{From: "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266", MinValue: "5ether"})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, added.Id)
+
+	tx, _ := store.TxByHash("0x02")
+	if assert.NotNil(t, tx) {
+		assert.Equal(t, 2, tx.Id)
+		assert.Equal(t, 1, tx.TxBlockId)
+	}
+	tx, _ = store.TxByHash("0x03")
+	if assert.NotNil(t, tx) {
+		assert.Equal(t, 3, tx.Id)
+	}
+	tx, _ = store.TxByHash("0x04")
+	assert.Nil(t, tx)
+	blocks, _ := store.BlocksByHash("0xb1")
+	assert.Equal(t, map[int]int{1: 1, 2: 2}, blocks[0].BlockFilterMatches)
+	hours, _ := store.Rollups("hour", 0, time.Now().Unix()+3600)
+	var blocksRolledUp, matches int64
+	for _, r := range hours {
+		blocksRolledUp += r.Blocks
+		matches += r.FilterMatches[2]
+	}
+	assert.Equal(t, int64(2), blocksRolledUp)
+	assert.Equal(t, int64(3), matches)
+	// 0x01 was stored and counted by ingestion already
+	assert.Equal(t, int64(2), FilterStatsOf(2).Matches)
+	assert.Equal(t, uint64(101), FilterStatsOf(2).LastMatchBlock)
+
+	// Matches are added to the filter as it is now, a filter deleted or
+	// replaced meanwhile is left alone
+	counting := Filters{Id: 3, From: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", MaxMatches: 5, Revision: 1}
+	live := counting
+	live.MatchCount = 2
+	assert.Nil(t, store.StoreFilter(live))
+	_, err = BackfillFilter(&counting)
+	assert.Nil(t, err)
+	stored, _ := store.FilterById(3)
+	assert.Equal(t, int64(3), stored.MatchCount)
+	replaced := Filters{Id: 4, From: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", MaxMatches: 5, Revision: 1}
+	assert.Nil(t, store.StoreFilter(Filters{Id: 4, TxTo: "0x0", Revision: 2}))
+	_, err = BackfillFilter(&replaced)
+	assert.Nil(t, err)
+	stored, _ = store.FilterById(4)
+	assert.Equal(t, int64(0), stored.MatchCount)
+	assert.Equal(t, "0x0", stored.TxTo)
+	_, err = BackfillFilter(&Filters{Id: 5, From: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", MaxMatches: 5})
+	assert.Nil(t, err)
+	stored, _ = store.FilterById(5)
+	assert.Nil(t, stored)
+
+	// Evicted blocks are skipped
+	store.DeleteBlocksFrom(101)
+	n, err := BackfillFilter(&Filters{Id: 3, From: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestFilterDryRunRequest(t *testing.T) {
+	defer testHistory(t)()
+	a := App{}
+	w := httptest.NewRecorder()
+	a.snoopFilterDryRunRequest(w, httptest.NewRequest("POST", "/filterdryrun", strings.NewReader(`{"minValue": "6ether"}`)))
+	assert.Equal(t, 200, w.Code)
+	var run FilterDryRun
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, 2, run.Blocks)
+	assert.Equal(t, uint64(100), run.FromBlock)
+	assert.Equal(t, 4, run.Matches)
+	assert.Equal(t, 1, run.Txs[0].Id)
+
+	w = httptest.NewRecorder()
+	a.snoopFilterDryRunRequest(w, httptest.NewRequest("POST", "/filterdryrun", strings.NewReader(`{"minValue": "7ether", "blocks": 1}`)))
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &run))
+	assert.Equal(t, 1, run.Blocks)
+	assert.Equal(t, 2, run.Matches)
+	n, _ := store.NumFilters()
+	assert.Equal(t, 1, n)
+	txs, _ := store.Txs()
+	assert.Equal(t, 1, len(txs))
+
+	w = httptest.NewRecorder()
+	a.snoopFilterDryRunRequest(w, httptest.NewRequest("POST", "/filterdryrun", strings.NewReader(`{"minValue": "7ether", "blocks": -1}`)))
+	assert.Equal(t, 400, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopFilterDryRunRequest(w, httptest.NewRequest("POST", "/filterdryrun", strings.NewReader(`{}`)))
+	assert.Equal(t, 400, w.Code)
+}
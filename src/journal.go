@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The journal directory holds the last compaction as a snapshot and the
+// mutations made since as NDJSON, one entry per line
+const (
+	journalFile         = "journal.ndjson"
+	journalSnapshotFile = "snapshot.ndjson.gz"
+)
+
+var (
+	journalEntries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_journal_entries_total",
+		Help: "The total number of mutations appended to the journal",
+	})
+	journalCompactions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_journal_compactions_total",
+		Help: "The total number of journal compactions into a snapshot",
+	})
+	journalBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snoopy_journal_bytes",
+		Help: "The size of the journal since the last compaction",
+	})
+)
+
+// One mutation of the memory store
+type JournalEntry struct {
+	Op         string     `json:"Op"` // block, blocktxs, tx, filter, deletefilter, filterid, deleteblocks, rollups, deleterollups, watchlist or deletewatchlist
+	Block      *Block     `json:"Block,omitempty"`
+	Txs        []Tx       `json:"Txs,omitempty"`
+	Tx         *Tx        `json:"Tx,omitempty"`
+	Filter     *Filters   `json:"Filter,omitempty"`
+	Id         int        `json:"Id,omitempty"`
+	Number     uint64     `json:"Number,omitempty"`
+	Rollups    []Rollup   `json:"Rollups,omitempty"`
+	Resolution string     `json:"Resolution,omitempty"`
+	Before     int64      `json:"Before,omitempty"`
+	Watchlist  *Watchlist `json:"Watchlist,omitempty"`
+	Name       string     `json:"Name,omitempty"`
+}
+
+func (e JournalEntry) apply(m *MemoryStore) error {
+	switch {
+	case e.Op == "block" && e.Block != nil:
+		return m.StoreBlock(*e.Block)
+	case e.Op == "blocktxs" && e.Block != nil:
+		return m.StoreBlockTxs(*e.Block, e.Txs)
+	case e.Op == "tx" && e.Tx != nil:
+		return m.StoreTx(*e.Tx)
+	case e.Op == "filter" && e.Filter != nil:
+		return m.StoreFilter(*e.Filter)
+	case e.Op == "deletefilter":
+		return m.DeleteFilter(e.Id)
+	case e.Op == "filterid":
+		m.reserveFilterIds(e.Id)
+		return nil
+	case e.Op == "deleteblocks":
+		_, err := m.DeleteBlocksFrom(e.Number)
+		return err
+	case e.Op == "rollups":
+		return m.StoreRollups(e.Rollups)
+	case e.Op == "deleterollups":
+		return m.DeleteRollups(e.Resolution, e.Before)
+	case e.Op == "watchlist" && e.Watchlist != nil:
+		return m.StoreWatchlist(*e.Watchlist)
+	case e.Op == "deletewatchlist":
+		return m.DeleteWatchlist(e.Name)
+	}
+	return fmt.Errorf("unknown journal entry %q", e.Op)
+}
+
+// When appended entries are fsynced. Every entry is written to the file
+// right away, so a crash of the process alone loses nothing, the policy
+// decides how much a crash of the machine can lose.
+type JournalOptions struct {
+	// Fsync after every entry
+	FsyncAlways bool
+	// Fsync this often when not always, zero leaves it to the OS
+	FsyncInterval time.Duration
+	// Compact into a snapshot this often, zero never
+	CompactInterval time.Duration
+}
+
+// Reads SNOOPY_JOURNAL_FSYNC and SNOOPY_JOURNAL_COMPACT_INTERVAL. The fsync
+// policy is always, never or an interval, one second by default.
+func journalOptionsFromEnv() (JournalOptions, error) {
+	o := JournalOptions{FsyncInterval: time.Second, CompactInterval: 10 * time.Minute}
+	switch v := os.Getenv("SNOOPY_JOURNAL_FSYNC"); v {
+	case "":
+	case "always":
+		o.FsyncAlways = true
+		o.FsyncInterval = 0
+	case "never":
+		o.FsyncInterval = 0
+	default:
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return o, fmt.Errorf("invalid SNOOPY_JOURNAL_FSYNC %q, use always, never or an interval", v)
+		}
+		o.FsyncInterval = d
+	}
+	if v := os.Getenv("SNOOPY_JOURNAL_COMPACT_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return o, fmt.Errorf("invalid SNOOPY_JOURNAL_COMPACT_INTERVAL %q", v)
+		}
+		o.CompactInterval = d
+	}
+	return o, nil
+}
+
+// JournaledStore is a MemoryStore that survives restarts. Every mutation
+// is appended to the journal before it is applied, reads go straight to
+// the memory store.
+type JournaledStore struct {
+	*MemoryStore
+
+	// Orders the journal like the memory store and guards the file
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	size    int64
+	dirty   bool
+	options JournalOptions
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Replays the snapshot and journal in dir into m and appends to the
+// journal from then on
+func NewJournaledStore(m *MemoryStore, dir string, options JournalOptions) (*JournaledStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	j := &JournaledStore{MemoryStore: m, dir: dir, options: options, done: make(chan struct{})}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	j.file = file
+	if info, err := file.Stat(); err == nil {
+		j.size = info.Size()
+		journalBytes.Set(float64(j.size))
+	}
+	if options.FsyncInterval > 0 {
+		j.every(options.FsyncInterval, j.Sync)
+	}
+	if options.CompactInterval > 0 {
+		j.every(options.CompactInterval, j.Compact)
+	}
+	return j, nil
+}
+
+func (j *JournaledStore) every(interval time.Duration, f func() error) {
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := f(); err != nil {
+					log.Print(err) // Log error and continue
+				}
+			case <-j.done:
+				return
+			}
+		}
+	}()
+}
+
+// Loads the snapshot and applies the journal on top of it. A last entry
+// cut short by a crash is dropped, anything else unreadable fails.
+func (j *JournaledStore) replay() error {
+	if f, err := os.Open(filepath.Join(j.dir, journalSnapshotFile)); err == nil {
+		cp, err := ImportSnapshot(j.MemoryStore, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("loading journal snapshot: %w", err)
+		}
+		log.Println("Journal snapshot: " + fmt.Sprint(cp.Blocks) + " blocks, " + fmt.Sprint(cp.Txs) + " txs, " + fmt.Sprint(cp.Filters) + " filters")
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	path := filepath.Join(j.dir, journalFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var offset int64
+	var replayed int
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Println("Journal: dropping a torn last entry at offset " + fmt.Sprint(offset))
+				if err := os.Truncate(path, offset); err != nil {
+					return err
+				}
+			}
+			break
+		} else if err != nil {
+			return err
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return fmt.Errorf("journal entry at offset %d: %w", offset, err)
+		}
+		if err := entry.apply(j.MemoryStore); err != nil {
+			return fmt.Errorf("journal entry at offset %d: %w", offset, err)
+		}
+		offset += int64(len(line))
+		replayed++
+	}
+	log.Println("Journal: replayed " + fmt.Sprint(replayed) + " entries")
+	return nil
+}
+
+// Appends the entry to the journal, callers hold j.mu
+func (j *JournaledStore) write(e JournalEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := j.file.Write(line); err != nil {
+		// Keep a partial entry from ending up in front of the next one
+		j.file.Truncate(j.size)
+		return err
+	}
+	j.size += int64(len(line))
+	if j.options.FsyncAlways {
+		if err := j.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		j.dirty = true
+	}
+	journalEntries.Inc()
+	journalBytes.Set(float64(j.size))
+	return nil
+}
+
+func (j *JournaledStore) mutate(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(e); err != nil {
+		return err
+	}
+	return e.apply(j.MemoryStore)
+}
+
+func (j *JournaledStore) StoreBlock(block Block) error {
+	return j.mutate(JournalEntry{Op: "block", Block: &block})
+}
+
+func (j *JournaledStore) StoreBlockTxs(block Block, txs []Tx) error {
+	return j.mutate(JournalEntry{Op: "blocktxs", Block: &block, Txs: txs})
+}
+
+func (j *JournaledStore) StoreTx(tx Tx) error {
+	return j.mutate(JournalEntry{Op: "tx", Tx: &tx})
+}
+
+func (j *JournaledStore) StoreFilter(filter Filters) error {
+	return j.mutate(JournalEntry{Op: "filter", Filter: &filter})
+}
+
+func (j *JournaledStore) DeleteFilter(id int) error {
+	return j.mutate(JournalEntry{Op: "deletefilter", Id: id})
+}
+
+func (j *JournaledStore) NextFilterId() (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	id, err := j.MemoryStore.NextFilterId()
+	if err != nil {
+		return 0, err
+	}
+	return id, j.write(JournalEntry{Op: "filterid", Id: id})
+}
+
+func (j *JournaledStore) DeleteBlocksFrom(number uint64) ([]*Block, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(JournalEntry{Op: "deleteblocks", Number: number}); err != nil {
+		return nil, err
+	}
+	return j.MemoryStore.DeleteBlocksFrom(number)
+}
+
+func (j *JournaledStore) StoreRollups(rollups []Rollup) error {
+	return j.mutate(JournalEntry{Op: "rollups", Rollups: rollups})
+}
+
+// Pruning old rollups is journaled only when there is something to prune
+func (j *JournaledStore) DeleteRollups(resolution string, before int64) error {
+	old, err := j.MemoryStore.Rollups(resolution, 0, before-1)
+	if err != nil || len(old) == 0 {
+		return err
+	}
+	return j.mutate(JournalEntry{Op: "deleterollups", Resolution: resolution, Before: before})
+}
+
+func (j *JournaledStore) StoreWatchlist(watchlist Watchlist) error {
+	return j.mutate(JournalEntry{Op: "watchlist", Watchlist: &watchlist})
+}
+
+func (j *JournaledStore) DeleteWatchlist(name string) error {
+	return j.mutate(JournalEntry{Op: "deletewatchlist", Name: name})
+}
+
+// A repair is not journaled, the repaired store is compacted instead
+func (j *JournaledStore) Check(repair bool) (CheckReport, error) {
+	if !repair {
+		return j.MemoryStore.Check(false)
+	}
+	j.mu.Lock()
+	report, err := j.MemoryStore.Check(true)
+	j.mu.Unlock()
+	if err != nil || !report.Repaired {
+		return report, err
+	}
+	return report, j.Compact()
+}
+
+// Fsyncs what was appended since the last sync
+func (j *JournaledStore) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// Writes the store to a new snapshot and empties the journal. The snapshot
+// replaces the old one only once it is complete, replaying entries that
+// made it into the snapshot again is harmless as all writes are upserts.
+func (j *JournaledStore) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	path := filepath.Join(j.dir, journalSnapshotFile)
+	tmp, err := os.CreateTemp(j.dir, journalSnapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := ExportSnapshot(j.MemoryStore, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(j.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.size = 0
+	j.dirty = false
+	// Deleted filters are not in the snapshot, their ids stay used
+	j.MemoryStore.mu.RLock()
+	lastFilterId := j.MemoryStore.lastFilterId
+	j.MemoryStore.mu.RUnlock()
+	if lastFilterId > 0 {
+		if err := j.write(JournalEntry{Op: "filterid", Id: lastFilterId}); err != nil {
+			return err
+		}
+	}
+	journalCompactions.Inc()
+	journalBytes.Set(float64(j.size))
+	return j.file.Sync()
+}
+
+// Stops the background sync and compaction and closes the journal
+func (j *JournaledStore) Close() error {
+	close(j.done)
+	j.wg.Wait()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.file.Sync(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+func (o JournalOptions) String() string {
+	var fsync string
+	switch {
+	case o.FsyncAlways:
+		fsync = "always"
+	case o.FsyncInterval > 0:
+		fsync = o.FsyncInterval.String()
+	default:
+		fsync = "never"
+	}
+	return "fsync " + fsync + ", compact every " + o.CompactInterval.String()
+}
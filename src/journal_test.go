@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{FsyncAlways: true})
+	assert.Nil(t, err)
+	j.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}, []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+	})
+	j.StoreBlockTxs(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232753}, []Tx{
+		{Id: 2, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+	})
+	j.StoreFilter(Filters{Id: 0, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	j.StoreFilter(Filters{Id: 1, Deployer: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"})
+	j.DeleteFilter(1)
+	deleted, err := j.DeleteBlocksFrom(12232753)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deleted))
+	assert.Nil(t, j.Close())
+
+	// A crash in the middle of the last write
+	f, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0o644)
+	f.WriteString(`{"Op":"tx","Tx":{"Id":3,`)
+	f.Close()
+
+	r, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{})
+	assert.Nil(t, err)
+	defer r.Close()
+	blocks, _ := r.Blocks()
+	assert.Equal(t, 1, len(blocks))
+	txs, _ := r.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(txs))
+	n, _ := r.NumFilters()
+	assert.Equal(t, 1, n)
+	tx, _ := r.TxById(2)
+	assert.Nil(t, tx)
+	// The torn entry is gone and appending goes on after the last good one
+	assert.Nil(t, r.StoreTx(Tx{Id: 3, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x6ba1cd3e59b3bbb8a9e0a0ed4f5d1ce6d5e8a4d2c1b0f9e8d7c6b5a493827160"}))
+	r2, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{})
+	assert.Nil(t, err)
+	defer r2.Close()
+	tx, _ = r2.TxById(3)
+	assert.NotNil(t, tx)
+}
+
+func TestJournalCompact(t *testing.T) {
+	dir := t.TempDir()
+	j, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{})
+	assert.Nil(t, err)
+	j.StoreBlock(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752})
+	j.StoreFilter(Filters{Id: 0, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	assert.Nil(t, j.Compact())
+	info, _ := os.Stat(filepath.Join(dir, journalFile))
+	assert.Equal(t, int64(0), info.Size())
+	j.StoreBlock(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232753})
+	// Replaying the filter again on top of the snapshot changes nothing
+	j.StoreFilter(Filters{Id: 0, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	assert.Nil(t, j.Close())
+
+	r, err := NewJournaledStore(NewMemoryStore(), dir, JournalOptions{})
+	assert.Nil(t, err)
+	defer r.Close()
+	blocks, _ := r.Blocks()
+	assert.Equal(t, 2, len(blocks))
+	filters, _ := r.FiltersByTxTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(filters))
+}
+
+func TestJournalOptionsFromEnv(t *testing.T) {
+	t.Setenv("SNOOPY_JOURNAL_FSYNC", "always")
+	o, err := journalOptionsFromEnv()
+	assert.Nil(t, err)
+	assert.True(t, o.FsyncAlways)
+	assert.Equal(t, 10*time.Minute, o.CompactInterval)
+	t.Setenv("SNOOPY_JOURNAL_FSYNC", "250ms")
+	t.Setenv("SNOOPY_JOURNAL_COMPACT_INTERVAL", "0")
+	o, _ = journalOptionsFromEnv()
+	assert.Equal(t, JournalOptions{FsyncInterval: 250 * time.Millisecond}, o)
+	t.Setenv("SNOOPY_JOURNAL_FSYNC", "sometimes")
+	_, err = journalOptionsFromEnv()
+	assert.NotNil(t, err)
+}
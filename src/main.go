@@ -4,15 +4,23 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
 	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -29,6 +37,16 @@ type Stats struct {
 }
 
 var allStats = Stats{NumBlocks: 0, NumTx: 0, NumAuthRequests: 0, NumUnAuthRequests: 0, NumSystemRequests: 0, NumApiConns: 0}
+
+// Guards allStats, counted from the ingestion and every request
+var statsMu sync.Mutex
+
+func currentStats() Stats {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	return allStats
+}
+
 var (
 	eventsProcessed = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "snoopy_processed_events_total",
@@ -50,6 +68,14 @@ var (
 		Name: "snoopy_processed_apicalls_total",
 		Help: "The total number of processed api calls",
 	})
+	contractsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_processed_contract_creations_total",
+		Help: "The total number of processed contract creations",
+	})
+	blocksReorged = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_reorged_blocks_total",
+		Help: "The total number of stored blocks dropped by chain reorganizations",
+	})
 )
 
 type Block struct {
@@ -59,18 +85,25 @@ type Block struct {
 	BlockTime            uint64 `json:"BlockTime,omitempty"`
 	BlockNonce           uint64 `json:"BlockNonce,omitempty"`
 	BlockNumTransactions int    `json:"BlockNumTransactions,omitempty"`
+	// Kept for the rollups, a reorg takes the block out of them again
+	BlockGasUsed       uint64      `json:"BlockGasUsed,omitempty"`
+	BlockBurnedFees    string      `json:"BlockBurnedFees,omitempty"`
+	BlockFailedTxs     int         `json:"BlockFailedTxs,omitempty"`
+	BlockFilterMatches map[int]int `json:"BlockFilterMatches,omitempty"`
+	BlockRolledUp      bool        `json:"BlockRolledUp,omitempty"`
 }
 
-var BlockById map[int]*Block = make(map[int]*Block)
-var BlockByNumber map[uint64][]*Block = make(map[uint64][]*Block)
-var BlockByHash map[string][]*Block = make(map[string][]*Block)
-
 type Tx struct {
-	Id              int    `json:"Id,omitempty"`
-	TxBlockId       int    `json:"TxBlockId,omitempty"`
-	TxBlockNumber   uint64 `json:"TxBlockNumber,omitempty"`
-	TxHash          string `json:"TxHash,omitempty"`
-	TxValue         uint64 `json:"TxValue,omitempty"`
+	Id            int    `json:"Id,omitempty"`
+	TxBlockId     int    `json:"TxBlockId,omitempty"`
+	TxBlockNumber uint64 `json:"TxBlockNumber,omitempty"`
+	TxBlockTime   uint64 `json:"TxBlockTime,omitempty"`
+	// Position in the block, kept when zero
+	TxIndex uint64 `json:"TxIndex"`
+	TxHash  string `json:"TxHash,omitempty"`
+	TxValue uint64 `json:"TxValue,omitempty"`
+	// Exact value in wei as a decimal string, TxValue overflows above about 18.4 ETH
+	TxValueWei      string `json:"TxValueWei,omitempty"`
 	TxGas           uint64 `json:"TxGas,omitempty"`
 	TxGasPrice      uint64 `json:"TxGasPrice,omitempty"`
 	TxCost          uint64 `json:"TxCost,omitempty"`
@@ -78,55 +111,95 @@ type Tx struct {
 	TxData          string `json:"TxData,omitempty"`
 	TxTo            string `json:"TxTo,omitempty"`
 	TxReceiptStatus uint64 `json:"TxReceiptStatus,omitempty"`
+	TxFrom          string `json:"TxFrom,omitempty"`
+	// Set on contract creations, TxTo is kept as "0x0" for those
+	TxContractCreation bool   `json:"TxContractCreation,omitempty"`
+	TxContractAddress  string `json:"TxContractAddress,omitempty"`
+	// Decoded from a replay of failed transactions matching a filter
+	TxRevertReason string `json:"TxRevertReason,omitempty"`
+	// Watchlist addresses the transaction touched when it was processed
+	TxWatchlists []WatchlistMatch `json:"TxWatchlists,omitempty"`
 }
 
-var TxById map[int]*Tx = make(map[int]*Tx)
-var TxByTo map[string][]*Tx = make(map[string][]*Tx)
-var TxByHash map[string][]*Tx = make(map[string][]*Tx)
-var TxByBlockId map[int][]*Tx = make(map[int][]*Tx)
-var TxByBlockNumber map[uint64][]*Tx = make(map[uint64][]*Tx)
-
+// A filter selects the transactions to keep, see FilterSubject for what its
+// criteria are matched against
 type Filters struct {
-	Id   int    `json:"Id,omitempty"`
+	Id int `json:"Id,omitempty"`
+	// Optional, identifies the filter across reloads of the filter file
+	Name string `json:"Name,omitempty"`
+	// Managed by the filter file, see SNOOPY_FILTER_FILE, and not changed through the API
+	ReadOnly bool `json:"ReadOnly,omitempty"`
+	// Recipient, also matched against either side of an internal transfer
 	TxTo string `json:"TxTo,omitempty"`
+	// Contract deployment filters
+	Deployer     string `json:"Deployer,omitempty"`
+	BytecodeHash string `json:"BytecodeHash,omitempty"`
+	// Sender
+	From string `json:"From,omitempty"`
+	// Sender, recipient or either side of an internal transfer on the named watchlist
+	Watchlist string `json:"Watchlist,omitempty"`
+	// Inclusive value bounds in wei as decimal strings
+	MinValue string `json:"MinValue,omitempty"`
+	MaxValue string `json:"MaxValue,omitempty"`
+	// Inclusive gas price bounds in wei
+	MinGasPrice uint64 `json:"MinGasPrice,omitempty"`
+	MaxGasPrice uint64 `json:"MaxGasPrice,omitempty"`
+	// Receipt status, 1 succeeded and 0 failed
+	ReceiptStatus *uint64 `json:"ReceiptStatus,omitempty"`
+	// First four bytes of the input, e.g. 0xa9059cbb for ERC-20 transfer
+	MethodSelector   string `json:"MethodSelector,omitempty"`
+	ContractCreation *bool  `json:"ContractCreation,omitempty"`
+	// Logs the transaction has to emit, one criterion each
+	Logs []LogCriteria `json:"Logs,omitempty"`
+	// A filter expression, see FilterExpr
+	Expression string `json:"Expression,omitempty"`
+	// How the criteria combine, all (the default) or any
+	Match string `json:"Match,omitempty"`
+	// ENS names given instead of addresses by field, e.g. From, re-resolved
+	// every SNOOPY_ENS_INTERVAL
+	ENS map[string]string `json:"ENS,omitempty"`
+	// When the filter matches, block numbers or times, both inclusive
+	ValidFrom  FilterBound `json:"ValidFrom,omitempty"`
+	ValidUntil FilterBound `json:"ValidUntil,omitempty"`
+	// Deactivates the filter once it matched this many transactions
+	MaxMatches int64 `json:"MaxMatches,omitempty"`
+	// Matches counted towards MaxMatches by the ingesting instance
+	MatchCount int64 `json:"MatchCount,omitempty"`
+	// The block the filter expired or reached MaxMatches at, it matches
+	// nothing after
+	DeactivatedBlock uint64 `json:"DeactivatedBlock,omitempty"`
+	// Changes with the criteria, matching reuses what was built for it
+	Revision int64 `json:"Revision,omitempty"`
 }
 
-var FilterById map[int]*Filters = make(map[int]*Filters)
-var FilterByTxTo map[string][]*Filters = make(map[string][]*Filters)
-
-func BlockStore(block Block) {
-	BlockById[block.Id] = &block
-	BlockByNumber[block.BlockNumber] = append(BlockByNumber[block.BlockNumber], &block)
-	BlockByHash[fmt.Sprint(block.BlockHash)] = append(BlockByHash[fmt.Sprint(block.BlockHash)], &block)
-}
-func TxStore(tx Tx) {
-	TxById[tx.Id] = &tx
-	TxByTo[tx.TxTo] = append(TxByTo[tx.TxTo], &tx)
-	TxByBlockId[tx.TxBlockId] = append(TxByBlockId[tx.TxBlockId], &tx)
-	TxByBlockNumber[tx.TxBlockNumber] = append(TxByBlockNumber[tx.TxBlockNumber], &tx)
-	TxByHash[fmt.Sprint(tx.TxHash)] = append(TxByHash[fmt.Sprint(tx.TxHash)], &tx)
-}
-func FilterStore(filter Filters) {
-	FilterById[filter.Id] = &filter
-	FilterByTxTo[fmt.Sprint(filter.TxTo)] = append(FilterByTxTo[fmt.Sprint(filter.TxTo)], &filter)
+// Infura websocket endpoint unless SNOOPY_NODE_URL points to a node of our own
+func nodeURL(projectID string, networkName string) string {
+	if url := os.Getenv("SNOOPY_NODE_URL"); url != "" {
+		return url
+	}
+	return "wss://" + networkName + ".infura.io/ws/v3/" + projectID
 }
 
 func check_connect(projectID string, networkName string) bool {
-	if projectID == "" {
-		log.Fatalf("No projectID found.")
-	}
-	if networkName == "" {
-		log.Fatalf("No networkName found.")
+	if os.Getenv("SNOOPY_NODE_URL") == "" {
+		if projectID == "" {
+			log.Fatalf("No projectID found.")
+		}
+		if networkName == "" {
+			log.Fatalf("No networkName found.")
+		}
 	}
 
-	_, err := ethclient.Dial("wss://" + networkName + ".infura.io/ws/v3/" + projectID)
+	_, err := ethclient.Dial(nodeURL(projectID, networkName))
 
 	if err != nil {
 		log.Fatal("Oops! There was a problem", err)
 		return false
 	} else {
 		log.Println("Success! you connected to the " + networkName + " Network")
+		statsMu.Lock()
 		allStats.NumApiConns++
+		statsMu.Unlock()
 		apiCallsProcessed.Inc()
 		return true
 	}
@@ -138,33 +211,56 @@ func snoop(wg *sync.WaitGroup, maxBlocks int, ch1 chan bool) bool {
 	networkName := os.Getenv("SNOOPY_NETWORK_NAME")
 
 	if check_connect(projectID, networkName) {
-		client, err := ethclient.Dial("wss://" + networkName + ".infura.io/ws/v3/" + projectID)
+		rpcClient, err := rpc.Dial(nodeURL(projectID, networkName))
 		if err != nil {
 			log.Fatal(err)
 		}
+		client := ethclient.NewClient(rpcClient)
+		SetENSClient(client)
+		go reconcileTokenBalancesRun(client)
+		go reresolveENSRun()
 		headers := make(chan *types.Header)
 		sub, err := client.SubscribeNewHead(context.Background(), headers)
 		if err != nil {
 			log.Fatal(err)
 		}
 		apiCallsProcessed.Inc()
+		statsMu.Lock()
 		allStats.NumApiConns++
+		statsMu.Unlock()
 		var wgb sync.WaitGroup
 		ch2 := make(chan bool)
-		var i = 0
+		// Continue the block and transaction ids of a persistent store
+		i, err := store.LastBlockId()
+		if err != nil {
+			log.Fatal(err)
+		}
+		lastTxId, err = store.LastTxId()
+		if err != nil {
+			log.Fatal(err)
+		}
+		var n = 0
 		for {
 			select {
 			case err := <-sub.Err():
 				log.Print(err) // Log error and continue
 			case header := <-headers:
+				// Imports may have raised the ids while we were running
+				if last, err := store.LastBlockId(); err == nil && last > i {
+					i = last
+				}
+				if last, err := store.LastTxId(); err == nil && last > lastTxId {
+					lastTxId = last
+				}
 				i++
-				if i >= maxBlocks && maxBlocks > 0 {
+				n++
+				if n >= maxBlocks && maxBlocks > 0 {
 					ch1 <- true
 					wg.Done()
 					return true
 				} else {
 					wgb.Add(1)
-					go snoopProcessEvent(&wgb, i, client, sub, header, maxBlocks, ch2)
+					go snoopProcessEvent(&wgb, i, client, rpcClient, sub, header, maxBlocks, ch2)
 					wgb.Wait() // Enable breakout
 				}
 			}
@@ -172,24 +268,87 @@ func snoop(wg *sync.WaitGroup, maxBlocks int, ch1 chan bool) bool {
 	}
 	return true
 }
-func snoopProcessEvent(wgb *sync.WaitGroup, i int, client *ethclient.Client, sub ethereum.Subscription, header *types.Header, maxBlocks int, ch2 chan bool) {
+
+// Id of the last stored transaction, blocks are processed one at a time
+var lastTxId int
+
+// Held while a block is processed or a new filter backfilled, both store
+// transactions under new ids
+var ingestMu sync.Mutex
+
+// Drops the stored blocks at and above number when the chain hands us another block at that height
+func snoopReorg(number uint64, hash string) {
+	blocks, err := store.BlocksByNumber(number)
+	if err != nil {
+		log.Print(err) // Log error and continue
+		return
+	}
+	var reorged bool
+	for _, block := range blocks {
+		if block.BlockHash != hash {
+			reorged = true
+		}
+	}
+	if !reorged {
+		return
+	}
+	// Every block dropped, past gaps in the heights too, leaves the rollups
+	dropped, err := store.DeleteBlocksFrom(number)
+	if err != nil {
+		log.Print(err) // Log error and continue
+		return
+	}
+	for _, block := range dropped {
+		if block.BlockRolledUp {
+			if err := RollupBlock(*block, -1); err != nil {
+				log.Print(err) // Log error and continue
+			}
+		}
+	}
+	RevertTokenTransfers(number)
+	DeleteInternalTxsFrom(number)
+	DeleteContractsFrom(number)
+	blocksReorged.Add(float64(len(dropped)))
+	log.Println("Reorg: dropped " + fmt.Sprint(len(dropped)) + " blocks from #" + fmt.Sprint(number))
+}
+
+func snoopProcessEvent(wgb *sync.WaitGroup, i int, client *ethclient.Client, rpcClient *rpc.Client, sub ethereum.Subscription, header *types.Header, maxBlocks int, ch2 chan bool) {
 	defer wgb.Done()
+	ingestMu.Lock()
+	defer ingestMu.Unlock()
 	// log.Println(header.Hash().Hex()) // 0xbc10defa8dda384c96a17640d84de5578804945d347072e091b4e5f390ddea7f
 	eventsProcessed.Inc()
 	block, err := client.BlockByHash(context.Background(), header.Hash())
 	if err != nil {
 		log.Print(err) // Log error and continue
 	}
-	cBlock := Block{Id: i, BlockHash: block.Hash().Hex(), BlockNumber: block.Number().Uint64(), BlockTime: block.Time(), BlockNonce: block.Nonce(), BlockNumTransactions: len(block.Transactions())}
-	BlockStore(cBlock)
-	allStats.NumBlocks++
-	allStats.NumTx += len(block.Transactions())
+	snoopReorg(block.Number().Uint64(), block.Hash().Hex())
+	// A block we already have keeps its id, writing it again replaces it
+	var rolledUp bool
+	known, err := store.BlocksByHash(block.Hash().Hex())
+	if err != nil {
+		log.Print(err) // Log error and continue
+	}
+	if len(known) > 0 {
+		i = known[0].Id
+		rolledUp = known[0].BlockRolledUp
+		log.Println("Duplicate: #" + block.Number().String() + " already stored as block " + fmt.Sprint(i))
+	} else {
+		statsMu.Lock()
+		allStats.NumBlocks++
+		allStats.NumTx += len(block.Transactions())
+		statsMu.Unlock()
+	}
+	cBlock := Block{Id: i, BlockHash: block.Hash().Hex(), BlockNumber: block.Number().Uint64(), BlockTime: block.Time(), BlockNonce: block.Nonce(), BlockNumTransactions: len(block.Transactions()), BlockGasUsed: block.GasUsed()}
+	if baseFee := block.BaseFee(); baseFee != nil {
+		cBlock.BlockBurnedFees = new(big.Int).Mul(baseFee, new(big.Int).SetUint64(block.GasUsed())).String()
+	}
 	// Combine Prometheus metrics
 	blocksProcessed.Inc()
 	var txInBlock float64 = float64(len(block.Transactions()))
 	txProcessed.Add(txInBlock)
 	// Reply with Block Data
-	s, err := json.Marshal(BlockById[i])
+	s, err := json.Marshal(cBlock)
 	if err != nil {
 		log.Print(err)
 	}
@@ -212,7 +371,31 @@ func snoopProcessEvent(wgb *sync.WaitGroup, i int, client *ethclient.Client, sub
 	// TxTo       string `json:"TxTo,omitempty"`
 	// TxReceiptStatus  uint64 `json:"TxTo,omitempty"`
 	var ti = 0
+	var cTxs []Tx
+	var subjects []FilterSubject
 	log.Println("Processing #" + block.Number().String())
+	filters, err := store.Filters()
+	if err != nil {
+		log.Print(err) // Log error and continue as if unfiltered
+	}
+	numFilters := len(filters)
+	schedule := NewFilterSchedule(filters, block.Number().Uint64(), block.Time())
+	index := loadFilterIndex(schedule.Active)
+	watchlists, err := loadWatchlists()
+	if err != nil {
+		log.Print(err) // Log error and continue without watchlists
+	}
+	touched := make(map[string]bool)
+	watched := WatchedAddresses()
+	var transfers []TokenTransfer
+	var internal map[string][]InternalTx
+	if traceEnabled() {
+		var txHashes []common.Hash
+		for _, tx := range blockT.Transactions() {
+			txHashes = append(txHashes, tx.Hash())
+		}
+		internal = traceBlock(rpcClient, blockT.Hash(), txHashes)
+	}
 	for _, tx := range blockT.Transactions() {
 		ti++
 		// fmt.Println(tx.Hash().Hex())        // 0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2
@@ -231,25 +414,60 @@ func snoopProcessEvent(wgb *sync.WaitGroup, i int, client *ethclient.Client, sub
 			continue
 		}
 		//fmt.Println(receipt.Status) // 1
-		var gotTx = 0
-		filters := FilterByTxTo
-		if len(filters) > 0 {
-			// Filters Exists
-			filter := FilterByTxTo[TxTo]
-			if len(filter) > 0 {
-				log.Println("Matched: " + string(TxTo))
-				cTx := Tx{Id: ti, TxBlockId: i, TxBlockNumber: block.Number().Uint64(), TxHash: tx.Hash().Hex(), TxValue: tx.Value().Uint64(), TxGas: tx.Gas(), TxGasPrice: tx.GasPrice().Uint64(), TxCost: tx.Cost().Uint64(), TxNonce: tx.Nonce(), TxTo: TxTo, TxReceiptStatus: receipt.Status}
-				TxStore(cTx)
-				gotTx = 1
-			}
+		if receipt.Status == types.ReceiptStatusFailed {
+			cBlock.BlockFailedTxs++
+		}
+		if watched.Len() > 0 {
+			transfers = append(transfers, decodeTransfers(receipt.Logs)...)
+		}
+		var TxFrom string
+		sender, err := client.TransactionSender(context.Background(), tx, blockT.Hash(), uint(ti-1))
+		if err != nil {
+			log.Print(err) // Log error and continue without sender
 		} else {
-			// No Filters Store everything
-			cTx := Tx{Id: ti, TxBlockId: i, TxBlockNumber: block.Number().Uint64(), TxHash: tx.Hash().Hex(), TxValue: tx.Value().Uint64(), TxGas: tx.Gas(), TxGasPrice: tx.GasPrice().Uint64(), TxCost: tx.Cost().Uint64(), TxNonce: tx.Nonce(), TxTo: TxTo, TxReceiptStatus: receipt.Status}
-			TxStore(cTx)
+			TxFrom = sender.Hex()
+		}
+		cTx := Tx{TxBlockId: i, TxBlockNumber: block.Number().Uint64(), TxBlockTime: block.Time(), TxIndex: uint64(ti - 1), TxHash: tx.Hash().Hex(), TxValue: tx.Value().Uint64(), TxValueWei: tx.Value().String(), TxGas: tx.Gas(), TxGasPrice: tx.GasPrice().Uint64(), TxCost: tx.Cost().Uint64(), TxNonce: tx.Nonce(), TxTo: TxTo, TxReceiptStatus: receipt.Status, TxFrom: TxFrom}
+		touched[TxTo] = true
+		touched[TxFrom] = true
+		for _, itx := range internal[cTx.TxHash] {
+			touched[itx.From] = true
+			touched[itx.To] = true
+		}
+		var contract *Contract
+		if tx.To() == nil {
+			cTx.TxContractCreation = true
+			cTx.TxContractAddress = receipt.ContractAddress.Hex()
+			contract = snoopContractCreation(client, receipt.ContractAddress, TxFrom, cTx.TxHash, i, block.Number())
+			log.Println("Contract created: " + cTx.TxContractAddress + " by " + TxFrom)
+		}
+		var gotTx = 0
+		// Kept in the history for filters added later, sees the id given below
+		subject := FilterSubject{Tx: &cTx, Input: tx.Data(), Logs: receipt.Logs, Contract: contract, Internal: internal[cTx.TxHash], Watchlists: watchlists}
+		cTx.TxWatchlists = WatchlistMatches(watchlists, &subject)
+		subjects = append(subjects, subject)
+		if matchBlockTx(schedule, index, filters, &cBlock, &cTx, subject) {
 			gotTx = 1
 		}
 		if gotTx == 1 {
-			s, err := json.Marshal(TxById[ti])
+			if receipt.Status == types.ReceiptStatusFailed && numFilters > 0 {
+				cTx.TxRevertReason = snoopRevertReason(client, cTx, tx.Data(), tx.Value(), block.Number())
+				log.Println("Reverted: " + cTx.TxHash + " " + cTx.TxRevertReason)
+			}
+			if stored, err := store.TxByHash(cTx.TxHash); err == nil && stored != nil {
+				cTx.Id = stored.Id
+			} else {
+				lastTxId++
+				cTx.Id = lastTxId
+			}
+			cTxs = append(cTxs, cTx)
+			for _, itx := range internal[cTx.TxHash] {
+				itx.TxHash = cTx.TxHash
+				itx.TxBlockId = i
+				itx.TxBlockNumber = cTx.TxBlockNumber
+				InternalTxStore(itx)
+			}
+			s, err := json.Marshal(cTx)
 			if err != nil {
 				log.Print(err)
 				continue
@@ -257,12 +475,54 @@ func snoopProcessEvent(wgb *sync.WaitGroup, i int, client *ethclient.Client, sub
 			log.Println("Tx: " + string(s))
 		}
 	}
+	schedule.Store()
+	HistoryRecord(HistoryBlock{BlockHash: cBlock.BlockHash, BlockNumber: cBlock.BlockNumber, Subjects: subjects})
+	// A block processed again is counted in the rollups once
+	cBlock.BlockRolledUp = true
+	// Block and matched transactions become visible together
+	if err := store.StoreBlockTxs(cBlock, cTxs); err != nil {
+		log.Print(err) // Log error and continue
+	} else if !rolledUp {
+		if err := RollupBlock(cBlock, 1); err != nil {
+			log.Print(err) // Log error and continue
+		}
+	}
+	if numFilters > 0 {
+		snoopBalances(client, touched, i, block.Number())
+	}
+	if len(transfers) > 0 {
+		ApplyTokenTransfers(client, transfers, watched, block.Number())
+	}
 	log.Println("Done #" + block.Number().String())
 }
 
+// Matches the transaction against the filters of the block and counts the
+// matches in the block. Without filters every transaction is kept.
+func matchBlockTx(schedule *FilterSchedule, index *FilterIndex, filters map[int]*Filters, cBlock *Block, cTx *Tx, subject FilterSubject) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	matched := schedule.Take(index.Match(subject))
+	if len(matched) == 0 {
+		return false
+	}
+	if len(cTx.TxWatchlists) > 0 {
+		log.Println("Matched: " + cTx.TxHash + " filters " + fmt.Sprint(matched) + " watchlists " + fmt.Sprint(cTx.TxWatchlists))
+	} else {
+		log.Println("Matched: " + cTx.TxHash + " filters " + fmt.Sprint(matched))
+	}
+	for _, id := range matched {
+		if cBlock.BlockFilterMatches == nil {
+			cBlock.BlockFilterMatches = make(map[int]int)
+		}
+		cBlock.BlockFilterMatches[id]++
+		FilterStatsRecord(filters[id], cTx)
+	}
+	return true
+}
+
 type App struct {
 	Router *mux.Router
-	// DB     *sql.DB // If DB backend is required add it here
 }
 
 type ProcessSnoopBlockIdRequest struct {
@@ -277,6 +537,9 @@ type ProcessSnoopBlockNumberRequest struct {
 type ProcessSnoopTxIdRequest struct {
 	Id int `json:"id,omitempty"`
 }
+type ProcessSnoopTxHashRequest struct {
+	Hash string `json:"hash,omitempty"`
+}
 type ProcessSnoopTxNumberRequest struct {
 	Number uint64 `json:"number,omitempty"`
 }
@@ -286,8 +549,101 @@ type ProcessSnoopTxToRequest struct {
 type ProcessSnoopFilterToRequest struct {
 	To string `json:"to,omitempty"`
 }
+type ProcessSnoopFilterAddRequest struct {
+	Name         string `json:"name,omitempty"`
+	To           string `json:"to,omitempty"`
+	Deployer     string `json:"deployer,omitempty"`
+	BytecodeHash string `json:"bytecodehash,omitempty"`
+	// Criteria beyond the recipient and deployment, see Filters
+	From             string        `json:"from,omitempty"`
+	Watchlist        string        `json:"watchlist,omitempty"`
+	MinValue         string        `json:"minvalue,omitempty"`
+	MaxValue         string        `json:"maxvalue,omitempty"`
+	MinGasPrice      string        `json:"mingasprice,omitempty"`
+	MaxGasPrice      string        `json:"maxgasprice,omitempty"`
+	ReceiptStatus    *uint64       `json:"receiptstatus,omitempty"`
+	MethodSelector   string        `json:"methodselector,omitempty"`
+	ContractCreation *bool         `json:"contractcreation,omitempty"`
+	Logs             []LogCriteria `json:"logs,omitempty"`
+	Expression       string        `json:"expression,omitempty"`
+	Match            string        `json:"match,omitempty"`
+	ValidFrom        FilterBound   `json:"validfrom,omitempty"`
+	ValidUntil       FilterBound   `json:"validuntil,omitempty"`
+	MaxMatches       int64         `json:"maxmatches,omitempty"`
+}
+
+// Whether only the recipient or deployment fields of the first filters are set
+func (pr ProcessSnoopFilterAddRequest) legacy() bool {
+	return pr.Name == "" && pr.From == "" && pr.Watchlist == "" && pr.MinValue == "" && pr.MaxValue == "" && pr.MinGasPrice == "" && pr.MaxGasPrice == "" &&
+		pr.ReceiptStatus == nil && pr.MethodSelector == "" && pr.ContractCreation == nil && len(pr.Logs) == 0 && pr.Expression == "" && pr.Match == "" &&
+		pr.ValidFrom == "" && pr.ValidUntil == "" && pr.MaxMatches == 0
+}
+
+func (pr ProcessSnoopFilterAddRequest) filter() (Filters, error) {
+	filter := Filters{Name: pr.Name, TxTo: pr.To, Deployer: pr.Deployer, BytecodeHash: pr.BytecodeHash, From: pr.From, Watchlist: pr.Watchlist, MinValue: pr.MinValue, MaxValue: pr.MaxValue,
+		ReceiptStatus: pr.ReceiptStatus, MethodSelector: pr.MethodSelector, ContractCreation: pr.ContractCreation, Logs: pr.Logs, Expression: pr.Expression, Match: pr.Match,
+		ValidFrom: pr.ValidFrom, ValidUntil: pr.ValidUntil, MaxMatches: pr.MaxMatches}
+	for _, p := range []struct {
+		name  string
+		value string
+		price *uint64
+	}{{"mingasprice", pr.MinGasPrice, &filter.MinGasPrice}, {"maxgasprice", pr.MaxGasPrice, &filter.MaxGasPrice}} {
+		if p.value == "" {
+			continue
+		}
+		wei, err := parseWei(p.value)
+		if err != nil {
+			return filter, err
+		}
+		if !wei.IsUint64() {
+			return filter, fmt.Errorf("%s %q is out of range", p.name, p.value)
+		}
+		*p.price = wei.Uint64()
+	}
+	return filter, nil
+}
+
+type ProcessSnoopContractAddressRequest struct {
+	Address string `json:"address,omitempty"`
+}
+type ProcessSnoopContractCreatorRequest struct {
+	Creator string `json:"creator,omitempty"`
+}
+type ProcessSnoopInternalTxHashRequest struct {
+	Hash string `json:"hash,omitempty"`
+}
+type ProcessSnoopBalanceAddressRequest struct {
+	Address string `json:"address,omitempty"`
+}
+type ProcessSnoopTokenBalanceRequest struct {
+	Address string `json:"address,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Number  uint64 `json:"number,omitempty"`
+}
+type ProcessSnoopCheckRequest struct {
+	Repair bool `json:"repair,omitempty"`
+}
 type ProcessSnoopFilterIdRequest struct {
-	Id int `json:"to,omitempty"`
+	Id *int `json:"id"`
+}
+
+// Replaces the criteria of the filter with the id
+type ProcessSnoopFilterUpdateRequest struct {
+	Id *int `json:"id"`
+	ProcessSnoopFilterAddRequest
+}
+
+// Runs the criteria over the last blocks of the history, all with no blocks
+type ProcessSnoopFilterDryRunRequest struct {
+	Blocks int `json:"blocks,omitempty"`
+	ProcessSnoopFilterAddRequest
+}
+
+// Adds addresses to or removes them from the named watchlist, or deletes it
+type ProcessSnoopWatchlistRequest struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Addresses   []WatchlistAddress `json:"addresses,omitempty"`
 }
 
 // Define our auth struct
@@ -295,6 +651,12 @@ type authenticationMiddleware struct {
 	tokenUsers map[string]string
 }
 
+// Whether this instance follows the chain, SNOOPY_INGEST=false makes it an
+// API only replica
+func ingestEnabled() bool {
+	return os.Getenv("SNOOPY_INGEST") != "false"
+}
+
 func (a *App) Initialize() {
 	a.Router = mux.NewRouter()
 	a.setupRoutes()
@@ -314,12 +676,43 @@ func (a *App) setupRoutes() {
 	api.HandleFunc("/blocknumber", a.snoopBlockNumberRequest).Methods("POST")
 	api.HandleFunc("/txs", a.snoopTxRequest).Methods("GET")
 	api.HandleFunc("/txid", a.snoopTxIdRequest).Methods("POST")
+	api.HandleFunc("/txhash", a.snoopTxHashRequest).Methods("POST")
 	api.HandleFunc("/txnumber", a.snoopTxNumberRequest).Methods("POST")
 	api.HandleFunc("/filters", a.snoopFiltersRequest).Methods("GET")
 	api.HandleFunc("/filterid", a.snoopFilterIdRequest).Methods("POST")
 	api.HandleFunc("/filterto", a.snoopFilterToRequest).Methods("POST")
 	api.HandleFunc("/filteradd", a.snoopFilterAddToRequest).Methods("POST")
+	api.HandleFunc("/filterupdate", a.snoopFilterUpdateRequest).Methods("POST")
 	api.HandleFunc("/filterdelete", a.snoopFilterDeleteIdRequest).Methods("POST")
+	api.HandleFunc("/filterdryrun", a.snoopFilterDryRunRequest).Methods("POST")
+	api.HandleFunc("/watchlists", a.snoopWatchlistsRequest).Methods("GET")
+	api.HandleFunc("/watchlistadd", a.snoopWatchlistAddRequest).Methods("POST")
+	api.HandleFunc("/watchlistremove", a.snoopWatchlistRemoveRequest).Methods("POST")
+	api.HandleFunc("/watchlistdelete", a.snoopWatchlistDeleteRequest).Methods("POST")
+	api.HandleFunc("/watchlistcsv", a.snoopWatchlistCSVRequest).Methods("POST")
+	// Internal transfers, balances, the token ledger and contracts are kept
+	// in memory by the ingesting instance, API only replicas have none
+	if ingestEnabled() {
+		api.HandleFunc("/internaltxs", a.snoopInternalTxRequest).Methods("GET")
+		api.HandleFunc("/internaltxhash", a.snoopInternalTxHashRequest).Methods("POST")
+		api.HandleFunc("/balances", a.snoopBalancesRequest).Methods("GET")
+		api.HandleFunc("/balanceaddress", a.snoopBalanceAddressRequest).Methods("POST")
+		api.HandleFunc("/tokenbalances", a.snoopTokenBalancesRequest).Methods("GET")
+		api.HandleFunc("/tokenbalance", a.snoopTokenBalanceRequest).Methods("POST")
+		api.HandleFunc("/contracts", a.snoopContractsRequest).Methods("GET")
+		api.HandleFunc("/contractaddress", a.snoopContractAddressRequest).Methods("POST")
+		api.HandleFunc("/contractcreator", a.snoopContractCreatorRequest).Methods("POST")
+	}
+	api.HandleFunc("/check", a.snoopCheckRequest).Methods("POST")
+	api.HandleFunc("/export", a.snoopExportRequest).Methods("GET")
+	api.HandleFunc("/import", a.snoopImportRequest).Methods("POST")
+	api.HandleFunc("/rollups", a.snoopRollupsRequest).Methods("GET")
+	// Grafana JSON datasource
+	api.HandleFunc("/grafana", a.grafanaTestRequest).Methods("GET")
+	api.HandleFunc("/grafana/", a.grafanaTestRequest).Methods("GET")
+	api.HandleFunc("/grafana/search", a.grafanaSearchRequest).Methods("POST")
+	api.HandleFunc("/grafana/metrics", a.grafanaMetricsRequest).Methods("POST")
+	api.HandleFunc("/grafana/query", a.grafanaQueryRequest).Methods("POST")
 	// Non Authenticated Routes
 	a.Router.HandleFunc("/ping", a.pingRoute).Methods("GET")
 	a.Router.HandleFunc("/health", a.healthCheck).Methods("GET")
@@ -344,11 +737,15 @@ func (amw *authenticationMiddleware) Middleware(next http.Handler) http.Handler
 		if user, found := amw.tokenUsers[token]; found {
 			// We found the token in our map
 			log.Printf("Authenticated user %s\n", user)
+			statsMu.Lock()
 			allStats.NumAuthRequests++
+			statsMu.Unlock()
 			next.ServeHTTP(w, r)
 		} else {
 			log.Printf("Unauthenticated user\n")
+			statsMu.Lock()
 			allStats.NumUnAuthRequests++
+			statsMu.Unlock()
 			http.Error(w, "Forbidden", http.StatusForbidden)
 		}
 	})
@@ -356,13 +753,17 @@ func (amw *authenticationMiddleware) Middleware(next http.Handler) http.Handler
 
 func (a *App) pingRoute(w http.ResponseWriter, r *http.Request) {
 	log.Printf("ping received\n")
+	statsMu.Lock()
 	allStats.NumSystemRequests++
+	statsMu.Unlock()
 	respondWithJSON(w, http.StatusOK, map[string]string{"ping": "pong"})
 }
 
 func (a *App) healthCheck(w http.ResponseWriter, r *http.Request) {
 	log.Printf("healthcheck received\n")
+	statsMu.Lock()
 	allStats.NumSystemRequests++
+	statsMu.Unlock()
 	respondWithJSON(w, http.StatusOK, map[string]string{"alive": "true"})
 }
 
@@ -374,12 +775,13 @@ func (a *App) snoopStatsRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Request: /")
 	// Reply with Stats
-	s, err := json.Marshal(allStats)
+	stats := currentStats()
+	s, err := json.Marshal(stats)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, allStats)
+	respondWithJSON(w, http.StatusOK, stats)
 }
 
 func (a *App) snoopBlockHashRequest(w http.ResponseWriter, r *http.Request) {
@@ -401,12 +803,17 @@ func (a *App) snoopBlockHashRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// Reply with Block Data
-	s, err := json.Marshal(BlockByHash[pr.Hash])
+	blocks, err := store.BlocksByHash(pr.Hash)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(blocks)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, BlockByHash[pr.Hash])
+	respondWithJSON(w, http.StatusOK, blocks)
 }
 
 func (a *App) snoopBlockIdRequest(w http.ResponseWriter, r *http.Request) {
@@ -424,18 +831,28 @@ func (a *App) snoopBlockIdRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if pr.Id < 1 || pr.Id > allStats.NumBlocks {
+	lastBlockId, err := store.LastBlockId()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if pr.Id < 1 || pr.Id > lastBlockId {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
 		return
 	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(BlockById[pr.Id])
+	block, err := store.BlockById(pr.Id)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(block)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, BlockById[pr.Id])
+	respondWithJSON(w, http.StatusOK, block)
 }
 
 func (a *App) snoopBlockNumberRequest(w http.ResponseWriter, r *http.Request) {
@@ -459,12 +876,17 @@ func (a *App) snoopBlockNumberRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(BlockByNumber[pr.Number])
+	blocks, err := store.BlocksByNumber(pr.Number)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(blocks)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, BlockByNumber[pr.Number])
+	respondWithJSON(w, http.StatusOK, blocks)
 }
 
 func (a *App) snoopBlocksRequest(w http.ResponseWriter, r *http.Request) {
@@ -475,12 +897,17 @@ func (a *App) snoopBlocksRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Println("Request: /blocks")
 	// Reply with All Blocks
-	s, err := json.Marshal(BlockById)
+	blocks, err := store.Blocks()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(blocks)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, BlockById)
+	respondWithJSON(w, http.StatusOK, blocks)
 }
 
 func (a *App) snoopTxRequest(w http.ResponseWriter, r *http.Request) {
@@ -489,14 +916,36 @@ func (a *App) snoopTxRequest(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
 		return
 	}
+	// Range queries, e.g. ?since=1h&minValue=100ether
+	q, ranged, err := txQueryFromValues(r.URL.Query(), time.Now())
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return
+	}
+	if ranged {
+		log.Println("Request: /txs?" + r.URL.RawQuery)
+		txs, err := store.TxsByRange(q)
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		log.Println("Sending: " + fmt.Sprint(len(txs)) + " txs")
+		respondWithJSON(w, http.StatusOK, txs)
+		return
+	}
 	log.Println("Request: /tx")
 	// Reply with All Blocks
-	s, err := json.Marshal(TxById)
+	txs, err := store.Txs()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(txs)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, TxById)
+	respondWithJSON(w, http.StatusOK, txs)
 }
 func (a *App) snoopTxIdRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -519,12 +968,51 @@ func (a *App) snoopTxIdRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(TxById[pr.Id])
+	tx, err := store.TxById(pr.Id)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(tx)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, tx)
+}
+
+func (a *App) snoopTxHashRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopTxHashRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Hash == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+
+	// Reply with Tx Data
+	tx, err := store.TxByHash(pr.Hash)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(tx)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, TxById[pr.Id])
+	respondWithJSON(w, http.StatusOK, tx)
 }
 func (a *App) snoopTxNumberRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -547,12 +1035,17 @@ func (a *App) snoopTxNumberRequest(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(TxByBlockNumber[pr.Number])
+	txs, err := store.TxsByBlockNumber(pr.Number)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(txs)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, TxByBlockNumber[pr.Number])
+	respondWithJSON(w, http.StatusOK, txs)
 }
 func (a *App) snoopFilterIdRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -569,18 +1062,29 @@ func (a *App) snoopFilterIdRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if pr.Id > 0 {
+	if pr.Id == nil || *pr.Id < 0 {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
 		return
 	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(FilterById[pr.Id])
+	filter, err := store.FilterById(*pr.Id)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if filter == nil {
+		respondWithFilterNotFound(w, *pr.Id)
+		return
+	}
+	number, t := filterClock()
+	reply := withStats(filter, number, t)
+	s, err := json.Marshal(reply)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, FilterById[pr.Id])
+	respondWithJSON(w, http.StatusOK, reply)
 }
 func (a *App) snoopFilterToRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -601,14 +1105,22 @@ func (a *App) snoopFilterToRequest(w http.ResponseWriter, r *http.Request) {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
 		return
 	}
+	if pr.To != "0x0" && !requestAddress(w, &pr.To) {
+		return
+	}
 
 	// Reply with Block Data
-	s, err := json.Marshal(FilterByTxTo[pr.To])
+	filters, err := store.FiltersByTxTo(pr.To)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(filters)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, FilterByTxTo[pr.To])
+	respondWithJSON(w, http.StatusOK, filters)
 }
 func (a *App) snoopFilterAddToRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -617,7 +1129,7 @@ func (a *App) snoopFilterAddToRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("Request: " + string(body))
-	var pr ProcessSnoopFilterToRequest
+	var pr ProcessSnoopFilterAddRequest
 	err = json.Unmarshal(body, &pr)
 	if err != nil {
 		log.Println(err.Error())
@@ -625,19 +1137,62 @@ func (a *App) snoopFilterAddToRequest(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if pr.To == "" {
+	if !pr.legacy() {
+		filter, err := pr.filter()
+		if err != nil {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+			return
+		}
+		added, err := AddFilterCriteria(filter)
+		if err != nil {
+			respondWithFilterError(w, err)
+			return
+		}
+		s, err := json.Marshal(added)
+		if err != nil {
+			log.Print(err)
+		}
+		log.Println("Added Filter: " + string(s))
+		respondWithJSON(w, http.StatusOK, added)
+		return
+	}
+	if pr.To == "" && pr.Deployer == "" && pr.BytecodeHash == "" {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
 		return
 	}
+	if pr.To == "" {
+		// Deployment filter
+		added, err := AddFilterCriteria(contractFilter(pr.Deployer, pr.BytecodeHash))
+		if err != nil {
+			respondWithFilterError(w, err)
+			return
+		}
+		s, err := json.Marshal(added)
+		if err != nil {
+			log.Print(err)
+		}
+		log.Println("Added Filter: " + string(s))
+		respondWithJSON(w, http.StatusOK, added)
+		return
+	}
 	// Add
-	AddFilter(pr.To)
+	added, err := AddFilterCriteria(Filters{TxTo: pr.To})
+	if err != nil {
+		respondWithFilterError(w, err)
+		return
+	}
 	// Reply with Block Data
-	s, err := json.Marshal(FilterByTxTo[pr.To])
+	filters, err := store.FiltersByTxTo(added.TxTo)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(filters)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Println("Added Filter: " + string(s))
-	respondWithJSON(w, http.StatusOK, FilterByTxTo[pr.To])
+	respondWithJSON(w, http.StatusOK, filters)
 }
 func (a *App) snoopFilterDeleteIdRequest(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
@@ -654,68 +1209,822 @@ func (a *App) snoopFilterDeleteIdRequest(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if pr.Id > 0 {
+	if pr.Id == nil || *pr.Id < 0 {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
 		return
 	}
+	filter, err := store.FilterById(*pr.Id)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if filter == nil {
+		respondWithFilterNotFound(w, *pr.Id)
+		return
+	}
+	if filter.ReadOnly {
+		respondWithFilterReadOnly(w, *pr.Id)
+		return
+	}
 	// Delete
-	DeleteFilter(pr.Id)
+	if !DeleteFilter(*pr.Id) {
+		respondWithJSON(w, http.StatusInternalServerError, map[string]string{"result": "false", "error": "Storage Error"})
+		return
+	}
 
 	// Reply with Block Data
-	log.Println("Deleted Filter " + fmt.Sprint(pr.Id))
+	log.Println("Deleted Filter " + fmt.Sprint(*pr.Id))
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "true"})
 }
 
-func (a *App) snoopFiltersRequest(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
+func (a *App) snoopFilterUpdateRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
 		return
 	}
-	log.Println("Request: /blocks")
-	// Reply with All Blocks
-	s, err := json.Marshal(FilterById)
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopFilterUpdateRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Id == nil || *pr.Id < 0 {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	filter, err := pr.filter()
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return
+	}
+	updated, err := UpdateFilterCriteria(*pr.Id, filter)
+	if err == errFilterReadOnly {
+		respondWithFilterReadOnly(w, *pr.Id)
+		return
+	}
+	if err != nil {
+		respondWithFilterError(w, err)
+		return
+	}
+	if updated == nil {
+		respondWithFilterNotFound(w, *pr.Id)
+		return
+	}
+	s, err := json.Marshal(updated)
 	if err != nil {
 		log.Print(err)
 	}
-	log.Println("Sending: " + string(s))
-	respondWithJSON(w, http.StatusOK, FilterById)
-}
-func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	w.Write(response)
+	log.Println("Updated Filter: " + string(s))
+	number, t := filterClock()
+	respondWithJSON(w, http.StatusOK, withStats(updated, number, t))
 }
-func AddFilter(to string) bool {
-	cRows := len(FilterById)
-	cFIlterRow := Filters{Id: cRows, TxTo: to}
-	FilterStore(cFIlterRow)
-	return true
-}
-func DeleteFilter(id int) bool {
-	cFilterRow := FilterById[id]
-	delete(FilterById, cFilterRow.Id)
-	delete(FilterByTxTo, cFilterRow.TxTo)
-	return true
-}
-func prometheusRun(port string, wg *sync.WaitGroup) bool {
-	defer wg.Done()
+
+func (a *App) snoopFilterDryRunRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopFilterDryRunRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Blocks < 0 {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	filter, err := pr.filter()
+	if err == nil {
+		err = filter.normalize()
+	}
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return
+	}
+	// Nothing is stored
+	run := DryRunFilter(&filter, pr.Blocks)
+	log.Println("Sending: dry run matched " + fmt.Sprint(run.Matches) + " txs in " + fmt.Sprint(run.Blocks) + " blocks")
+	respondWithJSON(w, http.StatusOK, run)
+}
+
+func (a *App) snoopFiltersRequest(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /blocks")
+	// Reply with All Blocks
+	filters, err := store.Filters()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	reply := make(map[int]FilterWithStats, len(filters))
+	number, t := filterClock()
+	for id, filter := range filters {
+		reply[id] = withStats(filter, number, t)
+	}
+	s, err := json.Marshal(reply)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, reply)
+}
+func (a *App) snoopWatchlistsRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request: /watchlists")
+	watchlists, err := store.Watchlists()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(watchlists)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, watchlists)
+}
+func (a *App) snoopWatchlistAddRequest(w http.ResponseWriter, r *http.Request) {
+	pr, ok := readWatchlistRequest(w, r)
+	if !ok {
+		return
+	}
+	watchlist, err := AddWatchlistAddresses(pr.Name, pr.Description, pr.Addresses)
+	if err != nil {
+		respondWithWatchlistError(w, err)
+		return
+	}
+	log.Println("Added to Watchlist " + pr.Name + ": " + fmt.Sprint(len(pr.Addresses)) + " addresses")
+	respondWithJSON(w, http.StatusOK, watchlist)
+}
+func (a *App) snoopWatchlistRemoveRequest(w http.ResponseWriter, r *http.Request) {
+	pr, ok := readWatchlistRequest(w, r)
+	if !ok {
+		return
+	}
+	watchlist, err := RemoveWatchlistAddresses(pr.Name, pr.Addresses)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if watchlist == nil {
+		respondWithWatchlistNotFound(w, pr.Name)
+		return
+	}
+	log.Println("Removed from Watchlist " + pr.Name + ": " + fmt.Sprint(len(pr.Addresses)) + " addresses")
+	respondWithJSON(w, http.StatusOK, watchlist)
+}
+func (a *App) snoopWatchlistDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	pr, ok := readWatchlistRequest(w, r)
+	if !ok {
+		return
+	}
+	watchlistMu.Lock()
+	defer watchlistMu.Unlock()
+	watchlists, err := store.Watchlists()
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if watchlists[pr.Name] == nil {
+		respondWithWatchlistNotFound(w, pr.Name)
+		return
+	}
+	ids, err := filtersUsingWatchlist(pr.Name)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	if len(ids) > 0 {
+		log.Println("Watchlist " + pr.Name + " is used by filters " + fmt.Sprint(ids))
+		respondWithJSON(w, http.StatusConflict, map[string]string{"result": "false", "error": "Watchlist is used by filters " + fmt.Sprint(ids)})
+		return
+	}
+	if err := store.DeleteWatchlist(pr.Name); err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	log.Println("Deleted Watchlist " + pr.Name)
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "true"})
+}
+
+// Adds or with remove=true removes the address,label lines of the CSV body,
+// the name and description are query parameters
+func (a *App) snoopWatchlistCSVRequest(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("name")
+	log.Println("Request: /watchlistcsv " + query.Encode())
+	entries, err := ParseWatchlistCSV(r.Body)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid CSV: " + err.Error()})
+		return
+	}
+	var watchlist *Watchlist
+	if query.Get("remove") == "true" {
+		watchlist, err = RemoveWatchlistAddresses(name, entries)
+		if err == nil && watchlist == nil {
+			respondWithWatchlistNotFound(w, name)
+			return
+		}
+	} else {
+		watchlist, err = AddWatchlistAddresses(name, query.Get("description"), entries)
+	}
+	if err != nil {
+		respondWithWatchlistError(w, err)
+		return
+	}
+	log.Println("Uploaded to Watchlist " + name + ": " + fmt.Sprint(len(entries)) + " addresses")
+	respondWithJSON(w, http.StatusOK, watchlist)
+}
+func readWatchlistRequest(w http.ResponseWriter, r *http.Request) (ProcessSnoopWatchlistRequest, bool) {
+	var pr ProcessSnoopWatchlistRequest
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return pr, false
+	}
+	log.Println("Request: " + string(body))
+	if err := json.Unmarshal(body, &pr); err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return pr, false
+	}
+	if pr.Name == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return pr, false
+	}
+	return pr, true
+}
+func (a *App) snoopInternalTxRequest(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /internaltxs")
+	// Reply with All Internal Transfers
+	internalTxs := InternalTxs()
+	s, err := json.Marshal(internalTxs)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, internalTxs)
+}
+func (a *App) snoopInternalTxHashRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopInternalTxHashRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Hash == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+
+	// Reply with Internal Transfers of the transaction
+	internalTxs := InternalTxsByTxHash(pr.Hash)
+	s, err := json.Marshal(internalTxs)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, internalTxs)
+}
+func (a *App) snoopBalancesRequest(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /balances")
+	// Reply with current Balances
+	balances := CurrentBalances()
+	s, err := json.Marshal(balances)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, balances)
+}
+func (a *App) snoopBalanceAddressRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopBalanceAddressRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Address == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	if !requestAddress(w, &pr.Address) {
+		return
+	}
+
+	// Reply with Balance History
+	balances := BalanceHistory(pr.Address)
+	s, err := json.Marshal(balances)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, balances)
+}
+func (a *App) snoopTokenBalancesRequest(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /tokenbalances")
+	// Reply with current Ledger Balances
+	balances := TokenBalances()
+	s, err := json.Marshal(balances)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, balances)
+}
+func (a *App) snoopTokenBalanceRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopTokenBalanceRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Address == "" || pr.Token == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	if !requestAddress(w, &pr.Address) || !requestAddress(w, &pr.Token) {
+		return
+	}
+	if pr.Number == 0 {
+		// Latest
+		pr.Number = math.MaxUint64
+	}
+
+	// Reply with Ledger Balance at block
+	balance := TokenBalanceAt(pr.Address, pr.Token, pr.Number)
+	s, err := json.Marshal(balance)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, balance)
+}
+func (a *App) snoopContractsRequest(w http.ResponseWriter, r *http.Request) {
+	_, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /contracts")
+	// Reply with All Contracts
+	contracts := Contracts()
+	s, err := json.Marshal(contracts)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, contracts)
+}
+func (a *App) snoopContractAddressRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopContractAddressRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Address == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	if !requestAddress(w, &pr.Address) {
+		return
+	}
+
+	// Reply with Contract Data
+	contract := ContractByAddress(pr.Address)
+	s, err := json.Marshal(contract)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, contract)
+}
+func (a *App) snoopContractCreatorRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopContractCreatorRequest
+	err = json.Unmarshal(body, &pr)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+
+	if pr.Creator == "" {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request. Missing or faulty fields or out of bounds"})
+		return
+	}
+	if !requestAddress(w, &pr.Creator) {
+		return
+	}
+
+	// Reply with Contract Data
+	contracts := ContractsByCreator(pr.Creator)
+	s, err := json.Marshal(contracts)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, contracts)
+}
+func (a *App) snoopCheckRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: " + string(body))
+	var pr ProcessSnoopCheckRequest
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &pr)
+		if err != nil {
+			log.Println(err.Error())
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+			return
+		}
+	}
+
+	// Reply with Check Report
+	report, err := store.Check(pr.Repair)
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	s, err := json.Marshal(report)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// Streams a gzip NDJSON snapshot of the store
+func (a *App) snoopExportRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request: /export")
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="snoopy-snapshot.ndjson.gz"`)
+	cp, err := ExportSnapshot(store, w)
+	if err != nil {
+		// Too late for an error response once streaming started
+		log.Print(err)
+		return
+	}
+	log.Println("Sending: snapshot of " + fmt.Sprint(cp.Blocks) + " blocks, " + fmt.Sprint(cp.Txs) + " txs and " + fmt.Sprint(cp.Filters) + " filters")
+}
+
+// Rollup buckets of one resolution, ?resolution=hour&from=...&to=... with
+// times in unix seconds or RFC 3339, the last day by default
+func (a *App) snoopRollupsRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request: /rollups?" + r.URL.RawQuery)
+	values := r.URL.Query()
+	name := values.Get("resolution")
+	if name == "" {
+		name = "hour"
+	}
+	res, err := findRollupResolution(name)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return
+	}
+	to := uint64(time.Now().Unix())
+	from := to - 86400
+	for _, p := range []struct {
+		name  string
+		value *uint64
+	}{{"from", &from}, {"to", &to}} {
+		if v := values.Get(p.name); v != "" {
+			if *p.value, err = parseUnixTime(v); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+				return
+			}
+		}
+	}
+	rollups, err := store.Rollups(res.Name, int64(from)/res.Size*res.Size, int64(to))
+	if err != nil {
+		respondWithStoreError(w, err)
+		return
+	}
+	log.Println("Sending: " + fmt.Sprint(len(rollups)) + " " + res.Name + " rollups")
+	respondWithJSON(w, http.StatusOK, rollups)
+}
+
+// Grafana tests the datasource with a GET of its URL
+func (a *App) grafanaTestRequest(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "true"})
+}
+
+// Targets for the rollup metrics and the matches of every filter
+func grafanaTargets() []string {
+	targets := []string{"blocks", "txs", "failed_txs", "gas_used", "burned_fees"}
+	filters, err := store.Filters()
+	if err != nil {
+		log.Print(err) // Log error and continue without filter targets
+		return targets
+	}
+	for _, id := range sortedIds(filters) {
+		targets = append(targets, "filter_matches:"+fmt.Sprint(id))
+	}
+	return targets
+}
+
+func (a *App) grafanaSearchRequest(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, grafanaTargets())
+}
+
+func (a *App) grafanaMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	var metrics []map[string]string
+	for _, target := range grafanaTargets() {
+		metrics = append(metrics, map[string]string{"label": target, "value": target})
+	}
+	respondWithJSON(w, http.StatusOK, metrics)
+}
+
+type GrafanaQueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target  string `json:"target"`
+		Payload struct {
+			// Overrides the resolution picked from the interval
+			Resolution string `json:"resolution"`
+		} `json:"payload"`
+	} `json:"targets"`
+}
+
+type GrafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+func (a *App) grafanaQueryRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	var q GrafanaQueryRequest
+	if err := json.Unmarshal(body, &q); err != nil || q.Range.To.Before(q.Range.From) {
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request"})
+		return
+	}
+	log.Println("Request: /grafana/query " + q.Range.From.Format(time.RFC3339) + " to " + q.Range.To.Format(time.RFC3339))
+	series := []GrafanaSeries{}
+	for _, target := range q.Targets {
+		if target.Target == "" {
+			continue
+		}
+		res := rollupResolutionFor(time.Duration(q.IntervalMs)*time.Millisecond, q.Range.From)
+		if target.Payload.Resolution != "" {
+			if res, err = findRollupResolution(target.Payload.Resolution); err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+				return
+			}
+		}
+		rollups, err := store.Rollups(res.Name, q.Range.From.Unix()/res.Size*res.Size, q.Range.To.Unix())
+		if err != nil {
+			respondWithStoreError(w, err)
+			return
+		}
+		s := GrafanaSeries{Target: target.Target, Datapoints: [][2]float64{}}
+		for _, rollup := range rollups {
+			v, err := rollup.metric(target.Target)
+			if err != nil {
+				respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+				return
+			}
+			s.Datapoints = append(s.Datapoints, [2]float64{v, float64(rollup.Start * 1000)})
+		}
+		series = append(series, s)
+	}
+	respondWithJSON(w, http.StatusOK, series)
+}
+
+// Reads a snapshot streamed in the request body into the store
+func (a *App) snoopImportRequest(w http.ResponseWriter, r *http.Request) {
+	log.Println("Request: /import")
+	// Blocks are not processed in between, the import lands in one piece
+	ingestMu.Lock()
+	cp, err := ImportSnapshot(store, r.Body)
+	ingestMu.Unlock()
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Snapshot: " + err.Error()})
+		return
+	}
+	s, err := json.Marshal(cp)
+	if err != nil {
+		log.Print(err)
+	}
+	log.Println("Sending: " + string(s))
+	respondWithJSON(w, http.StatusOK, cp)
+}
+
+func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
+func respondWithStoreError(w http.ResponseWriter, err error) {
+	log.Print(err)
+	respondWithJSON(w, http.StatusInternalServerError, map[string]string{"result": "false", "error": "Storage Error"})
+}
+func respondWithFilterNotFound(w http.ResponseWriter, id int) {
+	log.Println("Filter " + fmt.Sprint(id) + " not found")
+	respondWithJSON(w, http.StatusNotFound, map[string]string{"result": "false", "error": "Filter not found"})
+}
+func respondWithFilterReadOnly(w http.ResponseWriter, id int) {
+	log.Println("Filter " + fmt.Sprint(id) + " is managed by the filter file")
+	respondWithJSON(w, http.StatusForbidden, map[string]string{"result": "false", "error": "Filter is managed by the filter file"})
+}
+
+// Brings the address of a request into the form it is stored in, a 400 if
+// it is not an address
+func requestAddress(w http.ResponseWriter, address *string) bool {
+	normalized, err := normalizeAddress(*address)
+	if err != nil {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return false
+	}
+	*address = normalized
+	return true
+}
+func respondWithWatchlistNotFound(w http.ResponseWriter, name string) {
+	log.Println("Watchlist " + name + " not found")
+	respondWithJSON(w, http.StatusNotFound, map[string]string{"result": "false", "error": "Watchlist not found"})
+}
+
+// Invalid names and addresses are the caller's, anything else the store's
+func respondWithFilterError(w http.ResponseWriter, err error) {
+	if _, invalid := err.(*FilterError); invalid {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": err.Error()})
+		return
+	}
+	respondWithStoreError(w, err)
+}
+
+func respondWithWatchlistError(w http.ResponseWriter, err error) {
+	if _, invalid := err.(*WatchlistError); invalid {
+		log.Println(err.Error())
+		respondWithJSON(w, http.StatusBadRequest, map[string]string{"result": "false", "error": "Invalid Request: " + err.Error()})
+		return
+	}
+	respondWithStoreError(w, err)
+}
+func AddFilter(to string) bool {
+	if _, err := AddFilterCriteria(Filters{TxTo: to}); err != nil {
+		log.Print(err)
+		return false
+	}
+	return true
+}
+func DeleteFilter(id int) bool {
+	if err := store.DeleteFilter(id); err != nil {
+		log.Print(err)
+		return false
+	}
+	FilterStatsForget(id)
+	return true
+}
+
+func prometheusRun(port string, wg *sync.WaitGroup) bool {
+	defer wg.Done()
 	http.Handle("/metrics", promhttp.Handler())
 	http.ListenAndServe(port, nil)
 	return true
 }
 
+// Runs a maintenance subcommand instead of the service
+func runCommand(name string, args []string) error {
+	switch name {
+	case "check":
+		return runCheck(args)
+	case "export", "import":
+		return runSnapshot(name, args)
+	default:
+		return fmt.Errorf("unknown command %q, use check, export or import", name)
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	s, err := openStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	store = s
+	// Flush a persistent store when the pod is stopped
+	if c, ok := s.(io.Closer); ok {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-sig
+			if err := c.Close(); err != nil {
+				log.Print(err)
+			}
+			os.Exit(0)
+		}()
+	}
+	if path := os.Getenv("SNOOPY_ERROR_ABI"); path != "" {
+		if err := LoadErrorABI(path); err != nil {
+			log.Print(err) // Log error and continue without custom errors
+		}
+	}
 	var wg sync.WaitGroup
 	ch1 := make(chan bool)
 	a := App{}
 	a.Initialize()
 	// WaitGroups
-	wg.Add(3)
+	wg.Add(2)
 	go a.Run(":9080", &wg)
 	go prometheusRun(":2112", &wg)
-	go snoop(&wg, 0, ch1)
+	// API only replicas serve what a single ingesting instance writes to a shared store
+	if ingestEnabled() {
+		NormalizeStoredFilters()
+		// Filters from the file are in place before the first block
+		if path := os.Getenv("SNOOPY_FILTER_FILE"); path != "" {
+			WatchFilterFile(path)
+		}
+		wg.Add(1)
+		go snoop(&wg, 0, ch1)
+	} else {
+		log.Println("Ingestion disabled, serving the store only")
+	}
 	wg.Wait()
 	close(ch1)
 }
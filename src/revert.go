@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	errorSelector = [4]byte{0x08, 0xc3, 0x79, 0xa0} // Error(string)
+	panicSelector = [4]byte{0x4e, 0x48, 0x7b, 0x71} // Panic(uint256)
+)
+
+// Solidity panic codes, see https://docs.soliditylang.org/en/latest/control-structures.html#panic-via-assert-and-error-via-require
+var panicReasons = map[uint64]string{
+	0x00: "generic compiler panic",
+	0x01: "assert failed",
+	0x11: "arithmetic overflow or underflow",
+	0x12: "division or modulo by zero",
+	0x21: "invalid enum value",
+	0x22: "invalid storage byte array encoding",
+	0x31: "pop on empty array",
+	0x32: "array index out of bounds",
+	0x41: "out of memory",
+	0x51: "call to zero-initialized function",
+}
+
+// Custom errors known from the ABIs loaded into the registry
+var ErrorBySelector map[[4]byte]abi.Error = make(map[[4]byte]abi.Error)
+
+// Adds the custom errors of a contract ABI JSON file to the registry
+func LoadErrorABI(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	parsed, err := abi.JSON(f)
+	if err != nil {
+		return err
+	}
+	for _, e := range parsed.Errors {
+		var selector [4]byte
+		copy(selector[:], e.ID[:4])
+		ErrorBySelector[selector] = e
+	}
+	log.Println("Loaded " + fmt.Sprint(len(parsed.Errors)) + " custom errors from " + path)
+	return nil
+}
+
+// Turns revert data into something a human can read
+func decodeRevertReason(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	var selector [4]byte
+	copy(selector[:], data[:4])
+	switch selector {
+	case errorSelector:
+		reason, err := abi.UnpackRevert(data)
+		if err != nil {
+			break
+		}
+		return reason
+	case panicSelector:
+		if len(data) != 36 {
+			break
+		}
+		code := new(big.Int).SetBytes(data[4:])
+		if reason, ok := panicReasons[code.Uint64()]; code.IsUint64() && ok {
+			return "panic: " + reason
+		}
+		return "panic: code 0x" + code.Text(16)
+	default:
+		if customError, ok := ErrorBySelector[selector]; ok {
+			args, err := customError.Unpack(data)
+			if err == nil {
+				return customError.Name + fmt.Sprint(args)
+			}
+		}
+	}
+	return "custom error 0x" + hex.EncodeToString(data[:4])
+}
+
+// Replays a failed transaction at the parent block to get hold of the revert data
+func snoopRevertReason(client *ethclient.Client, tx Tx, data []byte, value *big.Int, blockNumber *big.Int) string {
+	msg := ethereum.CallMsg{From: common.HexToAddress(tx.TxFrom), Gas: tx.TxGas, Value: value, Data: data}
+	if !tx.TxContractCreation {
+		to := common.HexToAddress(tx.TxTo)
+		msg.To = &to
+	}
+	parent := new(big.Int).Sub(blockNumber, big.NewInt(1))
+	_, err := client.CallContract(context.Background(), msg, parent)
+	apiCallsProcessed.Inc()
+	if err == nil {
+		// State at the parent block differs from the one the tx actually ran on
+		return "unknown, replay did not revert"
+	}
+	if dataErr, ok := err.(rpc.DataError); ok {
+		if revertData, ok := dataErr.ErrorData().(string); ok {
+			if raw, err := hexutil.Decode(revertData); err == nil {
+				if reason := decodeRevertReason(raw); reason != "" {
+					return reason
+				}
+			}
+		}
+	}
+	return strings.TrimPrefix(err.Error(), "execution reverted: ")
+}
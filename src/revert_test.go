@@ -0,0 +1,28 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeRevertReason(t *testing.T) {
+	// Error("Not enough Ether provided.")
+	reverted := hexutil.MustDecode("0x08c379a00000000000000000000000000000000000000000000000000000000000000020000000000000000000000000000000000000000000000000000000000000001a4e6f7420656e6f7567682045746865722070726f76696465642e000000000000")
+	assert.Equal(t, "Not enough Ether provided.", decodeRevertReason(reverted))
+	// Panic(0x11)
+	panicked := hexutil.MustDecode("0x4e487b710000000000000000000000000000000000000000000000000000000000000011")
+	assert.Equal(t, "panic: arithmetic overflow or underflow", decodeRevertReason(panicked))
+	// InsufficientBalance(uint256,uint256)
+	custom := hexutil.MustDecode("0xcf47918100000000000000000000000000000000000000000000000000000000000000010000000000000000000000000000000000000000000000000000000000000002")
+	assert.Equal(t, "custom error 0xcf479181", decodeRevertReason(custom))
+	assert.Equal(t, "", decodeRevertReason([]byte{0x01}))
+
+	path := filepath.Join(t.TempDir(), "errors.json")
+	os.WriteFile(path, []byte(`[{"type":"error","name":"InsufficientBalance","inputs":[{"name":"available","type":"uint256"},{"name":"required","type":"uint256"}]}]`), 0644)
+	assert.Nil(t, LoadErrorABI(path))
+	assert.Equal(t, "InsufficientBalance[1 2]", decodeRevertReason(custom))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// A time bucket of aggregates over the committed blocks. Buckets are
+// written whole, so storing one again is harmless.
+type Rollup struct {
+	Resolution string `json:"Resolution"`
+	// Unix time the bucket starts at
+	Start     int64 `json:"Start"`
+	Blocks    int64 `json:"Blocks"`
+	Txs       int64 `json:"Txs"`
+	FailedTxs int64 `json:"FailedTxs"`
+	GasUsed   int64 `json:"GasUsed"`
+	// Base fees burned in wei, a decimal string as it outgrows 64 bits
+	BurnedFees string `json:"BurnedFees,omitempty"`
+	// Matched transactions by filter id
+	FilterMatches map[int]int64 `json:"FilterMatches,omitempty"`
+}
+
+type rollupResolution struct {
+	Name string
+	Size int64
+	// How long buckets are kept, zero forever
+	Keep time.Duration
+}
+
+var rollupResolutions = []rollupResolution{
+	{"minute", 60, 48 * time.Hour},
+	{"hour", 3600, 90 * 24 * time.Hour},
+	{"day", 86400, 0},
+}
+
+func findRollupResolution(name string) (rollupResolution, error) {
+	for _, r := range rollupResolutions {
+		if r.Name == name {
+			return r, nil
+		}
+	}
+	return rollupResolution{}, fmt.Errorf("unknown resolution %q, use minute, hour or day", name)
+}
+
+// Adds the counts of the block to the bucket, sign -1 takes them out again
+func (r *Rollup) add(block Block, sign int64) {
+	r.Blocks += sign
+	r.Txs += sign * int64(block.BlockNumTransactions)
+	r.FailedTxs += sign * int64(block.BlockFailedTxs)
+	r.GasUsed += sign * int64(block.BlockGasUsed)
+	if block.BlockBurnedFees != "" {
+		fees, ok := new(big.Int).SetString(block.BlockBurnedFees, 10)
+		if ok {
+			total, _ := new(big.Int).SetString(r.BurnedFees, 10)
+			if total == nil {
+				total = new(big.Int)
+			}
+			r.BurnedFees = total.Add(total, fees.Mul(fees, big.NewInt(sign))).String()
+		}
+	}
+	for id, n := range block.BlockFilterMatches {
+		if r.FilterMatches == nil {
+			r.FilterMatches = make(map[int]int64)
+		}
+		r.FilterMatches[id] += sign * int64(n)
+		if r.FilterMatches[id] == 0 {
+			delete(r.FilterMatches, id)
+		}
+	}
+}
+
+// Adds a committed block to its minute, hour and day buckets and drops the
+// buckets past their retention. The single ingesting instance is the only
+// writer, so reading and writing back the bucket does not race.
+func RollupBlock(block Block, sign int64) error {
+	var rollups []Rollup
+	for _, res := range rollupResolutions {
+		start := int64(block.BlockTime) / res.Size * res.Size
+		existing, err := store.Rollups(res.Name, start, start)
+		if err != nil {
+			return err
+		}
+		r := Rollup{Resolution: res.Name, Start: start}
+		if len(existing) > 0 {
+			r = *existing[0]
+			// Stored buckets are shared with readers, change a copy
+			matches := r.FilterMatches
+			r.FilterMatches = nil
+			for id, n := range matches {
+				if r.FilterMatches == nil {
+					r.FilterMatches = make(map[int]int64, len(matches))
+				}
+				r.FilterMatches[id] = n
+			}
+		}
+		r.add(block, sign)
+		rollups = append(rollups, r)
+	}
+	if err := store.StoreRollups(rollups); err != nil {
+		return err
+	}
+	for _, res := range rollupResolutions {
+		if res.Keep > 0 {
+			if err := store.DeleteRollups(res.Name, time.Now().Add(-res.Keep).Unix()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Value of the metric in the bucket, the Grafana targets are blocks, txs,
+// failed_txs, gas_used, burned_fees (ETH) and filter_matches:<id>
+func (r *Rollup) metric(target string) (float64, error) {
+	switch target {
+	case "blocks":
+		return float64(r.Blocks), nil
+	case "txs":
+		return float64(r.Txs), nil
+	case "failed_txs":
+		return float64(r.FailedTxs), nil
+	case "gas_used":
+		return float64(r.GasUsed), nil
+	case "burned_fees":
+		fees, ok := new(big.Float).SetString(r.BurnedFees)
+		if !ok {
+			return 0, nil
+		}
+		eth, _ := fees.Quo(fees, big.NewFloat(1e18)).Float64()
+		return eth, nil
+	}
+	var id int
+	if _, err := fmt.Sscanf(target, "filter_matches:%d", &id); err == nil {
+		return float64(r.FilterMatches[id]), nil
+	}
+	return 0, fmt.Errorf("unknown target %q", target)
+}
+
+// The coarsest resolution no longer than the interval, coarser still if its
+// buckets around from have already been dropped
+func rollupResolutionFor(interval time.Duration, from time.Time) rollupResolution {
+	chosen := rollupResolutions[0]
+	for _, res := range rollupResolutions {
+		if time.Duration(res.Size)*time.Second <= interval {
+			chosen = res
+		}
+	}
+	for _, res := range rollupResolutions {
+		if res.Size >= chosen.Size && (res.Keep == 0 || time.Since(from) <= res.Keep) {
+			return res
+		}
+	}
+	return rollupResolutions[len(rollupResolutions)-1]
+}
+
+func (m *MemoryStore) StoreRollups(rollups []Rollup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range rollups {
+		r := r
+		if m.rollups[r.Resolution] == nil {
+			m.rollups[r.Resolution] = make(map[int64]*Rollup)
+		}
+		m.rollups[r.Resolution][r.Start] = &r
+	}
+	return nil
+}
+
+func (m *MemoryStore) Rollups(resolution string, from int64, to int64) ([]*Rollup, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var rollups []*Rollup
+	for start, r := range m.rollups[resolution] {
+		if start >= from && start <= to {
+			rollups = append(rollups, r)
+		}
+	}
+	sort.Slice(rollups, func(a, b int) bool { return rollups[a].Start < rollups[b].Start })
+	return rollups, nil
+}
+
+func (m *MemoryStore) DeleteRollups(resolution string, before int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for start := range m.rollups[resolution] {
+		if start < before {
+			delete(m.rollups[resolution], start)
+		}
+	}
+	return nil
+}
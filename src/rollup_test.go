@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollupBlock(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	now := uint64(time.Now().Unix()) / 3600 * 3600
+	assert.Nil(t, RollupBlock(Block{BlockTime: now + 5, BlockNumTransactions: 150, BlockFailedTxs: 3, BlockGasUsed: 15000000, BlockBurnedFees: "300000000000000000", BlockFilterMatches: map[int]int{0: 2}}, 1))
+	assert.Nil(t, RollupBlock(Block{BlockTime: now + 17, BlockNumTransactions: 100, BlockGasUsed: 12000000, BlockBurnedFees: "20000000000000000000", BlockFilterMatches: map[int]int{0: 1, 1: 1}}, 1))
+	reorged := Block{BlockTime: now + 65, BlockNumTransactions: 50, BlockFailedTxs: 1, BlockGasUsed: 9000000, BlockBurnedFees: "100000000000000000", BlockFilterMatches: map[int]int{1: 4}}
+	assert.Nil(t, RollupBlock(reorged, 1))
+	assert.Nil(t, RollupBlock(reorged, -1))
+
+	minutes, _ := store.Rollups("minute", 0, int64(now)+3600)
+	assert.Equal(t, 2, len(minutes))
+	assert.Equal(t, int64(0), minutes[1].Blocks)
+	hours, _ := store.Rollups("hour", int64(now), int64(now))
+	assert.Equal(t, 1, len(hours))
+	assert.Equal(t, Rollup{Resolution: "hour", Start: int64(now), Blocks: 2, Txs: 250, FailedTxs: 3, GasUsed: 27000000, BurnedFees: "20300000000000000000", FilterMatches: map[int]int64{0: 3, 1: 1}}, *hours[0])
+	days, _ := store.Rollups("day", 0, int64(now))
+	assert.Equal(t, int64(2), days[0].Blocks)
+	fees, _ := hours[0].metric("burned_fees")
+	assert.InDelta(t, 20.3, fees, 1e-9)
+	matches, _ := hours[0].metric("filter_matches:0")
+	assert.Equal(t, float64(3), matches)
+	_, err := hours[0].metric("uncles")
+	assert.NotNil(t, err)
+
+	// Minute buckets past their retention are dropped with the next block
+	store.StoreRollups([]Rollup{{Resolution: "minute", Start: int64(now) - 72*3600, Blocks: 5}})
+	assert.Nil(t, RollupBlock(Block{BlockTime: now + 70}, 1))
+	minutes, _ = store.Rollups("minute", 0, int64(now)-3600)
+	assert.Equal(t, 0, len(minutes))
+}
+
+func TestReorgRollupsWithGap(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	now := uint64(time.Now().Unix()) / 3600 * 3600
+	// Nothing stored at 102
+	for n, number := range []uint64{100, 101, 103} {
+		block := Block{Id: n + 1, BlockHash: "0xb" + fmt.Sprint(number), BlockNumber: number, BlockTime: now + uint64(n), BlockNumTransactions: 10, BlockRolledUp: true}
+		assert.Nil(t, store.StoreBlock(block))
+		assert.Nil(t, RollupBlock(block, 1))
+	}
+	snoopReorg(101, "0xother")
+	blocks, _ := store.Blocks()
+	assert.Equal(t, 1, len(blocks))
+	hours, _ := store.Rollups("hour", int64(now), int64(now))
+	assert.Equal(t, int64(1), hours[0].Blocks)
+	assert.Equal(t, int64(10), hours[0].Txs)
+}
+
+func TestRollupResolutionFor(t *testing.T) {
+	assert.Equal(t, "minute", rollupResolutionFor(30*time.Second, time.Now().Add(-time.Hour)).Name)
+	assert.Equal(t, "hour", rollupResolutionFor(2*time.Hour, time.Now().Add(-time.Hour)).Name)
+	assert.Equal(t, "hour", rollupResolutionFor(time.Minute, time.Now().Add(-7*24*time.Hour)).Name)
+	assert.Equal(t, "day", rollupResolutionFor(time.Minute, time.Now().Add(-365*24*time.Hour)).Name)
+}
+
+func testRollups(t *testing.T, b Store) {
+	assert.Nil(t, b.StoreRollups([]Rollup{
+		{Resolution: "minute", Start: 1651499040, Blocks: 4},
+		{Resolution: "minute", Start: 1651499100, Blocks: 5},
+		{Resolution: "hour", Start: 1651496400, Blocks: 9, FilterMatches: map[int]int64{2: 7}},
+	}))
+	assert.Nil(t, b.StoreRollups([]Rollup{{Resolution: "minute", Start: 1651499100, Blocks: 6}}))
+	minutes, _ := b.Rollups("minute", 0, 1651499100)
+	assert.Equal(t, 2, len(minutes))
+	assert.Equal(t, int64(6), minutes[1].Blocks)
+	hours, _ := b.Rollups("hour", 1651496400, 1651496400)
+	assert.Equal(t, int64(7), hours[0].FilterMatches[2])
+	assert.Nil(t, b.DeleteRollups("minute", 1651499100))
+	minutes, _ = b.Rollups("minute", 0, 1651499100)
+	assert.Equal(t, 1, len(minutes))
+	hours, _ = b.Rollups("hour", 0, 1651496400)
+	assert.Equal(t, 1, len(hours))
+}
+
+func TestMemoryStoreRollups(t *testing.T) {
+	testRollups(t, NewMemoryStore())
+}
+
+func TestBoltStoreRollups(t *testing.T) {
+	b, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer b.Close()
+	testRollups(t, b)
+}
+
+func TestGrafanaQuery(t *testing.T) {
+	saved := store
+	store = NewMemoryStore()
+	defer func() { store = saved }()
+	store.StoreRollups([]Rollup{
+		{Resolution: "day", Start: 1651449600, Blocks: 6400, Txs: 1200000},
+		{Resolution: "day", Start: 1651536000, Blocks: 6500, Txs: 1300000},
+	})
+	a := App{}
+	body := `{"range":{"from":"2022-05-01T00:00:00Z","to":"2022-05-04T00:00:00Z"},"intervalMs":86400000,"targets":[{"target":"txs","refId":"A"}]}`
+	w := httptest.NewRecorder()
+	a.grafanaQueryRequest(w, httptest.NewRequest("POST", "/grafana/query", strings.NewReader(body)))
+	assert.Equal(t, 200, w.Code)
+	var series []GrafanaSeries
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &series))
+	assert.Equal(t, []GrafanaSeries{{Target: "txs", Datapoints: [][2]float64{{1200000, 1651449600000}, {1300000, 1651536000000}}}}, series)
+
+	w = httptest.NewRecorder()
+	a.grafanaQueryRequest(w, httptest.NewRequest("POST", "/grafana/query", strings.NewReader(strings.Replace(body, `"txs"`, `"uncles"`, 1))))
+	assert.Equal(t, 400, w.Code)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// A snapshot is gzip compressed NDJSON, a header line, one line per
+// block, transaction, filter, rollup and watchlist and a closing checkpoint line.
+const (
+	snapshotFormat  = "snoopy-snapshot"
+	snapshotVersion = 1
+)
+
+type SnapshotHeader struct {
+	Format  string `json:"Format"`
+	Version int    `json:"Version"`
+	Created string `json:"Created,omitempty"`
+}
+
+type SnapshotRecord struct {
+	Type       string      `json:"Type"` // block, tx, filter, rollup, watchlist or checkpoint
+	Block      *Block      `json:"Block,omitempty"`
+	Tx         *Tx         `json:"Tx,omitempty"`
+	Filter     *Filters    `json:"Filter,omitempty"`
+	Rollup     *Rollup     `json:"Rollup,omitempty"`
+	Watchlist  *Watchlist  `json:"Watchlist,omitempty"`
+	Checkpoint *Checkpoint `json:"Checkpoint,omitempty"`
+}
+
+// Where ingestion stood when the snapshot was taken, the counts let an
+// import tell a complete snapshot from a truncated one
+type Checkpoint struct {
+	LastBlockId     int    `json:"LastBlockId,omitempty"`
+	LastBlockNumber uint64 `json:"LastBlockNumber,omitempty"`
+	LastTxId        int    `json:"LastTxId,omitempty"`
+	Blocks          int    `json:"Blocks"`
+	Txs             int    `json:"Txs"`
+	Filters         int    `json:"Filters"`
+	Rollups         int    `json:"Rollups,omitempty"`
+	Watchlists      int    `json:"Watchlists,omitempty"`
+}
+
+func sortedIds[V any](records map[int]V) []int {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Writes everything in the store to w
+func ExportSnapshot(s Store, w io.Writer) (Checkpoint, error) {
+	var cp Checkpoint
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(SnapshotHeader{Format: snapshotFormat, Version: snapshotVersion, Created: time.Now().UTC().Format(time.RFC3339)}); err != nil {
+		return cp, err
+	}
+	blocks, err := s.Blocks()
+	if err != nil {
+		return cp, err
+	}
+	for _, id := range sortedIds(blocks) {
+		block := blocks[id]
+		if err := enc.Encode(SnapshotRecord{Type: "block", Block: block}); err != nil {
+			return cp, err
+		}
+		cp.Blocks++
+		cp.LastBlockId = block.Id
+		if block.BlockNumber > cp.LastBlockNumber {
+			cp.LastBlockNumber = block.BlockNumber
+		}
+	}
+	txs, err := s.Txs()
+	if err != nil {
+		return cp, err
+	}
+	for _, id := range sortedIds(txs) {
+		// Blocks ingested since the blocks were read come in the next snapshot
+		// together with their transactions
+		if txs[id].TxBlockId > cp.LastBlockId {
+			continue
+		}
+		if err := enc.Encode(SnapshotRecord{Type: "tx", Tx: txs[id]}); err != nil {
+			return cp, err
+		}
+		cp.Txs++
+		cp.LastTxId = id
+	}
+	filters, err := s.Filters()
+	if err != nil {
+		return cp, err
+	}
+	for _, id := range sortedIds(filters) {
+		if err := enc.Encode(SnapshotRecord{Type: "filter", Filter: filters[id]}); err != nil {
+			return cp, err
+		}
+		cp.Filters++
+	}
+	for _, res := range rollupResolutions {
+		rollups, err := s.Rollups(res.Name, 0, math.MaxInt64)
+		if err != nil {
+			return cp, err
+		}
+		for _, r := range rollups {
+			if err := enc.Encode(SnapshotRecord{Type: "rollup", Rollup: r}); err != nil {
+				return cp, err
+			}
+			cp.Rollups++
+		}
+	}
+	watchlists, err := s.Watchlists()
+	if err != nil {
+		return cp, err
+	}
+	names := make([]string, 0, len(watchlists))
+	for name := range watchlists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := enc.Encode(SnapshotRecord{Type: "watchlist", Watchlist: watchlists[name]}); err != nil {
+			return cp, err
+		}
+		cp.Watchlists++
+	}
+	if err := enc.Encode(SnapshotRecord{Type: "checkpoint", Checkpoint: &cp}); err != nil {
+		return cp, err
+	}
+	return cp, gz.Close()
+}
+
+// Reads a snapshot written by ExportSnapshot into the store. The whole
+// snapshot is read and checked before anything is written; one without its
+// checkpoint is rejected as truncated, one with block or transaction ids the
+// store holds for other records is rejected instead of attaching
+// transactions to the wrong block. Only a store error while writing leaves
+// part of it imported.
+func ImportSnapshot(s Store, r io.Reader) (Checkpoint, error) {
+	cp, records, err := readSnapshot(r)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	if err := checkSnapshotIds(s, records); err != nil {
+		return Checkpoint{}, err
+	}
+	for _, record := range records {
+		var err error
+		switch record.Type {
+		case "block":
+			err = s.StoreBlock(*record.Block)
+		case "tx":
+			err = s.StoreTx(*record.Tx)
+		case "filter":
+			err = s.StoreFilter(*record.Filter)
+		case "rollup":
+			err = s.StoreRollups([]Rollup{*record.Rollup})
+		case "watchlist":
+			err = s.StoreWatchlist(*record.Watchlist)
+		}
+		if err != nil {
+			return Checkpoint{}, err
+		}
+	}
+	return cp, nil
+}
+
+// The records of a snapshot up to its checkpoint, which has to match them
+func readSnapshot(r io.Reader) (Checkpoint, []SnapshotRecord, error) {
+	var cp Checkpoint
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return cp, nil, err
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	var header SnapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return cp, nil, fmt.Errorf("reading snapshot header: %w", err)
+	}
+	if header.Format != snapshotFormat {
+		return cp, nil, fmt.Errorf("not a snapshot, format %q", header.Format)
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return cp, nil, fmt.Errorf("snapshot version %d is not supported, expected up to %d", header.Version, snapshotVersion)
+	}
+	var read Checkpoint
+	var records []SnapshotRecord
+	for {
+		var record SnapshotRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return cp, nil, fmt.Errorf("snapshot is truncated, no checkpoint after %d blocks, %d txs and %d filters", read.Blocks, read.Txs, read.Filters)
+		} else if err != nil {
+			return cp, nil, err
+		}
+		switch {
+		case record.Type == "block" && record.Block != nil:
+			read.Blocks++
+		case record.Type == "tx" && record.Tx != nil:
+			read.Txs++
+		case record.Type == "filter" && record.Filter != nil:
+			read.Filters++
+		case record.Type == "rollup" && record.Rollup != nil:
+			read.Rollups++
+		case record.Type == "watchlist" && record.Watchlist != nil:
+			read.Watchlists++
+		case record.Type == "checkpoint" && record.Checkpoint != nil:
+			cp = *record.Checkpoint
+			if cp.Blocks != read.Blocks || cp.Txs != read.Txs || cp.Filters != read.Filters || cp.Rollups != read.Rollups || cp.Watchlists != read.Watchlists {
+				return cp, nil, fmt.Errorf("snapshot checkpoint expects %d blocks, %d txs, %d filters, %d rollups and %d watchlists, read %d, %d, %d, %d and %d",
+					cp.Blocks, cp.Txs, cp.Filters, cp.Rollups, cp.Watchlists, read.Blocks, read.Txs, read.Filters, read.Rollups, read.Watchlists)
+			}
+			return cp, records, nil
+		default:
+			return cp, nil, fmt.Errorf("unknown snapshot record %q", record.Type)
+		}
+		records = append(records, record)
+	}
+}
+
+// Checks that the ids of the blocks and transactions are free in the store
+// or held by the same records, importing a snapshot again is fine
+func checkSnapshotIds(s Store, records []SnapshotRecord) error {
+	for _, record := range records {
+		switch record.Type {
+		case "block":
+			block := record.Block
+			stored, err := s.BlockById(block.Id)
+			if err != nil {
+				return err
+			}
+			if stored != nil && stored.BlockHash != block.BlockHash {
+				return fmt.Errorf("block id %d of %s is taken by %s in the store", block.Id, block.BlockHash, stored.BlockHash)
+			}
+			byHash, err := s.BlocksByHash(block.BlockHash)
+			if err != nil {
+				return err
+			}
+			for _, stored := range byHash {
+				if stored.Id != block.Id {
+					return fmt.Errorf("block %s has id %d, the store has it as %d", block.BlockHash, block.Id, stored.Id)
+				}
+			}
+		case "tx":
+			tx := record.Tx
+			stored, err := s.TxById(tx.Id)
+			if err != nil {
+				return err
+			}
+			if stored != nil && stored.TxHash != tx.TxHash {
+				return fmt.Errorf("tx id %d of %s is taken by %s in the store", tx.Id, tx.TxHash, stored.TxHash)
+			}
+			if stored, err = s.TxByHash(tx.TxHash); err != nil {
+				return err
+			}
+			if stored != nil && stored.Id != tx.Id {
+				return fmt.Errorf("tx %s has id %d, the store has it as %d", tx.TxHash, tx.Id, stored.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// snoopy export|import [-file path] moves the store selected by SNOOPY_STORE
+// to or from a snapshot, stdout and stdin without -file
+func runSnapshot(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	path := flags.String("file", "", "Snapshot file, stdout or stdin if empty")
+	flags.Parse(args)
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+	var cp Checkpoint
+	if name == "export" {
+		out := io.Writer(os.Stdout)
+		if *path != "" {
+			f, err := os.Create(*path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+		cp, err = ExportSnapshot(s, out)
+	} else {
+		in := io.Reader(os.Stdin)
+		if *path != "" {
+			f, err := os.Open(*path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		cp, err = ImportSnapshot(s, in)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println(name + ": " + fmt.Sprint(cp.Blocks) + " blocks, " + fmt.Sprint(cp.Txs) + " txs, " + fmt.Sprint(cp.Filters) + " filters up to #" + fmt.Sprint(cp.LastBlockNumber))
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752, BlockTime: 1651499015}, []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxReceiptStatus: 1},
+		{Id: 2, TxBlockId: 1, TxBlockNumber: 12232752, TxIndex: 1, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0x0", TxContractCreation: true},
+	})
+	m.StoreBlock(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232754})
+	m.StoreFilter(Filters{Id: 0, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	m.StoreFilter(Filters{Id: 1, Deployer: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"})
+	m.StoreRollups([]Rollup{{Resolution: "day", Start: 1651449600, Blocks: 1, Txs: 2, FilterMatches: map[int]int64{0: 1}}})
+
+	var buf bytes.Buffer
+	cp, err := ExportSnapshot(m, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, Checkpoint{LastBlockId: 2, LastBlockNumber: 12232754, LastTxId: 2, Blocks: 2, Txs: 2, Filters: 2, Rollups: 1}, cp)
+
+	restored := NewMemoryStore()
+	imported, err := ImportSnapshot(restored, bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	assert.Equal(t, cp, imported)
+	tx, _ := restored.TxByHash("0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2")
+	assert.Equal(t, uint64(1), tx.TxIndex)
+	assert.True(t, tx.TxContractCreation)
+	block, _ := restored.BlockById(1)
+	assert.Equal(t, uint64(1651499015), block.BlockTime)
+	filters, _ := restored.FiltersByDeployer("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	assert.Equal(t, 1, len(filters))
+	rollups, _ := restored.Rollups("day", 0, 1651449600)
+	assert.Equal(t, int64(1), rollups[0].FilterMatches[0])
+	lastTxId, _ := restored.LastTxId()
+	assert.Equal(t, 2, lastTxId)
+
+	// A cut off snapshot is noticed
+	raw, _ := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	var plain bytes.Buffer
+	plain.ReadFrom(raw)
+	lines := bytes.SplitAfter(plain.Bytes(), []byte("\n"))
+	var cut bytes.Buffer
+	gz := gzip.NewWriter(&cut)
+	gz.Write(bytes.Join(lines[:3], nil))
+	gz.Close()
+	partial := NewMemoryStore()
+	_, err = ImportSnapshot(partial, &cut)
+	assert.NotNil(t, err)
+	lastBlockId, _ := partial.LastBlockId()
+	assert.Equal(t, 0, lastBlockId)
+}
+
+func TestSnapshotIdCollision(t *testing.T) {
+	source := NewMemoryStore()
+	source.StoreBlock(Block{Id: 1, BlockNumber: 10, BlockHash: "0xb1"})
+	source.StoreTx(Tx{Id: 1, TxHash: "0xt1", TxBlockId: 1})
+	var buf bytes.Buffer
+	_, err := ExportSnapshot(source, &buf)
+	assert.Nil(t, err)
+
+	// Block id 1 holds another block, its txs would end up under that block
+	target := NewMemoryStore()
+	target.StoreBlock(Block{Id: 1, BlockNumber: 20, BlockHash: "0xb2"})
+	_, err = ImportSnapshot(target, bytes.NewReader(buf.Bytes()))
+	assert.NotNil(t, err)
+	tx, _ := target.TxByHash("0xt1")
+	assert.Nil(t, tx)
+
+	// A tx id taken by another tx
+	target = NewMemoryStore()
+	target.StoreTx(Tx{Id: 1, TxHash: "0xt2"})
+	_, err = ImportSnapshot(target, bytes.NewReader(buf.Bytes()))
+	assert.NotNil(t, err)
+	block, _ := target.BlockById(1)
+	assert.Nil(t, block)
+
+	// The same snapshot again is fine
+	target = NewMemoryStore()
+	_, err = ImportSnapshot(target, bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+	_, err = ImportSnapshot(target, bytes.NewReader(buf.Bytes()))
+	assert.Nil(t, err)
+}
+
+// Ingests a block right after the blocks are read, as a running ingestion can
+type ingestingStore struct {
+	*MemoryStore
+}
+
+func (s ingestingStore) Blocks() (map[int]*Block, error) {
+	blocks, err := s.MemoryStore.Blocks()
+	s.StoreBlockTxs(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232753}, []Tx{
+		{Id: 2, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0x0"},
+	})
+	return blocks, err
+}
+
+func TestSnapshotDuringIngestion(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}, []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+	})
+	var buf bytes.Buffer
+	cp, err := ExportSnapshot(ingestingStore{m}, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cp.Blocks)
+	assert.Equal(t, 1, cp.Txs)
+	assert.Equal(t, 1, cp.LastTxId)
+
+	restored := NewMemoryStore()
+	_, err = ImportSnapshot(restored, &buf)
+	assert.Nil(t, err)
+	report, _ := restored.Check(false)
+	assert.Equal(t, 0, report.OrphanTxs)
+}
+
+func TestSnapshotHeader(t *testing.T) {
+	for _, header := range []string{`{"Format":"snoopy-snapshot","Version":2}`, `{"Format":"something-else","Version":1}`} {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write([]byte(header + "\n"))
+		gz.Close()
+		_, err := ImportSnapshot(NewMemoryStore(), &buf)
+		assert.NotNil(t, err)
+	}
+}
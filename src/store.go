@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+)
+
+// Store is where snooped blocks, transactions and filters are kept.
+// The ingestion goroutine writes while the API handlers read, so
+// implementations must be safe for concurrent use.
+type Store interface {
+	// Blocks are keyed by hash, storing one again replaces it
+	StoreBlock(block Block) error
+	BlockById(id int) (*Block, error)
+	BlocksByNumber(number uint64) ([]*Block, error)
+	BlocksByHash(hash string) ([]*Block, error)
+	Blocks() (map[int]*Block, error)
+	LastBlockId() (int, error)
+	// Writes a block and its transactions in one go, readers never see half a block
+	StoreBlockTxs(block Block, txs []Tx) error
+	// Drops the blocks at or above number and their transactions, used when the chain reorganizes.
+	// Returns the blocks dropped.
+	DeleteBlocksFrom(number uint64) ([]*Block, error)
+
+	StoreTx(tx Tx) error
+	TxById(id int) (*Tx, error)
+	// Transactions are keyed by hash, storing one again replaces it
+	TxByHash(hash string) (*Tx, error)
+	TxsByTo(to string) ([]*Tx, error)
+	TxsByBlockId(id int) ([]*Tx, error)
+	TxsByBlockNumber(number uint64) ([]*Tx, error)
+	// Transactions within the ranges of the query, served from an ordered index
+	TxsByRange(q TxQuery) ([]*Tx, error)
+	Txs() (map[int]*Tx, error)
+	LastTxId() (int, error)
+
+	StoreFilter(filter Filters) error
+	DeleteFilter(id int) error
+	FilterById(id int) (*Filters, error)
+	FiltersByTxTo(to string) ([]*Filters, error)
+	FiltersByDeployer(deployer string) ([]*Filters, error)
+	FiltersByBytecodeHash(hash string) ([]*Filters, error)
+	Filters() (map[int]*Filters, error)
+	NumFilters() (int, error)
+	// Hands out a filter id that was never used before, not even by a deleted filter
+	NextFilterId() (int, error)
+
+	// Time bucketed aggregates, kept apart from the raw data and its retention.
+	// Buckets are stored whole, replacing what was stored for their start.
+	StoreRollups(rollups []Rollup) error
+	Rollups(resolution string, from int64, to int64) ([]*Rollup, error)
+	DeleteRollups(resolution string, before int64) error
+
+	// Watchlists are keyed by name, storing one again replaces it
+	StoreWatchlist(watchlist Watchlist) error
+	DeleteWatchlist(name string) error
+	Watchlists() (map[string]*Watchlist, error)
+
+	// Looks for duplicate and dangling index entries, removing them if repair is set
+	Check(repair bool) (CheckReport, error)
+}
+
+// The store used by the ingestion and the API
+var store Store = NewMemoryStore()
+
+// Opens the backend selected by SNOOPY_STORE, memory unless told otherwise
+func openStore() (Store, error) {
+	switch backend := os.Getenv("SNOOPY_STORE"); backend {
+	case "", "memory":
+		retention, err := retentionFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		m := NewMemoryStore()
+		m.SetRetention(retention)
+		if dir := os.Getenv("SNOOPY_JOURNAL_PATH"); dir != "" {
+			options, err := journalOptionsFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			log.Println("Using journal " + dir + ", " + options.String())
+			return NewJournaledStore(m, dir, options)
+		}
+		return m, nil
+	case "bolt":
+		path := os.Getenv("SNOOPY_STORE_PATH")
+		if path == "" {
+			path = "snoopy.db"
+		}
+		log.Println("Using bolt store " + path)
+		return NewBoltStore(path)
+	case "postgres":
+		dsn := os.Getenv("SNOOPY_STORE_DSN")
+		if dsn == "" {
+			return nil, fmt.Errorf("SNOOPY_STORE_DSN is required for the postgres store")
+		}
+		log.Println("Using postgres store")
+		return NewPostgresStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown store %q, use memory, bolt or postgres", backend)
+	}
+}
+
+// MemoryStore keeps everything in maps guarded by a single RWMutex.
+// Lookups hand out copies of the index slices and maps so callers
+// can range over them after the lock is released.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	blockById     map[int]*Block
+	blockByNumber map[uint64][]*Block
+	blockByHash   map[string][]*Block
+	lastBlockId   int
+	// Block ids in the order they were stored, the front is evicted first
+	blockOrder []int
+
+	txById          map[int]*Tx
+	txByTo          map[string][]*Tx
+	txByHash        map[string]*Tx
+	lastTxId        int
+	txByBlockId     map[int][]*Tx
+	txByBlockNumber map[uint64][]*Tx
+	// Ordered by block time, value and gas price for range queries
+	txByTime     *orderedIndex
+	txByValue    *orderedIndex
+	txByGasPrice *orderedIndex
+
+	filterById           map[int]*Filters
+	filterByTxTo         map[string][]*Filters
+	filterByDeployer     map[string][]*Filters
+	filterByBytecodeHash map[string][]*Filters
+	lastFilterId         int
+
+	rollups map[string]map[int64]*Rollup
+
+	watchlists map[string]*Watchlist
+
+	retention Retention
+	// Approximate heap footprint of the blocks and transactions
+	size int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		blockById:            make(map[int]*Block),
+		blockByNumber:        make(map[uint64][]*Block),
+		blockByHash:          make(map[string][]*Block),
+		txById:               make(map[int]*Tx),
+		txByTo:               make(map[string][]*Tx),
+		txByHash:             make(map[string]*Tx),
+		txByBlockId:          make(map[int][]*Tx),
+		txByBlockNumber:      make(map[uint64][]*Tx),
+		txByTime:             newOrderedIndex(),
+		txByValue:            newOrderedIndex(),
+		txByGasPrice:         newOrderedIndex(),
+		filterById:           make(map[int]*Filters),
+		filterByTxTo:         make(map[string][]*Filters),
+		filterByDeployer:     make(map[string][]*Filters),
+		filterByBytecodeHash: make(map[string][]*Filters),
+		rollups:              make(map[string]map[int64]*Rollup),
+		watchlists:           make(map[string]*Watchlist),
+	}
+}
+
+func (m *MemoryStore) StoreBlock(block Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeBlock(block)
+	m.evict()
+	return nil
+}
+
+func (m *MemoryStore) storeBlock(block Block) {
+	old, found := m.blockById[block.Id]
+	for _, dup := range append([]*Block(nil), m.blockByHash[block.BlockHash]...) {
+		if dup != old {
+			m.removeBlockRecord(dup)
+		}
+	}
+	switch {
+	case !found:
+		// Eviction goes by the order ids were first stored in
+		m.blockOrder = append(m.blockOrder, block.Id)
+	case old.BlockHash != block.BlockHash:
+		// Another block under the id, the transactions were the old block's
+		m.removeBlock(old)
+	default:
+		m.removeBlockRecord(old)
+	}
+	m.blockById[block.Id] = &block
+	if block.Id > m.lastBlockId {
+		m.lastBlockId = block.Id
+	}
+	m.blockByNumber[block.BlockNumber] = append(m.blockByNumber[block.BlockNumber], &block)
+	m.blockByHash[block.BlockHash] = append(m.blockByHash[block.BlockHash], &block)
+	m.size += block.approxSize()
+}
+
+// Takes a block and its transactions out of every index
+func (m *MemoryStore) removeBlock(block *Block) int {
+	txs := append([]*Tx(nil), m.txByBlockId[block.Id]...)
+	for _, tx := range txs {
+		m.removeTx(tx)
+	}
+	m.removeBlockRecord(block)
+	return len(txs)
+}
+
+// Takes just the block out of the indexes, its transactions stay
+func (m *MemoryStore) removeBlockRecord(block *Block) {
+	if m.blockById[block.Id] == block {
+		delete(m.blockById, block.Id)
+	}
+	memoryIndexRemove(m.blockByNumber, block.BlockNumber, block)
+	memoryIndexRemove(m.blockByHash, block.BlockHash, block)
+	m.size -= block.approxSize()
+}
+
+func (m *MemoryStore) removeTx(tx *Tx) {
+	if m.txById[tx.Id] == tx {
+		delete(m.txById, tx.Id)
+	}
+	if m.txByHash[tx.TxHash] == tx {
+		delete(m.txByHash, tx.TxHash)
+	}
+	memoryIndexRemove(m.txByTo, tx.TxTo, tx)
+	memoryIndexRemove(m.txByBlockId, tx.TxBlockId, tx)
+	memoryIndexRemove(m.txByBlockNumber, tx.TxBlockNumber, tx)
+	for _, index := range txRangeIndexes {
+		m.orderedIndex(index).remove(string(tx.rangeKey(index)), tx)
+	}
+	m.size -= tx.approxSize()
+}
+
+// Removes one entry from the slice under key, dropping the key once it is empty.
+// Entries go oldest first so the search rarely gets past the front.
+func memoryIndexRemove[K comparable, V any](index map[K][]*V, key K, entry *V) {
+	entries := index[key]
+	for n, e := range entries {
+		if e == entry {
+			entries = append(entries[:n:n], entries[n+1:]...)
+			break
+		}
+	}
+	if len(entries) == 0 {
+		delete(index, key)
+	} else {
+		index[key] = entries
+	}
+}
+
+func (m *MemoryStore) BlockById(id int) (*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.blockById[id], nil
+}
+
+func (m *MemoryStore) BlocksByNumber(number uint64) ([]*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Block(nil), m.blockByNumber[number]...), nil
+}
+
+func (m *MemoryStore) BlocksByHash(hash string) ([]*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Block(nil), m.blockByHash[hash]...), nil
+}
+
+func (m *MemoryStore) Blocks() (map[int]*Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	blocks := make(map[int]*Block, len(m.blockById))
+	for id, block := range m.blockById {
+		blocks[id] = block
+	}
+	return blocks, nil
+}
+
+func (m *MemoryStore) LastBlockId() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastBlockId, nil
+}
+
+func (m *MemoryStore) StoreBlockTxs(block Block, txs []Tx) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeBlock(block)
+	for _, tx := range txs {
+		m.storeTx(tx)
+	}
+	m.evict()
+	return nil
+}
+
+func (m *MemoryStore) DeleteBlocksFrom(number uint64) ([]*Block, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var deleted []*Block
+	for _, block := range m.blockById {
+		if block.BlockNumber >= number {
+			m.removeBlock(block)
+			deleted = append(deleted, block)
+		}
+	}
+	// Transactions stored without their block
+	for n, txs := range m.txByBlockNumber {
+		if n >= number {
+			for _, tx := range txs {
+				m.removeTx(tx)
+			}
+		}
+	}
+	// A deleted id stored again goes to the end
+	order := m.blockOrder[:0]
+	for _, id := range m.blockOrder {
+		if _, found := m.blockById[id]; found {
+			order = append(order, id)
+		}
+	}
+	m.blockOrder = order
+	m.updateSizeMetrics()
+	return deleted, nil
+}
+
+func (m *MemoryStore) StoreTx(tx Tx) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.storeTx(tx)
+	m.evict()
+	return nil
+}
+
+func (m *MemoryStore) storeTx(tx Tx) {
+	if old, found := m.txByHash[tx.TxHash]; found {
+		m.removeTx(old)
+	}
+	m.txByHash[tx.TxHash] = &tx
+	m.txById[tx.Id] = &tx
+	if tx.Id > m.lastTxId {
+		m.lastTxId = tx.Id
+	}
+	m.txByTo[tx.TxTo] = append(m.txByTo[tx.TxTo], &tx)
+	m.txByBlockId[tx.TxBlockId] = append(m.txByBlockId[tx.TxBlockId], &tx)
+	m.txByBlockNumber[tx.TxBlockNumber] = append(m.txByBlockNumber[tx.TxBlockNumber], &tx)
+	for _, index := range txRangeIndexes {
+		m.orderedIndex(index).insert(string(tx.rangeKey(index)), &tx)
+	}
+	m.size += tx.approxSize()
+}
+
+func (m *MemoryStore) TxById(id int) (*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.txById[id], nil
+}
+
+func (m *MemoryStore) TxsByTo(to string) ([]*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Tx(nil), m.txByTo[to]...), nil
+}
+
+func (m *MemoryStore) TxByHash(hash string) (*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.txByHash[hash], nil
+}
+
+func (m *MemoryStore) TxsByBlockId(id int) ([]*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Tx(nil), m.txByBlockId[id]...), nil
+}
+
+func (m *MemoryStore) TxsByBlockNumber(number uint64) ([]*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Tx(nil), m.txByBlockNumber[number]...), nil
+}
+
+func (m *MemoryStore) Txs() (map[int]*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	txs := make(map[int]*Tx, len(m.txById))
+	for id, tx := range m.txById {
+		txs[id] = tx
+	}
+	return txs, nil
+}
+
+func (m *MemoryStore) LastTxId() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastTxId, nil
+}
+
+func (m *MemoryStore) StoreFilter(filter Filters) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Storing an id again replaces the filter
+	if old, found := m.filterById[filter.Id]; found {
+		m.removeFilter(old)
+	}
+	if filter.Id > m.lastFilterId {
+		m.lastFilterId = filter.Id
+	}
+	m.filterById[filter.Id] = &filter
+	if filter.TxTo != "" {
+		m.filterByTxTo[filter.TxTo] = append(m.filterByTxTo[filter.TxTo], &filter)
+	}
+	if filter.Deployer != "" {
+		m.filterByDeployer[filter.Deployer] = append(m.filterByDeployer[filter.Deployer], &filter)
+	}
+	if filter.BytecodeHash != "" {
+		m.filterByBytecodeHash[filter.BytecodeHash] = append(m.filterByBytecodeHash[filter.BytecodeHash], &filter)
+	}
+	return nil
+}
+
+func (m *MemoryStore) DeleteFilter(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cFilterRow, found := m.filterById[id]
+	if !found {
+		return nil
+	}
+	m.removeFilter(cFilterRow)
+	return nil
+}
+
+// Drops the filter from the id and lookup indexes, other filters on the same
+// address stay
+func (m *MemoryStore) removeFilter(filter *Filters) {
+	delete(m.filterById, filter.Id)
+	memoryIndexRemove(m.filterByTxTo, filter.TxTo, filter)
+	memoryIndexRemove(m.filterByDeployer, filter.Deployer, filter)
+	memoryIndexRemove(m.filterByBytecodeHash, filter.BytecodeHash, filter)
+}
+
+func (m *MemoryStore) FilterById(id int) (*Filters, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.filterById[id], nil
+}
+
+func (m *MemoryStore) FiltersByTxTo(to string) ([]*Filters, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Filters(nil), m.filterByTxTo[to]...), nil
+}
+
+func (m *MemoryStore) FiltersByDeployer(deployer string) ([]*Filters, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Filters(nil), m.filterByDeployer[deployer]...), nil
+}
+
+func (m *MemoryStore) FiltersByBytecodeHash(hash string) ([]*Filters, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]*Filters(nil), m.filterByBytecodeHash[hash]...), nil
+}
+
+func (m *MemoryStore) Filters() (map[int]*Filters, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	filters := make(map[int]*Filters, len(m.filterById))
+	for id, filter := range m.filterById {
+		filters[id] = filter
+	}
+	return filters, nil
+}
+
+func (m *MemoryStore) NumFilters() (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.filterById), nil
+}
+
+func (m *MemoryStore) NextFilterId() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastFilterId++
+	return m.lastFilterId, nil
+}
+
+// Makes sure ids up to id are not handed out again
+func (m *MemoryStore) reserveFilterIds(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id > m.lastFilterId {
+		m.lastFilterId = id
+	}
+}
@@ -0,0 +1,1136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore keeps the store in a single bbolt file so snooped data
+// survives restarts. Primary records are keyed by id, transactions by
+// hash. The secondary indexes hold copies of the records under
+// "<key>\x00<id>", filters under "<key>\x00<sequence>", so lookups
+// behave like the slices of the MemoryStore. The range indexes map
+// "<field><id>" to the transaction hash.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var (
+	boltMeta                  = []byte("meta")
+	boltBlocks                = []byte("blocks")
+	boltBlocksByNumber        = []byte("blocks_by_number")
+	boltBlocksByHash          = []byte("blocks_by_hash")
+	boltTxs                   = []byte("txs")
+	boltTxsByTo               = []byte("txs_by_to")
+	boltTxsByHash             = []byte("txs_by_hash") // Dropped in version 2
+	boltTxsById               = []byte("txs_by_id")
+	boltTxsByBlockId          = []byte("txs_by_block_id")
+	boltTxsByBlockNumber      = []byte("txs_by_block_number")
+	boltTxsByTime             = []byte("txs_by_time")
+	boltTxsByValue            = []byte("txs_by_value")
+	boltTxsByGasPrice         = []byte("txs_by_gas_price")
+	boltFilters               = []byte("filters")
+	boltFiltersByTxTo         = []byte("filters_by_txto")
+	boltFiltersByDeployer     = []byte("filters_by_deployer")
+	boltFiltersByBytecodeHash = []byte("filters_by_bytecodehash")
+	boltRollups               = []byte("rollups")
+	boltWatchlists            = []byte("watchlists")
+
+	boltSchemaVersionKey = []byte("schema_version")
+	boltLastFilterIdKey  = []byte("last_filter_id")
+)
+
+// Schema migrations, boltMigrations[n] takes the file from version n to n+1.
+// Append only, never edit a migration that has been released.
+var boltMigrations = []func(tx *bolt.Tx) error{
+	// 1: initial layout
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBlocks, boltBlocksByNumber, boltBlocksByHash, boltTxs, boltTxsByTo, boltTxsByHash, boltTxsByBlockId, boltTxsByBlockNumber, boltFilters, boltFiltersByTxTo, boltFiltersByDeployer, boltFiltersByBytecodeHash} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: transactions keyed by hash with global ids, their index entries keyed by id.
+	// Rebuilt from the block id index which held every transaction stored so far.
+	func(tx *bolt.Tx) error {
+		var txs []Tx
+		seen := make(map[string]int)
+		err := tx.Bucket(boltTxsByBlockId).ForEach(func(k, v []byte) error {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			// Ids used to count the transactions of each block from 1
+			if t.Id > 0 {
+				t.TxIndex = uint64(t.Id - 1)
+			}
+			if n, found := seen[t.TxHash]; found {
+				txs[n] = t
+				return nil
+			}
+			seen[t.TxHash] = len(txs)
+			txs = append(txs, t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltTxs, boltTxsByTo, boltTxsByHash, boltTxsByBlockId, boltTxsByBlockNumber} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{boltTxs, boltTxsById, boltTxsByTo, boltTxsByBlockId, boltTxsByBlockNumber} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for n, t := range txs {
+			t.Id = n + 1
+			v, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			puts := []struct {
+				bucket []byte
+				key    []byte
+				value  []byte
+			}{
+				{boltTxs, []byte(t.TxHash), v},
+				{boltTxsById, boltIntKey(t.Id), []byte(t.TxHash)},
+				{boltTxsByTo, boltKey(boltStringPrefix(t.TxTo), t.Id), v},
+				{boltTxsByBlockId, boltKey(boltIntKey(t.TxBlockId), t.Id), v},
+				{boltTxsByBlockNumber, boltKey(boltUint64(t.TxBlockNumber), t.Id), v},
+			}
+			for _, put := range puts {
+				if err := tx.Bucket(put.bucket).Put(put.key, put.value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+	// 3: block index entries keyed by id, of the blocks sharing a hash only the newest stays
+	func(tx *bolt.Tx) error {
+		newest := make(map[string]Block)
+		var stale [][]byte
+		err := tx.Bucket(boltBlocks).ForEach(func(k, v []byte) error {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			if old, found := newest[block.BlockHash]; found {
+				if old.Id > block.Id {
+					stale = append(stale, append([]byte{}, k...))
+					return nil
+				}
+				stale = append(stale, boltIntKey(old.Id))
+			}
+			newest[block.BlockHash] = block
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stale {
+			if err := tx.Bucket(boltBlocks).Delete(k); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{boltBlocksByNumber, boltBlocksByHash} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, block := range newest {
+			v, err := json.Marshal(block)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBlocksByNumber).Put(boltKey(boltUint64(block.BlockNumber), block.Id), v); err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltBlocksByHash).Put(boltKey(boltStringPrefix(block.BlockHash), block.Id), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 4: range indexes on block time, value and gas price, transactions get the time of their block
+	func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltTxsByTime, boltTxsByValue, boltTxsByGasPrice} {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		var txs []Tx
+		err := tx.Bucket(boltTxs).ForEach(func(k, v []byte) error {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			txs = append(txs, t)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, t := range txs {
+			if t.TxBlockTime == 0 {
+				if v := tx.Bucket(boltBlocks).Get(boltIntKey(t.TxBlockId)); v != nil {
+					var block Block
+					if err := json.Unmarshal(v, &block); err != nil {
+						return err
+					}
+					t.TxBlockTime = block.BlockTime
+				}
+			}
+			v, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			puts := []struct {
+				bucket []byte
+				key    []byte
+				value  []byte
+			}{
+				{boltTxs, []byte(t.TxHash), v},
+				{boltTxsByTo, boltKey(boltStringPrefix(t.TxTo), t.Id), v},
+				{boltTxsByBlockId, boltKey(boltIntKey(t.TxBlockId), t.Id), v},
+				{boltTxsByBlockNumber, boltKey(boltUint64(t.TxBlockNumber), t.Id), v},
+				{boltTxsByTime, t.rangeKey(txRangeTime), []byte(t.TxHash)},
+				{boltTxsByValue, t.rangeKey(txRangeValue), []byte(t.TxHash)},
+				{boltTxsByGasPrice, t.rangeKey(txRangeGasPrice), []byte(t.TxHash)},
+			}
+			for _, put := range puts {
+				if err := tx.Bucket(put.bucket).Put(put.key, put.value); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+	// 5: rollups keyed by resolution and start
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(boltRollups)
+		return err
+	},
+	// 6: watchlists keyed by name
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket(boltWatchlists)
+		return err
+	},
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	// Fail rather than wait forever if another process holds the file
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	b := &BoltStore{db: db}
+	if err := b.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltStore) SchemaVersion() (uint64, error) {
+	var version uint64
+	err := b.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMeta)
+		if meta == nil {
+			return nil
+		}
+		if v := meta.Get(boltSchemaVersionKey); v != nil {
+			version = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	})
+	return version, err
+}
+
+// Runs the pending migrations, each in its own transaction together with the version bump
+func (b *BoltStore) migrate() error {
+	version, err := b.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > uint64(len(boltMigrations)) {
+		return fmt.Errorf("store schema version %d is newer than supported version %d", version, len(boltMigrations))
+	}
+	for n := version; n < uint64(len(boltMigrations)); n++ {
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists(boltMeta)
+			if err != nil {
+				return err
+			}
+			if err := boltMigrations[n](tx); err != nil {
+				return err
+			}
+			return meta.Put(boltSchemaVersionKey, boltUint64(n+1))
+		})
+		if err != nil {
+			return fmt.Errorf("store migration to version %d failed: %w", n+1, err)
+		}
+		log.Println("Migrated store to schema version " + fmt.Sprint(n+1))
+	}
+	return nil
+}
+
+func boltUint64(v uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, v)
+	return k
+}
+
+func boltIntKey(v int) []byte {
+	return boltUint64(uint64(v))
+}
+
+func boltStringPrefix(v string) []byte {
+	return append([]byte(v), 0)
+}
+
+// Index key of a record with a unique id, deletable without a scan
+func boltKey(prefix []byte, id int) []byte {
+	return append(append([]byte{}, prefix...), boltIntKey(id)...)
+}
+
+// Adds a copy of the record to an index bucket under prefix
+func boltIndexPut(bucket *bolt.Bucket, prefix []byte, value []byte) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	return bucket.Put(append(append([]byte{}, prefix...), boltUint64(seq)...), value)
+}
+
+// Calls fn with every record stored under prefix, in insertion order
+func boltIndexScan(bucket *bolt.Bucket, prefix []byte, fn func(v []byte) error) error {
+	c := bucket.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+8; k, v = c.Next() {
+		if err := fn(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Calls fn with every record in an index bucket and deletes the ones it returns true for
+func boltIndexDeleteWhere(bucket *bolt.Bucket, fn func(v []byte) (bool, error)) error {
+	var keys [][]byte
+	err := bucket.ForEach(func(k, v []byte) error {
+		del, err := fn(v)
+		if del {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stores a block, replacing a stored block with the same hash or id
+func boltPutBlock(tx *bolt.Tx, block Block) error {
+	var stale [][]byte
+	err := boltIndexScan(tx.Bucket(boltBlocksByHash), boltStringPrefix(block.BlockHash), func(v []byte) error {
+		stale = append(stale, append([]byte{}, v...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if old := tx.Bucket(boltBlocks).Get(boltIntKey(block.Id)); old != nil {
+		stale = append(stale, append([]byte{}, old...))
+	}
+	for _, v := range stale {
+		if err := boltDeleteBlock(tx, v); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltBlocks).Put(boltIntKey(block.Id), v); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltBlocksByNumber).Put(boltKey(boltUint64(block.BlockNumber), block.Id), v); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBlocksByHash).Put(boltKey(boltStringPrefix(block.BlockHash), block.Id), v)
+}
+
+// Removes the stored block v from the primary bucket and its indexes, its transactions stay
+func boltDeleteBlock(tx *bolt.Tx, v []byte) error {
+	var block Block
+	if err := json.Unmarshal(v, &block); err != nil {
+		return err
+	}
+	if bytes.Equal(tx.Bucket(boltBlocks).Get(boltIntKey(block.Id)), v) {
+		if err := tx.Bucket(boltBlocks).Delete(boltIntKey(block.Id)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltBlocksByNumber).Delete(boltKey(boltUint64(block.BlockNumber), block.Id)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltBlocksByHash).Delete(boltKey(boltStringPrefix(block.BlockHash), block.Id))
+}
+
+// Stores a transaction under its hash, replacing the one stored before
+func boltPutTx(tx *bolt.Tx, t Tx) error {
+	if old := tx.Bucket(boltTxs).Get([]byte(t.TxHash)); old != nil {
+		if err := boltDeleteTx(tx, old); err != nil {
+			return err
+		}
+	}
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxs).Put([]byte(t.TxHash), v); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsById).Put(boltIntKey(t.Id), []byte(t.TxHash)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsByTo).Put(boltKey(boltStringPrefix(t.TxTo), t.Id), v); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsByBlockId).Put(boltKey(boltIntKey(t.TxBlockId), t.Id), v); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsByBlockNumber).Put(boltKey(boltUint64(t.TxBlockNumber), t.Id), v); err != nil {
+		return err
+	}
+	for _, index := range txRangeIndexes {
+		if err := tx.Bucket(boltRangeBucket(index)).Put(t.rangeKey(index), []byte(t.TxHash)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes the stored transaction v from the primary bucket and every index
+func boltDeleteTx(tx *bolt.Tx, v []byte) error {
+	var t Tx
+	if err := json.Unmarshal(v, &t); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxs).Delete([]byte(t.TxHash)); err != nil {
+		return err
+	}
+	if string(tx.Bucket(boltTxsById).Get(boltIntKey(t.Id))) == t.TxHash {
+		if err := tx.Bucket(boltTxsById).Delete(boltIntKey(t.Id)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(boltTxsByTo).Delete(boltKey(boltStringPrefix(t.TxTo), t.Id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsByBlockId).Delete(boltKey(boltIntKey(t.TxBlockId), t.Id)); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltTxsByBlockNumber).Delete(boltKey(boltUint64(t.TxBlockNumber), t.Id)); err != nil {
+		return err
+	}
+	for _, index := range txRangeIndexes {
+		bucket := tx.Bucket(boltRangeBucket(index))
+		if string(bucket.Get(t.rangeKey(index))) == t.TxHash {
+			if err := bucket.Delete(t.rangeKey(index)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func boltRangeBucket(index txRangeIndex) []byte {
+	switch index {
+	case txRangeValue:
+		return boltTxsByValue
+	case txRangeGasPrice:
+		return boltTxsByGasPrice
+	}
+	return boltTxsByTime
+}
+
+func (b *BoltStore) StoreBlock(block Block) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPutBlock(tx, block)
+	})
+}
+
+func (b *BoltStore) StoreBlockTxs(block Block, txs []Tx) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := boltPutBlock(tx, block); err != nil {
+			return err
+		}
+		for _, t := range txs {
+			if err := boltPutTx(tx, t); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) DeleteBlocksFrom(number uint64) ([]*Block, error) {
+	var deleted []*Block
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		orphanedBlock := func(v []byte) (bool, error) {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return false, err
+			}
+			return block.BlockNumber >= number, nil
+		}
+		orphanedTx := func(v []byte) (bool, error) {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return false, err
+			}
+			return t.TxBlockNumber >= number, nil
+		}
+		err := boltIndexDeleteWhere(tx.Bucket(boltBlocks), func(v []byte) (bool, error) {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return false, err
+			}
+			if block.BlockNumber < number {
+				return false, nil
+			}
+			deleted = append(deleted, &block)
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltBlocksByNumber, boltBlocksByHash} {
+			if err := boltIndexDeleteWhere(tx.Bucket(name), orphanedBlock); err != nil {
+				return err
+			}
+		}
+		var orphans [][]byte
+		err = tx.Bucket(boltTxs).ForEach(func(k, v []byte) error {
+			del, err := orphanedTx(v)
+			if del {
+				orphans = append(orphans, append([]byte{}, v...))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		for _, v := range orphans {
+			if err := boltDeleteTx(tx, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (b *BoltStore) BlockById(id int) (*Block, error) {
+	var block *Block
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBlocks).Get(boltIntKey(id))
+		if v == nil {
+			return nil
+		}
+		block = &Block{}
+		return json.Unmarshal(v, block)
+	})
+	return block, err
+}
+
+func (b *BoltStore) blocksByIndex(bucket []byte, prefix []byte) ([]*Block, error) {
+	var blocks []*Block
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltIndexScan(tx.Bucket(bucket), prefix, func(v []byte) error {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			blocks = append(blocks, &block)
+			return nil
+		})
+	})
+	return blocks, err
+}
+
+func (b *BoltStore) BlocksByNumber(number uint64) ([]*Block, error) {
+	return b.blocksByIndex(boltBlocksByNumber, boltUint64(number))
+}
+
+func (b *BoltStore) BlocksByHash(hash string) ([]*Block, error) {
+	return b.blocksByIndex(boltBlocksByHash, boltStringPrefix(hash))
+}
+
+func (b *BoltStore) Blocks() (map[int]*Block, error) {
+	blocks := make(map[int]*Block)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlocks).ForEach(func(k, v []byte) error {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			blocks[block.Id] = &block
+			return nil
+		})
+	})
+	return blocks, err
+}
+
+func (b *BoltStore) LastBlockId() (int, error) {
+	var id int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(boltBlocks).Cursor().Last()
+		if k != nil {
+			id = int(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (b *BoltStore) StoreTx(t Tx) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPutTx(tx, t)
+	})
+}
+
+func (b *BoltStore) TxById(id int) (*Tx, error) {
+	var t *Tx
+	err := b.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(boltTxsById).Get(boltIntKey(id))
+		if hash == nil {
+			return nil
+		}
+		v := tx.Bucket(boltTxs).Get(hash)
+		if v == nil {
+			return nil
+		}
+		t = &Tx{}
+		return json.Unmarshal(v, t)
+	})
+	return t, err
+}
+
+func (b *BoltStore) txsByIndex(bucket []byte, prefix []byte) ([]*Tx, error) {
+	var txs []*Tx
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltIndexScan(tx.Bucket(bucket), prefix, func(v []byte) error {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			txs = append(txs, &t)
+			return nil
+		})
+	})
+	return txs, err
+}
+
+func (b *BoltStore) TxsByTo(to string) ([]*Tx, error) {
+	return b.txsByIndex(boltTxsByTo, boltStringPrefix(to))
+}
+
+func (b *BoltStore) TxByHash(hash string) (*Tx, error) {
+	var t *Tx
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltTxs).Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		t = &Tx{}
+		return json.Unmarshal(v, t)
+	})
+	return t, err
+}
+
+func (b *BoltStore) TxsByBlockId(id int) ([]*Tx, error) {
+	return b.txsByIndex(boltTxsByBlockId, boltIntKey(id))
+}
+
+func (b *BoltStore) TxsByBlockNumber(number uint64) ([]*Tx, error) {
+	return b.txsByIndex(boltTxsByBlockNumber, boltUint64(number))
+}
+
+func (b *BoltStore) TxsByRange(q TxQuery) ([]*Tx, error) {
+	index, lower, upper := q.bounds()
+	var txs []*Tx
+	err := b.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltRangeBucket(index)).Cursor()
+		for k, hash := c.Seek(lower); k != nil && !txRangePast(k, upper); k, hash = c.Next() {
+			v := tx.Bucket(boltTxs).Get(hash)
+			if v == nil {
+				continue
+			}
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if !q.matches(&t) {
+				continue
+			}
+			txs = append(txs, &t)
+			if q.Limit > 0 && len(txs) == q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return txs, err
+}
+
+func (b *BoltStore) Txs() (map[int]*Tx, error) {
+	txs := make(map[int]*Tx)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTxs).ForEach(func(k, v []byte) error {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			txs[t.Id] = &t
+			return nil
+		})
+	})
+	return txs, err
+}
+
+func (b *BoltStore) LastTxId() (int, error) {
+	var id int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(boltTxsById).Cursor().Last()
+		if k != nil {
+			id = int(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return id, err
+}
+
+func (b *BoltStore) StoreFilter(filter Filters) error {
+	v, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		// Storing an id again replaces the filter
+		if old := tx.Bucket(boltFilters).Get(boltIntKey(filter.Id)); old != nil {
+			if err := boltRemoveFilter(tx, old); err != nil {
+				return err
+			}
+		}
+		if err := boltReserveFilterIds(tx, filter.Id); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltFilters).Put(boltIntKey(filter.Id), v); err != nil {
+			return err
+		}
+		if filter.TxTo != "" {
+			if err := boltIndexPut(tx.Bucket(boltFiltersByTxTo), boltStringPrefix(filter.TxTo), v); err != nil {
+				return err
+			}
+		}
+		if filter.Deployer != "" {
+			if err := boltIndexPut(tx.Bucket(boltFiltersByDeployer), boltStringPrefix(filter.Deployer), v); err != nil {
+				return err
+			}
+		}
+		if filter.BytecodeHash != "" {
+			if err := boltIndexPut(tx.Bucket(boltFiltersByBytecodeHash), boltStringPrefix(filter.BytecodeHash), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) DeleteFilter(id int) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltFilters).Get(boltIntKey(id))
+		if v == nil {
+			return nil
+		}
+		return boltRemoveFilter(tx, v)
+	})
+}
+
+// Drops a stored filter and its own index entries, other filters on the same
+// address stay
+func boltRemoveFilter(tx *bolt.Tx, v []byte) error {
+	var filter Filters
+	if err := json.Unmarshal(v, &filter); err != nil {
+		return err
+	}
+	if err := tx.Bucket(boltFilters).Delete(boltIntKey(filter.Id)); err != nil {
+		return err
+	}
+	for _, index := range []struct {
+		bucket []byte
+		key    string
+	}{{boltFiltersByTxTo, filter.TxTo}, {boltFiltersByDeployer, filter.Deployer}, {boltFiltersByBytecodeHash, filter.BytecodeHash}} {
+		if index.key == "" {
+			continue
+		}
+		var stale [][]byte
+		prefix := boltStringPrefix(index.key)
+		c := tx.Bucket(index.bucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+8; k, v = c.Next() {
+			var entry Filters
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			if entry.Id == filter.Id {
+				stale = append(stale, append([]byte{}, k...))
+			}
+		}
+		for _, k := range stale {
+			if err := tx.Bucket(index.bucket).Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Makes sure ids up to id are not handed out again
+func boltReserveFilterIds(tx *bolt.Tx, id int) error {
+	meta := tx.Bucket(boltMeta)
+	if v := meta.Get(boltLastFilterIdKey); v != nil && int(binary.BigEndian.Uint64(v)) >= id {
+		return nil
+	}
+	return meta.Put(boltLastFilterIdKey, boltUint64(uint64(id)))
+}
+
+// The next id after the last one handed out or stored, files written before
+// ids were tracked start after the highest stored id
+func (b *BoltStore) NextFilterId() (int, error) {
+	var id int
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMeta).Get(boltLastFilterIdKey); v != nil {
+			id = int(binary.BigEndian.Uint64(v))
+		}
+		if k, _ := tx.Bucket(boltFilters).Cursor().Last(); k != nil && int(binary.BigEndian.Uint64(k)) > id {
+			id = int(binary.BigEndian.Uint64(k))
+		}
+		id++
+		return boltReserveFilterIds(tx, id)
+	})
+	return id, err
+}
+
+func (b *BoltStore) FilterById(id int) (*Filters, error) {
+	var filter *Filters
+	err := b.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltFilters).Get(boltIntKey(id))
+		if v == nil {
+			return nil
+		}
+		filter = &Filters{}
+		return json.Unmarshal(v, filter)
+	})
+	return filter, err
+}
+
+func (b *BoltStore) filtersByIndex(bucket []byte, prefix []byte) ([]*Filters, error) {
+	var filters []*Filters
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltIndexScan(tx.Bucket(bucket), prefix, func(v []byte) error {
+			var filter Filters
+			if err := json.Unmarshal(v, &filter); err != nil {
+				return err
+			}
+			filters = append(filters, &filter)
+			return nil
+		})
+	})
+	return filters, err
+}
+
+func (b *BoltStore) FiltersByTxTo(to string) ([]*Filters, error) {
+	return b.filtersByIndex(boltFiltersByTxTo, boltStringPrefix(to))
+}
+
+func (b *BoltStore) FiltersByDeployer(deployer string) ([]*Filters, error) {
+	return b.filtersByIndex(boltFiltersByDeployer, boltStringPrefix(deployer))
+}
+
+func (b *BoltStore) FiltersByBytecodeHash(hash string) ([]*Filters, error) {
+	return b.filtersByIndex(boltFiltersByBytecodeHash, boltStringPrefix(hash))
+}
+
+func (b *BoltStore) Filters() (map[int]*Filters, error) {
+	filters := make(map[int]*Filters)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFilters).ForEach(func(k, v []byte) error {
+			var filter Filters
+			if err := json.Unmarshal(v, &filter); err != nil {
+				return err
+			}
+			filters[filter.Id] = &filter
+			return nil
+		})
+	})
+	return filters, err
+}
+
+func (b *BoltStore) NumFilters() (int, error) {
+	var n int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltFilters).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Rollup key, the resolution followed by the start
+func boltRollupKey(resolution string, start int64) []byte {
+	return append(boltStringPrefix(resolution), boltUint64(uint64(start))...)
+}
+
+func (b *BoltStore) StoreRollups(rollups []Rollup) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, r := range rollups {
+			v, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(boltRollups).Put(boltRollupKey(r.Resolution, r.Start), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) Rollups(resolution string, from int64, to int64) ([]*Rollup, error) {
+	var rollups []*Rollup
+	if from < 0 {
+		from = 0
+	}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		prefix, last := boltStringPrefix(resolution), boltRollupKey(resolution, to)
+		c := tx.Bucket(boltRollups).Cursor()
+		for k, v := c.Seek(boltRollupKey(resolution, from)); k != nil && bytes.HasPrefix(k, prefix) && bytes.Compare(k, last) <= 0; k, v = c.Next() {
+			var r Rollup
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rollups = append(rollups, &r)
+		}
+		return nil
+	})
+	return rollups, err
+}
+
+func (b *BoltStore) DeleteRollups(resolution string, before int64) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		prefix, end := boltStringPrefix(resolution), boltRollupKey(resolution, before)
+		var keys [][]byte
+		c := tx.Bucket(boltRollups).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range keys {
+			if err := tx.Bucket(boltRollups).Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStore) StoreWatchlist(watchlist Watchlist) error {
+	v, err := json.Marshal(watchlist)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWatchlists).Put([]byte(watchlist.Name), v)
+	})
+}
+
+func (b *BoltStore) DeleteWatchlist(name string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWatchlists).Delete([]byte(name))
+	})
+}
+
+func (b *BoltStore) Watchlists() (map[string]*Watchlist, error) {
+	watchlists := make(map[string]*Watchlist)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltWatchlists).ForEach(func(k, v []byte) error {
+			var watchlist Watchlist
+			if err := json.Unmarshal(v, &watchlist); err != nil {
+				return err
+			}
+			watchlists[watchlist.Name] = &watchlist
+			return nil
+		})
+	})
+	return watchlists, err
+}
+
+// Deletes the entries of an index bucket that live rejects if repair is set, returns how many there were
+func boltIndexCheck(bucket *bolt.Bucket, live func(k, v []byte) bool, repair bool) (int, error) {
+	var dangling [][]byte
+	bucket.ForEach(func(k, v []byte) error {
+		if !live(k, v) {
+			dangling = append(dangling, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if repair {
+		for _, k := range dangling {
+			if err := bucket.Delete(k); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return len(dangling), nil
+}
+
+// A range index entry is live if the transaction it names is still filed under its key
+func boltRangeLive(txs *bolt.Bucket, index txRangeIndex) func(k, v []byte) bool {
+	return func(k, v []byte) bool {
+		var t Tx
+		stored := txs.Get(v)
+		return stored != nil && json.Unmarshal(stored, &t) == nil && bytes.Equal(t.rangeKey(index), k)
+	}
+}
+
+func (b *BoltStore) Check(repair bool) (CheckReport, error) {
+	var r CheckReport
+	check := func(tx *bolt.Tx) error {
+		blocks := tx.Bucket(boltBlocks)
+		txs := tx.Bucket(boltTxs)
+		// Index entries are copies of the primary record
+		liveBlock := func(k, v []byte) bool {
+			return bytes.Equal(blocks.Get(k[len(k)-8:]), v)
+		}
+		liveTx := func(k, v []byte) bool {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return false
+			}
+			return bytes.Equal(txs.Get([]byte(t.TxHash)), v)
+		}
+		checks := []struct {
+			bucket []byte
+			live   func(k, v []byte) bool
+		}{
+			{boltBlocksByNumber, liveBlock},
+			{boltBlocksByHash, liveBlock},
+			{boltTxsByTo, liveTx},
+			{boltTxsByBlockId, liveTx},
+			{boltTxsByBlockNumber, liveTx},
+			{boltTxsByTime, boltRangeLive(txs, txRangeTime)},
+			{boltTxsByValue, boltRangeLive(txs, txRangeValue)},
+			{boltTxsByGasPrice, boltRangeLive(txs, txRangeGasPrice)},
+			{boltTxsById, func(k, v []byte) bool {
+				var t Tx
+				stored := txs.Get(v)
+				return stored != nil && json.Unmarshal(stored, &t) == nil && t.Id == int(binary.BigEndian.Uint64(k))
+			}},
+		}
+		for _, c := range checks {
+			dangling, err := boltIndexCheck(tx.Bucket(c.bucket), c.live, repair)
+			if err != nil {
+				return err
+			}
+			r.DanglingEntries += dangling
+		}
+		// Of the blocks sharing a hash the one with the highest id stays
+		newest := make(map[string]int)
+		var all []Block
+		err := blocks.ForEach(func(k, v []byte) error {
+			var block Block
+			if err := json.Unmarshal(v, &block); err != nil {
+				return err
+			}
+			all = append(all, block)
+			if block.Id > newest[block.BlockHash] {
+				newest[block.BlockHash] = block.Id
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, block := range all {
+			if block.Id == newest[block.BlockHash] {
+				continue
+			}
+			r.DuplicateBlocks++
+			if repair {
+				if err := boltDeleteBlock(tx, blocks.Get(boltIntKey(block.Id))); err != nil {
+					return err
+				}
+			}
+		}
+		var orphans [][]byte
+		err = txs.ForEach(func(k, v []byte) error {
+			var t Tx
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			if blocks.Get(boltIntKey(t.TxBlockId)) == nil {
+				// Values are only valid until the next write
+				orphans = append(orphans, append([]byte(nil), v...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		r.OrphanTxs = len(orphans)
+		if repair {
+			for _, v := range orphans {
+				if err := boltDeleteTx(tx, v); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	var err error
+	if repair {
+		err = b.db.Update(check)
+	} else {
+		err = b.db.View(check)
+	}
+	r.Repaired = repair && err == nil && (!r.Clean() || r.OrphanTxs > 0)
+	return r, err
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStorePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snoopy.db")
+	b, err := NewBoltStore(path)
+	assert.Nil(t, err)
+	assert.Nil(t, b.StoreBlock(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752, BlockTime: 1651499015, BlockNonce: 4627854504322470268, BlockNumTransactions: 8}))
+	assert.Nil(t, b.StoreBlock(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232754, BlockTime: 1651499051, BlockNonce: 8148927535907424638, BlockNumTransactions: 7}))
+	assert.Nil(t, b.StoreTx(Tx{Id: 1, TxBlockId: 2, TxBlockNumber: 12232754, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxReceiptStatus: 1}))
+	assert.Nil(t, b.StoreFilter(Filters{Id: 0, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}))
+	assert.Nil(t, b.StoreFilter(Filters{Id: 1, Deployer: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"}))
+	assert.Nil(t, b.Close())
+
+	// Reopen
+	b, err = NewBoltStore(path)
+	assert.Nil(t, err)
+	defer b.Close()
+	version, err := b.SchemaVersion()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(len(boltMigrations)), version)
+	lastBlockId, _ := b.LastBlockId()
+	assert.Equal(t, 2, lastBlockId)
+	block, _ := b.BlockById(1)
+	assert.Equal(t, uint64(12232752), block.BlockNumber)
+	missing, _ := b.BlockById(3)
+	assert.Nil(t, missing)
+	blocks, _ := b.BlocksByHash("0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1")
+	assert.Equal(t, 1, len(blocks))
+	blocks, _ = b.BlocksByNumber(12232752)
+	assert.Equal(t, 1, len(blocks))
+	txs, _ := b.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(txs))
+	txs, _ = b.TxsByBlockNumber(12232754)
+	assert.Equal(t, "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", txs[0].TxHash)
+	txs, _ = b.TxsByTo("0x0")
+	assert.Equal(t, 0, len(txs))
+	n, _ := b.NumFilters()
+	assert.Equal(t, 2, n)
+	assert.Nil(t, b.DeleteFilter(1))
+	filters, _ := b.FiltersByDeployer("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	assert.Equal(t, 0, len(filters))
+	filters, _ = b.FiltersByTxTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(filters))
+}
+
+func TestBoltStoreNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snoopy.db")
+	b, err := NewBoltStore(path)
+	assert.Nil(t, err)
+	b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMeta).Put(boltSchemaVersionKey, boltUint64(uint64(len(boltMigrations)+1)))
+	})
+	b.Close()
+	_, err = NewBoltStore(path)
+	assert.NotNil(t, err)
+}
+
+func TestBoltStoreReorg(t *testing.T) {
+	b, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Nil(t, b.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}, []Tx{{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}}))
+	assert.Nil(t, b.StoreBlockTxs(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232753}, []Tx{{Id: 2, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}}))
+	deleted, err := b.DeleteBlocksFrom(12232753)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deleted))
+	blocks, _ := b.BlocksByNumber(12232753)
+	assert.Equal(t, 0, len(blocks))
+	lastBlockId, _ := b.LastBlockId()
+	assert.Equal(t, 1, lastBlockId)
+	txs, _ := b.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(txs))
+	txs, _ = b.TxsByBlockId(2)
+	assert.Equal(t, 0, len(txs))
+}
+
+func TestBoltStoreTxByHash(t *testing.T) {
+	b, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer b.Close()
+	assert.Nil(t, b.StoreTx(Tx{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}))
+	assert.Nil(t, b.StoreTx(Tx{Id: 2, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}))
+	tx, _ := b.TxByHash("0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533")
+	assert.Equal(t, 2, tx.Id)
+	tx, _ = b.TxById(1)
+	assert.Nil(t, tx)
+	txs, _ := b.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(txs))
+	txs, _ = b.TxsByBlockNumber(12232752)
+	assert.Equal(t, 0, len(txs))
+	lastTxId, _ := b.LastTxId()
+	assert.Equal(t, 2, lastTxId)
+}
+
+// Files written before transactions had global ids are renumbered
+func TestBoltStoreMigrateTxIds(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "snoopy.db"), 0600, nil)
+	assert.Nil(t, err)
+	b := &BoltStore{db: db}
+	defer b.Close()
+	assert.Nil(t, db.Update(func(tx *bolt.Tx) error {
+		meta, _ := tx.CreateBucketIfNotExists(boltMeta)
+		if err := boltMigrations[0](tx); err != nil {
+			return err
+		}
+		for n, old := range []Tx{
+			{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+			{Id: 2, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+			{Id: 1, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", TxTo: "0xA090e606E30bD747d4E6245a1517EbE430F0057e"},
+		} {
+			v, _ := json.Marshal(old)
+			tx.Bucket(boltTxs).Put(boltIntKey(old.Id), v)
+			tx.Bucket(boltTxsByBlockId).Put(boltKey(boltIntKey(old.TxBlockId), n), v)
+		}
+		return meta.Put(boltSchemaVersionKey, boltUint64(1))
+	}))
+	assert.Nil(t, b.migrate())
+	txs, _ := b.Txs()
+	assert.Equal(t, 3, len(txs))
+	tx, _ := b.TxByHash("0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2")
+	assert.Equal(t, 2, tx.Id)
+	assert.Equal(t, uint64(1), tx.TxIndex)
+	tx, _ = b.TxById(3)
+	assert.Equal(t, "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", tx.TxHash)
+	assert.Equal(t, uint64(0), tx.TxIndex)
+	txs2, _ := b.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 2, len(txs2))
+}
+
+func TestBoltStoreIdempotentBlocksAndCheck(t *testing.T) {
+	b, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer b.Close()
+	block := Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}
+	tx := Tx{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}
+	assert.Nil(t, b.StoreBlockTxs(block, []Tx{tx}))
+	assert.Nil(t, b.StoreBlockTxs(block, []Tx{tx}))
+	// Same hash under a new id replaces the block
+	block.Id = 2
+	assert.Nil(t, b.StoreBlock(block))
+	blocks, _ := b.BlocksByNumber(12232752)
+	assert.Equal(t, 1, len(blocks))
+	assert.Equal(t, 2, blocks[0].Id)
+	old, _ := b.BlockById(1)
+	assert.Nil(t, old)
+
+	report, err := b.Check(false)
+	assert.Nil(t, err)
+	assert.True(t, report.Clean())
+	assert.Equal(t, 1, report.OrphanTxs)
+	b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltTxsByTo).Put(boltKey(boltStringPrefix("0x0"), 7), []byte(`{"Id":7,"TxHash":"0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2"}`))
+	})
+	report, _ = b.Check(true)
+	assert.Equal(t, 1, report.DanglingEntries)
+	assert.True(t, report.Repaired)
+	assert.Equal(t, 1, report.OrphanTxs)
+	txs, _ := b.TxsByTo("0x0")
+	assert.Equal(t, 0, len(txs))
+	orphan, _ := b.TxByHash(tx.TxHash)
+	assert.Nil(t, orphan)
+	report, _ = b.Check(false)
+	assert.True(t, report.Clean())
+	assert.Equal(t, 0, report.OrphanTxs)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+)
+
+// What a consistency check of the store found
+type CheckReport struct {
+	// Blocks sharing a hash with a newer block
+	DuplicateBlocks int `json:"DuplicateBlocks"`
+	// Index entries listing the same record twice
+	DuplicateEntries int `json:"DuplicateEntries"`
+	// Index entries whose record is gone or was replaced
+	DanglingEntries int `json:"DanglingEntries"`
+	// Transactions whose block is not stored, removed on repair
+	OrphanTxs int  `json:"OrphanTxs"`
+	Repaired  bool `json:"Repaired,omitempty"`
+}
+
+func (r CheckReport) Clean() bool {
+	return r.DuplicateBlocks == 0 && r.DuplicateEntries == 0 && r.DanglingEntries == 0
+}
+
+func (m *MemoryStore) Check(repair bool) (CheckReport, error) {
+	if repair {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	} else {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+	}
+	var r CheckReport
+	liveBlock := func(block *Block) bool { return m.blockById[block.Id] == block }
+	liveTx := func(tx *Tx) bool { return m.txByHash[tx.TxHash] == tx }
+	for _, check := range []func() (int, int){
+		func() (int, int) { return memoryIndexCheck(m.blockByNumber, liveBlock, repair) },
+		func() (int, int) { return memoryIndexCheck(m.blockByHash, liveBlock, repair) },
+		func() (int, int) { return memoryIndexCheck(m.txByTo, liveTx, repair) },
+		func() (int, int) { return memoryIndexCheck(m.txByBlockId, liveTx, repair) },
+		func() (int, int) { return memoryIndexCheck(m.txByBlockNumber, liveTx, repair) },
+	} {
+		duplicates, dangling := check()
+		r.DuplicateEntries += duplicates
+		r.DanglingEntries += dangling
+	}
+	for _, index := range txRangeIndexes {
+		dangling := m.orderedIndexCheck(index, liveTx, repair)
+		r.DanglingEntries += dangling
+	}
+	for id, tx := range m.txById {
+		if !liveTx(tx) {
+			r.DanglingEntries++
+			if repair {
+				delete(m.txById, id)
+			}
+		}
+	}
+	// Of the blocks sharing a hash the one with the highest id stays
+	for _, blocks := range m.blockByHash {
+		live := make(map[*Block]bool)
+		var newest *Block
+		for _, block := range blocks {
+			if liveBlock(block) {
+				live[block] = true
+				if newest == nil || block.Id > newest.Id {
+					newest = block
+				}
+			}
+		}
+		var stale []*Block
+		for block := range live {
+			if block != newest {
+				stale = append(stale, block)
+			}
+		}
+		r.DuplicateBlocks += len(stale)
+		if repair {
+			for _, block := range stale {
+				m.removeBlockRecord(block)
+			}
+		}
+	}
+	var orphans []*Tx
+	for _, tx := range m.txByHash {
+		if _, found := m.blockById[tx.TxBlockId]; !found {
+			orphans = append(orphans, tx)
+		}
+	}
+	r.OrphanTxs = len(orphans)
+	if repair {
+		for _, tx := range orphans {
+			m.removeTx(tx)
+		}
+	}
+	r.Repaired = repair && (!r.Clean() || r.OrphanTxs > 0)
+	return r, nil
+}
+
+// Counts entries listed twice and entries no longer live, dropping both if repair is set
+func memoryIndexCheck[K comparable, V any](index map[K][]*V, live func(*V) bool, repair bool) (int, int) {
+	var duplicates, dangling int
+	for k, entries := range index {
+		seen := make(map[*V]bool, len(entries))
+		var kept []*V
+		for _, e := range entries {
+			if seen[e] {
+				duplicates++
+				continue
+			}
+			if !live(e) {
+				dangling++
+				continue
+			}
+			seen[e] = true
+			kept = append(kept, e)
+		}
+		if repair && len(kept) != len(entries) {
+			if len(kept) == 0 {
+				delete(index, k)
+			} else {
+				index[k] = kept
+			}
+		}
+	}
+	return duplicates, dangling
+}
+
+// Counts entries of an ordered index no longer live or filed under a stale key
+func (m *MemoryStore) orderedIndexCheck(index txRangeIndex, live func(*Tx) bool, repair bool) int {
+	type entry struct {
+		key string
+		tx  *Tx
+	}
+	var dangling []entry
+	o := m.orderedIndex(index)
+	o.ascend("", func(key string, tx *Tx) bool {
+		if !live(tx) || string(tx.rangeKey(index)) != key {
+			dangling = append(dangling, entry{key, tx})
+		}
+		return true
+	})
+	if repair {
+		for _, e := range dangling {
+			o.remove(e.key, e.tx)
+		}
+	}
+	return len(dangling)
+}
+
+// snoopy check [-repair] checks the store selected by SNOOPY_STORE
+func runCheck(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Remove the duplicate and dangling entries found")
+	flags.Parse(args)
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	if c, ok := s.(io.Closer); ok {
+		defer c.Close()
+	}
+	report, err := s.Check(*repair)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore keeps the store in PostgreSQL so several API replicas
+// can serve the data written by a single ingesting instance. The
+// looked up fields get their own indexed columns, the full record is
+// kept as JSON next to them.
+type PostgresStore struct {
+	db *sql.DB
+}
+
+// Key of the advisory lock serializing migrations of replicas starting together
+const postgresMigrationLock = 0x736e6f6f7079
+
+// Schema migrations, postgresMigrations[n] takes the database from version n to n+1.
+// Append only, never edit a migration that has been released.
+var postgresMigrations = []string{
+	// 1: initial layout, transactions and filters get a surrogate key as their ids may repeat
+	`CREATE TABLE blocks (
+		id     INTEGER PRIMARY KEY,
+		hash   TEXT NOT NULL,
+		number BIGINT NOT NULL,
+		data   JSONB NOT NULL
+	);
+	CREATE INDEX blocks_hash_idx ON blocks (hash);
+	CREATE INDEX blocks_number_idx ON blocks (number);
+	CREATE TABLE txs (
+		seq          BIGSERIAL PRIMARY KEY,
+		id           INTEGER NOT NULL,
+		block_id     INTEGER NOT NULL,
+		block_number BIGINT NOT NULL,
+		hash         TEXT NOT NULL,
+		tx_to        TEXT NOT NULL,
+		data         JSONB NOT NULL
+	);
+	CREATE INDEX txs_id_idx ON txs (id);
+	CREATE INDEX txs_block_id_idx ON txs (block_id);
+	CREATE INDEX txs_block_number_idx ON txs (block_number);
+	CREATE INDEX txs_hash_idx ON txs (hash);
+	CREATE INDEX txs_tx_to_idx ON txs (tx_to);
+	CREATE TABLE filters (
+		seq           BIGSERIAL PRIMARY KEY,
+		id            INTEGER NOT NULL,
+		tx_to         TEXT NOT NULL,
+		deployer      TEXT NOT NULL,
+		bytecode_hash TEXT NOT NULL,
+		data          JSONB NOT NULL
+	);
+	CREATE INDEX filters_id_idx ON filters (id);
+	CREATE INDEX filters_tx_to_idx ON filters (tx_to) WHERE tx_to <> '';
+	CREATE INDEX filters_deployer_idx ON filters (deployer) WHERE deployer <> '';
+	CREATE INDEX filters_bytecode_hash_idx ON filters (bytecode_hash) WHERE bytecode_hash <> '';`,
+	// 2: transactions keyed by hash with global ids, ids used to count the transactions of each block from 1
+	`DELETE FROM txs a USING txs b WHERE a.hash = b.hash AND a.seq < b.seq;
+	ALTER TABLE txs ADD COLUMN tx_index INTEGER NOT NULL DEFAULT 0;
+	UPDATE txs SET tx_index = GREATEST(txs.id - 1, 0), id = r.n,
+		data = txs.data || jsonb_build_object('Id', r.n, 'TxIndex', GREATEST(txs.id - 1, 0))
+		FROM (SELECT seq, row_number() OVER (ORDER BY seq) AS n FROM txs) r WHERE txs.seq = r.seq;
+	ALTER TABLE txs DROP CONSTRAINT txs_pkey;
+	ALTER TABLE txs ADD PRIMARY KEY (hash);
+	DROP INDEX txs_hash_idx;
+	DROP INDEX txs_id_idx;
+	CREATE UNIQUE INDEX txs_id_key ON txs (id);`,
+	// 3: blocks keyed by hash, of the blocks sharing a hash only the newest stays
+	`DELETE FROM blocks a USING blocks b WHERE a.hash = b.hash AND a.id < b.id;
+	DROP INDEX blocks_hash_idx;
+	CREATE UNIQUE INDEX blocks_hash_key ON blocks (hash);`,
+	// 4: range indexes on block time, value and gas price, transactions get the time of their block
+	`ALTER TABLE txs ADD COLUMN block_time BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN value NUMERIC(78, 0) NOT NULL DEFAULT 0,
+		ADD COLUMN gas_price NUMERIC(20, 0) NOT NULL DEFAULT 0;
+	UPDATE txs SET block_time = COALESCE(NULLIF((txs.data->>'TxBlockTime')::bigint, 0), (blocks.data->>'BlockTime')::bigint, 0)
+		FROM blocks WHERE blocks.id = txs.block_id;
+	UPDATE txs SET value = COALESCE((data->>'TxValueWei')::numeric, (data->>'TxValue')::numeric, 0),
+		gas_price = COALESCE((data->>'TxGasPrice')::numeric, 0),
+		data = CASE WHEN block_time > 0 THEN data || jsonb_build_object('TxBlockTime', block_time) ELSE data END;
+	CREATE INDEX txs_block_time_idx ON txs (block_time, id);
+	CREATE INDEX txs_value_idx ON txs (value, id);
+	CREATE INDEX txs_gas_price_idx ON txs (gas_price, id);`,
+	// 5: rollups keyed by resolution and start
+	`CREATE TABLE rollups (
+		resolution TEXT NOT NULL,
+		start      BIGINT NOT NULL,
+		data       JSONB NOT NULL,
+		PRIMARY KEY (resolution, start)
+	);`,
+	// 6: filters keyed by id, of the rows sharing an id only the newest stays, ids come from a sequence
+	`DELETE FROM filters a USING filters b WHERE a.id = b.id AND a.seq < b.seq;
+	DROP INDEX filters_id_idx;
+	CREATE UNIQUE INDEX filters_id_key ON filters (id);
+	CREATE SEQUENCE filter_ids;
+	SELECT setval('filter_ids', COALESCE((SELECT MAX(id) FROM filters), 0) + 1, false);`,
+	// 7: watchlists keyed by name
+	`CREATE TABLE watchlists (
+		name TEXT PRIMARY KEY,
+		data JSONB NOT NULL
+	);`,
+}
+
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	p := &PostgresStore{db: db}
+	if err := p.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PostgresStore) Close() error {
+	return p.db.Close()
+}
+
+func (p *PostgresStore) SchemaVersion() (int, error) {
+	var version int
+	err := p.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Runs the pending migrations in one transaction, holding an advisory lock
+// so replicas starting at the same time do not race each other
+func (p *PostgresStore) migrate() error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	if version > len(postgresMigrations) {
+		return fmt.Errorf("store schema version %d is newer than supported version %d", version, len(postgresMigrations))
+	}
+	for n := version; n < len(postgresMigrations); n++ {
+		if _, err := tx.Exec(postgresMigrations[n]); err != nil {
+			return fmt.Errorf("store migration to version %d failed: %w", n+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, n+1); err != nil {
+			return err
+		}
+		log.Println("Migrated store to schema version " + fmt.Sprint(n+1))
+	}
+	return tx.Commit()
+}
+
+// Anything that can run a statement, the database itself or a transaction
+type postgresExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Upserts a block by id, replacing a stored block with the same hash
+func postgresPutBlock(e postgresExecer, block Block) error {
+	v, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if _, err := e.Exec(`DELETE FROM blocks WHERE hash = $1 AND id <> $2`, block.BlockHash, block.Id); err != nil {
+		return err
+	}
+	_, err = e.Exec(`INSERT INTO blocks (id, hash, number, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET hash = EXCLUDED.hash, number = EXCLUDED.number, data = EXCLUDED.data`,
+		block.Id, block.BlockHash, int64(block.BlockNumber), string(v))
+	return err
+}
+
+func (p *PostgresStore) StoreBlock(block Block) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := postgresPutBlock(tx, block); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Upserts transactions by hash, all of them in a single statement
+func postgresPutTxs(e postgresExecer, txs []Tx) error {
+	var ids, blockIds, blockNumbers, txIndexes, blockTimes []int64
+	var hashes, tos, values, gasPrices, data []string
+	for _, t := range txs {
+		v, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, int64(t.Id))
+		blockIds = append(blockIds, int64(t.TxBlockId))
+		blockNumbers = append(blockNumbers, int64(t.TxBlockNumber))
+		txIndexes = append(txIndexes, int64(t.TxIndex))
+		hashes = append(hashes, t.TxHash)
+		tos = append(tos, t.TxTo)
+		blockTimes = append(blockTimes, int64(t.TxBlockTime))
+		values = append(values, t.ValueWei().String())
+		gasPrices = append(gasPrices, fmt.Sprint(t.TxGasPrice))
+		data = append(data, string(v))
+	}
+	_, err := e.Exec(`INSERT INTO txs (id, block_id, block_number, tx_index, hash, tx_to, block_time, value, gas_price, data)
+		SELECT * FROM unnest($1::integer[], $2::integer[], $3::bigint[], $4::integer[], $5::text[], $6::text[], $7::bigint[], $8::numeric[], $9::numeric[], $10::jsonb[])
+		ON CONFLICT (hash) DO UPDATE SET id = EXCLUDED.id, block_id = EXCLUDED.block_id, block_number = EXCLUDED.block_number,
+			tx_index = EXCLUDED.tx_index, tx_to = EXCLUDED.tx_to, block_time = EXCLUDED.block_time, value = EXCLUDED.value,
+			gas_price = EXCLUDED.gas_price, data = EXCLUDED.data`,
+		pq.Array(ids), pq.Array(blockIds), pq.Array(blockNumbers), pq.Array(txIndexes), pq.Array(hashes), pq.Array(tos),
+		pq.Array(blockTimes), pq.Array(values), pq.Array(gasPrices), pq.Array(data))
+	return err
+}
+
+// Writes the block and its transactions within a single transaction
+func (p *PostgresStore) StoreBlockTxs(block Block, txs []Tx) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := postgresPutBlock(tx, block); err != nil {
+		return err
+	}
+	if len(txs) > 0 {
+		if err := postgresPutTxs(tx, txs); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresStore) DeleteBlocksFrom(number uint64) ([]*Block, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM txs WHERE block_number >= $1`, int64(number)); err != nil {
+		return nil, err
+	}
+	deleted, err := postgresScan[Block](tx.Query(`DELETE FROM blocks WHERE number >= $1 RETURNING data`, int64(number)))
+	if err != nil {
+		return nil, err
+	}
+	return deleted, tx.Commit()
+}
+
+// Unmarshals the data column of every row into a new T
+func postgresScan[T any](rows *sql.Rows, err error) ([]*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var records []*T
+	for rows.Next() {
+		var v []byte
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		var record T
+		if err := json.Unmarshal(v, &record); err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+	return records, rows.Err()
+}
+
+// Like postgresScan for lookups that return at most one record
+func postgresScanOne[T any](rows *sql.Rows, err error) (*T, error) {
+	records, err := postgresScan[T](rows, err)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+func (p *PostgresStore) BlockById(id int) (*Block, error) {
+	return postgresScanOne[Block](p.db.Query(`SELECT data FROM blocks WHERE id = $1`, id))
+}
+
+func (p *PostgresStore) BlocksByNumber(number uint64) ([]*Block, error) {
+	return postgresScan[Block](p.db.Query(`SELECT data FROM blocks WHERE number = $1 ORDER BY id`, int64(number)))
+}
+
+func (p *PostgresStore) BlocksByHash(hash string) ([]*Block, error) {
+	return postgresScan[Block](p.db.Query(`SELECT data FROM blocks WHERE hash = $1 ORDER BY id`, hash))
+}
+
+func (p *PostgresStore) Blocks() (map[int]*Block, error) {
+	records, err := postgresScan[Block](p.db.Query(`SELECT data FROM blocks`))
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[int]*Block, len(records))
+	for _, block := range records {
+		blocks[block.Id] = block
+	}
+	return blocks, nil
+}
+
+func (p *PostgresStore) LastBlockId() (int, error) {
+	var id int
+	err := p.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM blocks`).Scan(&id)
+	return id, err
+}
+
+func (p *PostgresStore) StoreTx(t Tx) error {
+	return postgresPutTxs(p.db, []Tx{t})
+}
+
+func (p *PostgresStore) TxById(id int) (*Tx, error) {
+	return postgresScanOne[Tx](p.db.Query(`SELECT data FROM txs WHERE id = $1`, id))
+}
+
+func (p *PostgresStore) TxByHash(hash string) (*Tx, error) {
+	return postgresScanOne[Tx](p.db.Query(`SELECT data FROM txs WHERE hash = $1`, hash))
+}
+
+func (p *PostgresStore) TxsByTo(to string) ([]*Tx, error) {
+	return postgresScan[Tx](p.db.Query(`SELECT data FROM txs WHERE tx_to = $1 ORDER BY id`, to))
+}
+
+func (p *PostgresStore) TxsByBlockId(id int) ([]*Tx, error) {
+	return postgresScan[Tx](p.db.Query(`SELECT data FROM txs WHERE block_id = $1 ORDER BY tx_index`, id))
+}
+
+func (p *PostgresStore) TxsByBlockNumber(number uint64) ([]*Tx, error) {
+	return postgresScan[Tx](p.db.Query(`SELECT data FROM txs WHERE block_number = $1 ORDER BY block_id, tx_index`, int64(number)))
+}
+
+// Ordered by the column of the index the other stores would run the query on
+func (p *PostgresStore) TxsByRange(q TxQuery) ([]*Tx, error) {
+	var where []string
+	var args []interface{}
+	bound := func(cond string, v interface{}) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if q.FromTime > 0 {
+		bound("block_time >= $%d", int64(q.FromTime))
+	}
+	if q.ToTime > 0 {
+		bound("block_time <= $%d", int64(q.ToTime))
+	}
+	if q.MinValue != nil {
+		bound("value >= $%d::numeric", q.MinValue.String())
+	}
+	if q.MaxValue != nil {
+		bound("value <= $%d::numeric", q.MaxValue.String())
+	}
+	if q.MinGasPrice > 0 {
+		bound("gas_price >= $%d::numeric", fmt.Sprint(q.MinGasPrice))
+	}
+	if q.MaxGasPrice > 0 {
+		bound("gas_price <= $%d::numeric", fmt.Sprint(q.MaxGasPrice))
+	}
+	query := `SELECT data FROM txs`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	index, _, _ := q.bounds()
+	query += map[txRangeIndex]string{
+		txRangeTime:     ` ORDER BY block_time, id`,
+		txRangeValue:    ` ORDER BY value, id`,
+		txRangeGasPrice: ` ORDER BY gas_price, id`,
+	}[index]
+	if q.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, q.Limit)
+	}
+	return postgresScan[Tx](p.db.Query(query, args...))
+}
+
+func (p *PostgresStore) Txs() (map[int]*Tx, error) {
+	records, err := postgresScan[Tx](p.db.Query(`SELECT data FROM txs`))
+	if err != nil {
+		return nil, err
+	}
+	txs := make(map[int]*Tx, len(records))
+	for _, t := range records {
+		txs[t.Id] = t
+	}
+	return txs, nil
+}
+
+func (p *PostgresStore) LastTxId() (int, error) {
+	var id int
+	err := p.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM txs`).Scan(&id)
+	return id, err
+}
+
+func (p *PostgresStore) StoreFilter(filter Filters) error {
+	v, err := json.Marshal(filter)
+	if err != nil {
+		return err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Storing an id again replaces the filter
+	if _, err := tx.Exec(`INSERT INTO filters (id, tx_to, deployer, bytecode_hash, data) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET tx_to = EXCLUDED.tx_to, deployer = EXCLUDED.deployer, bytecode_hash = EXCLUDED.bytecode_hash, data = EXCLUDED.data`,
+		filter.Id, filter.TxTo, filter.Deployer, filter.BytecodeHash, string(v)); err != nil {
+		return err
+	}
+	// Ids stored from elsewhere, e.g. a snapshot, are not handed out again
+	if _, err := tx.Exec(`SELECT setval('filter_ids', $1) WHERE $1 >= (SELECT last_value FROM filter_ids)`, filter.Id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresStore) DeleteFilter(id int) error {
+	_, err := p.db.Exec(`DELETE FROM filters WHERE id = $1`, id)
+	return err
+}
+
+func (p *PostgresStore) FilterById(id int) (*Filters, error) {
+	return postgresScanOne[Filters](p.db.Query(`SELECT data FROM filters WHERE id = $1 ORDER BY seq DESC LIMIT 1`, id))
+}
+
+func (p *PostgresStore) FiltersByTxTo(to string) ([]*Filters, error) {
+	return postgresScan[Filters](p.db.Query(`SELECT data FROM filters WHERE tx_to = $1 AND tx_to <> '' ORDER BY seq`, to))
+}
+
+func (p *PostgresStore) FiltersByDeployer(deployer string) ([]*Filters, error) {
+	return postgresScan[Filters](p.db.Query(`SELECT data FROM filters WHERE deployer = $1 AND deployer <> '' ORDER BY seq`, deployer))
+}
+
+func (p *PostgresStore) FiltersByBytecodeHash(hash string) ([]*Filters, error) {
+	return postgresScan[Filters](p.db.Query(`SELECT data FROM filters WHERE bytecode_hash = $1 AND bytecode_hash <> '' ORDER BY seq`, hash))
+}
+
+func (p *PostgresStore) Filters() (map[int]*Filters, error) {
+	records, err := postgresScan[Filters](p.db.Query(`SELECT data FROM filters ORDER BY seq`))
+	if err != nil {
+		return nil, err
+	}
+	filters := make(map[int]*Filters, len(records))
+	for _, filter := range records {
+		filters[filter.Id] = filter
+	}
+	return filters, nil
+}
+
+func (p *PostgresStore) NumFilters() (int, error) {
+	var n int
+	err := p.db.QueryRow(`SELECT COUNT(*) FROM filters`).Scan(&n)
+	return n, err
+}
+
+func (p *PostgresStore) NextFilterId() (int, error) {
+	var id int
+	err := p.db.QueryRow(`SELECT nextval('filter_ids')`).Scan(&id)
+	return id, err
+}
+
+func (p *PostgresStore) StoreRollups(rollups []Rollup) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, r := range rollups {
+		v, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO rollups (resolution, start, data) VALUES ($1, $2, $3)
+			ON CONFLICT (resolution, start) DO UPDATE SET data = EXCLUDED.data`, r.Resolution, r.Start, string(v)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (p *PostgresStore) Rollups(resolution string, from int64, to int64) ([]*Rollup, error) {
+	return postgresScan[Rollup](p.db.Query(`SELECT data FROM rollups WHERE resolution = $1 AND start >= $2 AND start <= $3 ORDER BY start`, resolution, from, to))
+}
+
+func (p *PostgresStore) DeleteRollups(resolution string, before int64) error {
+	_, err := p.db.Exec(`DELETE FROM rollups WHERE resolution = $1 AND start < $2`, resolution, before)
+	return err
+}
+
+func (p *PostgresStore) StoreWatchlist(watchlist Watchlist) error {
+	v, err := json.Marshal(watchlist)
+	if err != nil {
+		return err
+	}
+	_, err = p.db.Exec(`INSERT INTO watchlists (name, data) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET data = EXCLUDED.data`, watchlist.Name, string(v))
+	return err
+}
+
+func (p *PostgresStore) DeleteWatchlist(name string) error {
+	_, err := p.db.Exec(`DELETE FROM watchlists WHERE name = $1`, name)
+	return err
+}
+
+func (p *PostgresStore) Watchlists() (map[string]*Watchlist, error) {
+	records, err := postgresScan[Watchlist](p.db.Query(`SELECT data FROM watchlists`))
+	if err != nil {
+		return nil, err
+	}
+	watchlists := make(map[string]*Watchlist, len(records))
+	for _, watchlist := range records {
+		watchlists[watchlist.Name] = watchlist
+	}
+	return watchlists, nil
+}
+
+// The constraints keep the tables free of duplicates and PostgreSQL maintains
+// the indexes, what is left to look for are transactions without their block
+func (p *PostgresStore) Check(repair bool) (CheckReport, error) {
+	var r CheckReport
+	if !repair {
+		err := p.db.QueryRow(`SELECT COUNT(*) FROM txs WHERE NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.id = txs.block_id)`).Scan(&r.OrphanTxs)
+		return r, err
+	}
+	tx, err := p.db.Begin()
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM txs WHERE NOT EXISTS (SELECT 1 FROM blocks WHERE blocks.id = txs.block_id)`)
+	if err != nil {
+		return r, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return r, err
+	}
+	if err := tx.Commit(); err != nil {
+		return r, err
+	}
+	r.OrphanTxs = int(deleted)
+	r.Repaired = deleted > 0
+	return r, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A range query over transactions, every bound is inclusive and a zero or
+// nil bound is open. Results come in the order of the index the query
+// runs on, block time when a time bound is set, otherwise value, otherwise
+// gas price.
+type TxQuery struct {
+	FromTime    uint64
+	ToTime      uint64
+	MinValue    *big.Int
+	MaxValue    *big.Int
+	MinGasPrice uint64
+	MaxGasPrice uint64
+	// Zero returns every match
+	Limit int
+}
+
+// The ordered transaction indexes
+type txRangeIndex int
+
+const (
+	txRangeTime txRangeIndex = iota
+	txRangeValue
+	txRangeGasPrice
+)
+
+// Value keys are 256 bit big endian so they order like the amounts
+const txValueKeyLen = 32
+
+// Exact value in wei, TxValue only holds values below about 18.4 ETH
+func (t *Tx) ValueWei() *big.Int {
+	if t.TxValueWei != "" {
+		if v, ok := new(big.Int).SetString(t.TxValueWei, 10); ok {
+			return v
+		}
+	}
+	return new(big.Int).SetUint64(t.TxValue)
+}
+
+func txValueKey(v *big.Int) []byte {
+	k := make([]byte, txValueKeyLen)
+	if v.Sign() > 0 && v.BitLen() <= 8*txValueKeyLen {
+		v.FillBytes(k)
+	} else if v.Sign() > 0 {
+		for n := range k {
+			k[n] = 0xff
+		}
+	}
+	return k
+}
+
+// Index key of the transaction, the indexed field followed by the id
+func (t *Tx) rangeKey(index txRangeIndex) []byte {
+	var field []byte
+	switch index {
+	case txRangeTime:
+		field = boltUint64(t.TxBlockTime)
+	case txRangeValue:
+		field = txValueKey(t.ValueWei())
+	case txRangeGasPrice:
+		field = boltUint64(t.TxGasPrice)
+	}
+	return boltKey(field, t.Id)
+}
+
+// The index the query runs on and the bounds of the indexed field, a nil
+// upper bound is open
+func (q TxQuery) bounds() (txRangeIndex, []byte, []byte) {
+	switch {
+	case q.FromTime > 0 || q.ToTime > 0:
+		var upper []byte
+		if q.ToTime > 0 {
+			upper = boltUint64(q.ToTime)
+		}
+		return txRangeTime, boltUint64(q.FromTime), upper
+	case q.MinValue != nil || q.MaxValue != nil:
+		lower := make([]byte, txValueKeyLen)
+		if q.MinValue != nil {
+			lower = txValueKey(q.MinValue)
+		}
+		var upper []byte
+		if q.MaxValue != nil {
+			upper = txValueKey(q.MaxValue)
+		}
+		return txRangeValue, lower, upper
+	case q.MinGasPrice > 0 || q.MaxGasPrice > 0:
+		var upper []byte
+		if q.MaxGasPrice > 0 {
+			upper = boltUint64(q.MaxGasPrice)
+		}
+		return txRangeGasPrice, boltUint64(q.MinGasPrice), upper
+	}
+	return txRangeTime, boltUint64(0), nil
+}
+
+// Whether the index key is past the upper bound of the query
+func txRangePast(key []byte, upper []byte) bool {
+	return upper != nil && bytes.Compare(key[:len(key)-8], upper) > 0
+}
+
+func (q TxQuery) matches(t *Tx) bool {
+	if t.TxBlockTime < q.FromTime || (q.ToTime > 0 && t.TxBlockTime > q.ToTime) {
+		return false
+	}
+	if t.TxGasPrice < q.MinGasPrice || (q.MaxGasPrice > 0 && t.TxGasPrice > q.MaxGasPrice) {
+		return false
+	}
+	if q.MinValue != nil || q.MaxValue != nil {
+		v := t.ValueWei()
+		if (q.MinValue != nil && v.Cmp(q.MinValue) < 0) || (q.MaxValue != nil && v.Cmp(q.MaxValue) > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses an amount like 100ether, 30gwei or a plain number of wei
+func parseWei(s string) (*big.Int, error) {
+	units := []struct {
+		suffix   string
+		decimals int64
+	}{{"ether", 18}, {"eth", 18}, {"gwei", 9}, {"wei", 0}}
+	amount, decimals := strings.ToLower(strings.TrimSpace(s)), int64(0)
+	for _, unit := range units {
+		if strings.HasSuffix(amount, unit.suffix) {
+			amount, decimals = strings.TrimSpace(strings.TrimSuffix(amount, unit.suffix)), unit.decimals
+			break
+		}
+	}
+	r, ok := new(big.Rat).SetString(amount)
+	if !ok || r.Sign() < 0 {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	r.Mul(r, new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(decimals), nil)))
+	if !r.IsInt() {
+		return nil, fmt.Errorf("amount %q is not a whole number of wei", s)
+	}
+	return r.Num(), nil
+}
+
+// Parses a unix time in seconds or an RFC 3339 time
+func parseUnixTime(s string) (uint64, error) {
+	if n, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil || t.Unix() < 0 {
+		return 0, fmt.Errorf("invalid time %q, use unix seconds or RFC 3339", s)
+	}
+	return uint64(t.Unix()), nil
+}
+
+// Reads a TxQuery from the fromTime, toTime, since, minValue, maxValue,
+// minGasPrice, maxGasPrice and limit query parameters. Returns false when
+// none of them is set, other parameters such as cache busters are ignored.
+func txQueryFromValues(values url.Values, now time.Time) (TxQuery, bool, error) {
+	var q TxQuery
+	var set bool
+	for name := range values {
+		switch name {
+		case "fromTime", "toTime", "since", "minValue", "maxValue", "minGasPrice", "maxGasPrice", "limit":
+			set = true
+		}
+	}
+	if values.Get("fromTime") != "" && values.Get("since") != "" {
+		return q, set, fmt.Errorf("use either fromTime or since")
+	}
+	var err error
+	if v := values.Get("fromTime"); v != "" {
+		if q.FromTime, err = parseUnixTime(v); err != nil {
+			return q, set, err
+		}
+	}
+	if v := values.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return q, set, fmt.Errorf("invalid since %q, use a duration like 1h", v)
+		}
+		q.FromTime = uint64(now.Add(-d).Unix())
+	}
+	if v := values.Get("toTime"); v != "" {
+		if q.ToTime, err = parseUnixTime(v); err != nil {
+			return q, set, err
+		}
+	}
+	if v := values.Get("minValue"); v != "" {
+		if q.MinValue, err = parseWei(v); err != nil {
+			return q, set, err
+		}
+	}
+	if v := values.Get("maxValue"); v != "" {
+		if q.MaxValue, err = parseWei(v); err != nil {
+			return q, set, err
+		}
+	}
+	for _, p := range []struct {
+		name  string
+		value *uint64
+	}{{"minGasPrice", &q.MinGasPrice}, {"maxGasPrice", &q.MaxGasPrice}} {
+		if v := values.Get(p.name); v != "" {
+			wei, err := parseWei(v)
+			if err != nil {
+				return q, set, err
+			}
+			if !wei.IsUint64() {
+				return q, set, fmt.Errorf("%s %q is out of range", p.name, v)
+			}
+			*p.value = wei.Uint64()
+		}
+	}
+	if v := values.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			return q, set, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	return q, set, nil
+}
+
+// orderedIndex is a skip list of transactions ordered by their range key,
+// inserts and range scans take logarithmic time. Guarded by the store lock.
+type orderedIndex struct {
+	head  *orderedNode
+	level int
+	len   int
+	rnd   *rand.Rand
+}
+
+type orderedNode struct {
+	key  string
+	tx   *Tx
+	next []*orderedNode
+}
+
+const orderedMaxLevel = 24
+
+func newOrderedIndex() *orderedIndex {
+	return &orderedIndex{head: &orderedNode{next: make([]*orderedNode, orderedMaxLevel)}, level: 1, rnd: rand.New(rand.NewSource(1))}
+}
+
+// The last node before key on every level
+func (o *orderedIndex) path(key string) [orderedMaxLevel]*orderedNode {
+	var path [orderedMaxLevel]*orderedNode
+	n := o.head
+	for l := o.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].key < key {
+			n = n.next[l]
+		}
+		path[l] = n
+	}
+	return path
+}
+
+func (o *orderedIndex) insert(key string, tx *Tx) {
+	path := o.path(key)
+	if next := path[0].next[0]; next != nil && next.key == key {
+		next.tx = tx
+		return
+	}
+	level := 1
+	for level < orderedMaxLevel && o.rnd.Intn(4) == 0 {
+		level++
+	}
+	for l := o.level; l < level; l++ {
+		path[l] = o.head
+	}
+	if level > o.level {
+		o.level = level
+	}
+	node := &orderedNode{key: key, tx: tx, next: make([]*orderedNode, level)}
+	for l := 0; l < level; l++ {
+		node.next[l] = path[l].next[l]
+		path[l].next[l] = node
+	}
+	o.len++
+}
+
+// Removes the entry under key if it still points at tx
+func (o *orderedIndex) remove(key string, tx *Tx) {
+	path := o.path(key)
+	node := path[0].next[0]
+	if node == nil || node.key != key || node.tx != tx {
+		return
+	}
+	for l := range node.next {
+		path[l].next[l] = node.next[l]
+	}
+	o.len--
+}
+
+// Calls fn with the entries from key on in order until it returns false
+func (o *orderedIndex) ascend(from string, fn func(key string, tx *Tx) bool) {
+	for n := o.path(from)[0].next[0]; n != nil; n = n.next[0] {
+		if !fn(n.key, n.tx) {
+			return
+		}
+	}
+}
+
+func (m *MemoryStore) orderedIndex(index txRangeIndex) *orderedIndex {
+	switch index {
+	case txRangeValue:
+		return m.txByValue
+	case txRangeGasPrice:
+		return m.txByGasPrice
+	}
+	return m.txByTime
+}
+
+var txRangeIndexes = []txRangeIndex{txRangeTime, txRangeValue, txRangeGasPrice}
+
+func (m *MemoryStore) TxsByRange(q TxQuery) ([]*Tx, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	index, lower, upper := q.bounds()
+	var txs []*Tx
+	m.orderedIndex(index).ascend(string(lower), func(key string, tx *Tx) bool {
+		if txRangePast([]byte(key), upper) {
+			return false
+		}
+		if q.matches(tx) {
+			txs = append(txs, tx)
+		}
+		return q.Limit == 0 || len(txs) < q.Limit
+	})
+	return txs, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func ether(n int64) string {
+	return new(big.Int).Mul(big.NewInt(n), big.NewInt(1e18)).String()
+}
+
+// Two blocks an hour apart, values up to 250 ETH
+func storeRangeTestTxs(t *testing.T, s Store) {
+	assert.Nil(t, s.StoreBlockTxs(Block{Id: 1, BlockHash: fmt.Sprintf("0x%064x", 1), BlockNumber: 12232752, BlockTime: 1651495400}, []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxBlockTime: 1651495400, TxHash: fmt.Sprintf("0x%064x", 11), TxValueWei: ether(150), TxGasPrice: 30e9},
+		{Id: 2, TxBlockId: 1, TxBlockNumber: 12232752, TxBlockTime: 1651495400, TxIndex: 1, TxHash: fmt.Sprintf("0x%064x", 12), TxValue: 1e18, TxGasPrice: 50e9},
+	}))
+	assert.Nil(t, s.StoreBlockTxs(Block{Id: 2, BlockHash: fmt.Sprintf("0x%064x", 2), BlockNumber: 12232753, BlockTime: 1651499015}, []Tx{
+		{Id: 3, TxBlockId: 2, TxBlockNumber: 12232753, TxBlockTime: 1651499015, TxHash: fmt.Sprintf("0x%064x", 13), TxValueWei: ether(250), TxGasPrice: 20e9},
+		{Id: 4, TxBlockId: 2, TxBlockNumber: 12232753, TxBlockTime: 1651499015, TxIndex: 1, TxHash: fmt.Sprintf("0x%064x", 14), TxValueWei: ether(100), TxGasPrice: 40e9},
+		{Id: 5, TxBlockId: 2, TxBlockNumber: 12232753, TxBlockTime: 1651499015, TxIndex: 2, TxHash: fmt.Sprintf("0x%064x", 15), TxGasPrice: 60e9},
+	}))
+}
+
+func txIds(txs []*Tx) []int {
+	var ids []int
+	for _, tx := range txs {
+		ids = append(ids, tx.Id)
+	}
+	return ids
+}
+
+func testTxsByRange(t *testing.T, s Store) {
+	storeRangeTestTxs(t, s)
+	// Transfers above 100 ETH in the last hour
+	q, _, err := txQueryFromValues(url.Values{"since": {"1h"}, "minValue": {"100.5ether"}}, time.Unix(1651499100, 0))
+	assert.Nil(t, err)
+	txs, err := s.TxsByRange(q)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{3}, txIds(txs))
+
+	one := big.NewInt(1e18)
+	txs, _ = s.TxsByRange(TxQuery{MinValue: one})
+	assert.Equal(t, []int{2, 4, 1, 3}, txIds(txs))
+	txs, _ = s.TxsByRange(TxQuery{MaxValue: one})
+	assert.Equal(t, []int{5, 2}, txIds(txs))
+	txs, _ = s.TxsByRange(TxQuery{MinGasPrice: 30e9, MaxGasPrice: 50e9})
+	assert.Equal(t, []int{1, 4, 2}, txIds(txs))
+	txs, _ = s.TxsByRange(TxQuery{FromTime: 1651495400, ToTime: 1651495400, MinGasPrice: 40e9})
+	assert.Equal(t, []int{2}, txIds(txs))
+	txs, _ = s.TxsByRange(TxQuery{Limit: 3})
+	assert.Equal(t, []int{1, 2, 3}, txIds(txs))
+
+	// Replaced and reorged transactions leave the indexes
+	assert.Nil(t, s.StoreTx(Tx{Id: 3, TxBlockId: 2, TxBlockNumber: 12232753, TxBlockTime: 1651499015, TxHash: fmt.Sprintf("0x%064x", 13), TxValueWei: ether(10), TxGasPrice: 20e9}))
+	txs, _ = s.TxsByRange(TxQuery{MinValue: big.NewInt(0).Mul(one, big.NewInt(200))})
+	assert.Equal(t, 0, len(txs))
+	_, err = s.DeleteBlocksFrom(12232753)
+	assert.Nil(t, err)
+	txs, _ = s.TxsByRange(TxQuery{FromTime: 1651499000})
+	assert.Equal(t, 0, len(txs))
+	report, _ := s.Check(false)
+	assert.True(t, report.Clean())
+}
+
+func TestMemoryStoreTxsByRange(t *testing.T) {
+	testTxsByRange(t, NewMemoryStore())
+}
+
+func TestBoltStoreTxsByRange(t *testing.T) {
+	b, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer b.Close()
+	testTxsByRange(t, b)
+}
+
+func TestOrderedIndex(t *testing.T) {
+	o := newOrderedIndex()
+	txs := make([]Tx, 1000)
+	for n := range txs {
+		txs[n] = Tx{Id: n + 1, TxGasPrice: uint64(n*7919) % 1000}
+		o.insert(string(txs[n].rangeKey(txRangeGasPrice)), &txs[n])
+	}
+	for n := 0; n < len(txs); n += 2 {
+		o.remove(string(txs[n].rangeKey(txRangeGasPrice)), &txs[n])
+	}
+	assert.Equal(t, 500, o.len)
+	var last string
+	var seen int
+	o.ascend("", func(key string, tx *Tx) bool {
+		assert.True(t, key > last)
+		assert.Equal(t, 0, tx.Id%2)
+		last = key
+		seen++
+		return true
+	})
+	assert.Equal(t, 500, seen)
+}
+
+func TestTxQueryFromValues(t *testing.T) {
+	_, set, err := txQueryFromValues(url.Values{}, time.Now())
+	assert.Nil(t, err)
+	assert.False(t, set)
+	q, set, err := txQueryFromValues(url.Values{"fromTime": {"2022-05-02T13:00:00Z"}, "toTime": {"1651499015"}, "maxValue": {"2"}, "minGasPrice": {"1.5gwei"}, "limit": {"10"}}, time.Now())
+	assert.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, TxQuery{FromTime: 1651496400, ToTime: 1651499015, MaxValue: big.NewInt(2), MinGasPrice: 1500000000, Limit: 10}, q)
+	for _, values := range []url.Values{
+		{"minValue": {"-1"}},
+		{"minValue": {"0.5wei"}},
+		{"since": {"yesterday"}},
+		{"maxGasPrice": {"100ether"}},
+		{"fromTime": {"1651499015"}, "since": {"1h"}},
+	} {
+		_, _, err := txQueryFromValues(values, time.Now())
+		assert.NotNil(t, err, values)
+	}
+
+	// Other parameters are left to the caller
+	_, set, err = txQueryFromValues(url.Values{"_": {"1651499015"}}, time.Now())
+	assert.Nil(t, err)
+	assert.False(t, set)
+	q, set, err = txQueryFromValues(url.Values{"limit": {"5"}, "nocache": {"1"}}, time.Now())
+	assert.Nil(t, err)
+	assert.True(t, set)
+	assert.Equal(t, 5, q.Limit)
+}
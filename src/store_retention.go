@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storeEvictedBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_store_evicted_blocks_total",
+		Help: "The total number of blocks evicted from the memory store",
+	})
+	storeEvictedTxs = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_store_evicted_transactions_total",
+		Help: "The total number of transactions evicted from the memory store",
+	})
+	storeBlocks = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snoopy_store_blocks",
+		Help: "The number of blocks in the memory store",
+	})
+	storeTxs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snoopy_store_transactions",
+		Help: "The number of transactions in the memory store",
+	})
+	storeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "snoopy_store_bytes",
+		Help: "The approximate size of the blocks and transactions in the memory store, without the history, internal transfers and contracts",
+	})
+)
+
+// Retention bounds the memory store, the oldest blocks are evicted with
+// their transactions once any limit is exceeded. Zero means unlimited.
+type Retention struct {
+	MaxBlocks int
+	MaxAge    time.Duration
+	MaxBytes  int64
+}
+
+// Rough per record overhead of the struct, the map entries and the index slots.
+// Only blocks and transactions are counted against MaxBytes, the history kept
+// for new filters, internal transfers, contracts and balances come on top.
+const (
+	memoryBlockOverhead = 320
+	memoryTxOverhead    = 640
+)
+
+func (b *Block) approxSize() int64 {
+	return memoryBlockOverhead + int64(len(b.BlockHash))
+}
+
+func (t *Tx) approxSize() int64 {
+	return memoryTxOverhead + int64(len(t.TxHash)+len(t.TxData)+len(t.TxTo)+len(t.TxFrom)+len(t.TxContractAddress)+len(t.TxRevertReason))
+}
+
+// Reads SNOOPY_RETENTION_BLOCKS, SNOOPY_RETENTION_AGE and SNOOPY_RETENTION_MB
+func retentionFromEnv() (Retention, error) {
+	var r Retention
+	if v := os.Getenv("SNOOPY_RETENTION_BLOCKS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("invalid SNOOPY_RETENTION_BLOCKS %q", v)
+		}
+		r.MaxBlocks = n
+	}
+	if v := os.Getenv("SNOOPY_RETENTION_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return r, fmt.Errorf("invalid SNOOPY_RETENTION_AGE %q", v)
+		}
+		r.MaxAge = d
+	}
+	if v := os.Getenv("SNOOPY_RETENTION_MB"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return r, fmt.Errorf("invalid SNOOPY_RETENTION_MB %q", v)
+		}
+		r.MaxBytes = n << 20
+	}
+	return r, nil
+}
+
+func (r Retention) exceeded(blocks int, bytes int64, oldest *Block) bool {
+	if r.MaxBlocks > 0 && blocks > r.MaxBlocks {
+		return true
+	}
+	if r.MaxBytes > 0 && bytes > r.MaxBytes {
+		return true
+	}
+	return r.MaxAge > 0 && time.Since(time.Unix(int64(oldest.BlockTime), 0)) > r.MaxAge
+}
+
+func (m *MemoryStore) SetRetention(r Retention) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retention = r
+	m.evict()
+}
+
+// Evicts the oldest blocks until the retention holds again, the newest
+// block always stays. Callers hold the write lock.
+func (m *MemoryStore) evict() {
+	for len(m.blockOrder) > 0 && len(m.blockById) > 1 {
+		oldest, found := m.blockById[m.blockOrder[0]]
+		if found && !m.retention.exceeded(len(m.blockById), m.size, oldest) {
+			break
+		}
+		m.blockOrder = m.blockOrder[1:]
+		if !found {
+			// Already deleted by a reorg
+			continue
+		}
+		storeEvictedTxs.Add(float64(m.removeBlock(oldest)))
+		storeEvictedBlocks.Inc()
+	}
+	m.updateSizeMetrics()
+}
+
+func (m *MemoryStore) updateSizeMetrics() {
+	storeBlocks.Set(float64(len(m.blockById)))
+	storeTxs.Set(float64(len(m.txById)))
+	storeBytes.Set(float64(m.size))
+}
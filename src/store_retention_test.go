@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func storeRetentionBlocks(m *MemoryStore, n int, blockTime uint64) {
+	for i := 1; i <= n; i++ {
+		m.StoreBlockTxs(Block{Id: i, BlockHash: "0xd1ee549faee24058432f750a6f3aa5e5a96789b4bed29914da95e3b8c98b9ee" + string(rune('0'+i%10)), BlockNumber: uint64(12232778 + i), BlockTime: blockTime + uint64(i)}, []Tx{
+			{Id: 2*i - 1, TxBlockId: i, TxBlockNumber: uint64(12232778 + i), TxHash: fmt.Sprintf("0x%064x", 2*i-1), TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+			{Id: 2 * i, TxBlockId: i, TxBlockNumber: uint64(12232778 + i), TxIndex: 1, TxHash: fmt.Sprintf("0x%064x", 2*i), TxTo: "0xA090e606E30bD747d4E6245a1517EbE430F0057e"},
+		})
+	}
+}
+
+func TestMemoryStoreRetentionBlocks(t *testing.T) {
+	m := NewMemoryStore()
+	m.SetRetention(Retention{MaxBlocks: 3})
+	storeRetentionBlocks(m, 5, uint64(time.Now().Unix()))
+	blocks, _ := m.Blocks()
+	assert.Equal(t, 3, len(blocks))
+	block, _ := m.BlockById(2)
+	assert.Nil(t, block)
+	txs, _ := m.Txs()
+	assert.Equal(t, 6, len(txs))
+	// Every index lost the evicted entries
+	txs2, _ := m.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 3, len(txs2))
+	tx, _ := m.TxByHash(fmt.Sprintf("0x%064x", 2))
+	assert.Nil(t, tx)
+	tx, _ = m.TxByHash(fmt.Sprintf("0x%064x", 10))
+	assert.Equal(t, 10, tx.Id)
+	txs2, _ = m.TxsByBlockId(1)
+	assert.Equal(t, 0, len(txs2))
+	blocks2, _ := m.BlocksByNumber(12232780)
+	assert.Equal(t, 0, len(blocks2))
+	assert.Equal(t, 3, len(m.blockByHash))
+	lastBlockId, _ := m.LastBlockId()
+	assert.Equal(t, 5, lastBlockId)
+}
+
+func TestMemoryStoreRetentionAgeAndSize(t *testing.T) {
+	m := NewMemoryStore()
+	storeRetentionBlocks(m, 5, 1651499015)
+	m.SetRetention(Retention{MaxAge: time.Hour})
+	// The newest block stays however old it is
+	blocks, _ := m.Blocks()
+	assert.Equal(t, 1, len(blocks))
+
+	m = NewMemoryStore()
+	storeRetentionBlocks(m, 5, uint64(time.Now().Unix()))
+	full := m.size
+	m.SetRetention(Retention{MaxBytes: full - 1})
+	blocks, _ = m.Blocks()
+	assert.Equal(t, 4, len(blocks))
+	assert.Less(t, m.size, full)
+
+	// Nothing is left behind once everything is gone
+	m.DeleteBlocksFrom(0)
+	assert.Equal(t, int64(0), m.size)
+	assert.Equal(t, 0, len(m.txByTo))
+}
+
+func TestMemoryStoreRestoredBlocks(t *testing.T) {
+	m := NewMemoryStore()
+	storeRetentionBlocks(m, 3, uint64(time.Now().Unix()))
+	// Processed again, the blocks keep their place in the eviction order
+	for i := 0; i < 10; i++ {
+		block, _ := m.BlockById(1)
+		m.StoreBlock(*block)
+	}
+	assert.Equal(t, []int{1, 2, 3}, m.blockOrder)
+	m.SetRetention(Retention{MaxBlocks: 2})
+	block, _ := m.BlockById(1)
+	assert.Nil(t, block)
+	block, _ = m.BlockById(2)
+	assert.NotNil(t, block)
+
+	// Another block under an id takes the transactions of the old one along
+	replaced := *block
+	replaced.BlockHash = "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1"
+	assert.Nil(t, m.StoreBlock(replaced))
+	txs, _ := m.TxsByBlockId(2)
+	assert.Equal(t, 0, len(txs))
+	tx, _ := m.TxByHash(fmt.Sprintf("0x%064x", 3))
+	assert.Nil(t, tx)
+	assert.Equal(t, []int{2, 3}, m.blockOrder)
+
+	// Ids deleted by a reorg leave the order, stored again they go to the end
+	m.DeleteBlocksFrom(replaced.BlockNumber)
+	assert.Equal(t, 0, len(m.blockOrder))
+}
+
+func TestRetentionFromEnv(t *testing.T) {
+	t.Setenv("SNOOPY_RETENTION_BLOCKS", "1000")
+	t.Setenv("SNOOPY_RETENTION_AGE", "24h")
+	t.Setenv("SNOOPY_RETENTION_MB", "512")
+	r, err := retentionFromEnv()
+	assert.Nil(t, err)
+	assert.Equal(t, Retention{MaxBlocks: 1000, MaxAge: 24 * time.Hour, MaxBytes: 512 << 20}, r)
+	t.Setenv("SNOOPY_RETENTION_AGE", "a day")
+	_, err = retentionFromEnv()
+	assert.NotNil(t, err)
+}
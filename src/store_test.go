@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	m := NewMemoryStore()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 500; i++ {
+			m.StoreBlock(Block{Id: i, BlockHash: fmt.Sprintf("0x%064x", i), BlockNumber: uint64(12232778 + i)})
+			m.StoreTx(Tx{Id: i, TxHash: fmt.Sprintf("0x%064x", i), TxBlockId: i, TxBlockNumber: uint64(12232778 + i), TxTo: "0xA090e606E30bD747d4E6245a1517EbE430F0057e"})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 500; i++ {
+			m.Blocks()
+			m.TxsByTo("0xA090e606E30bD747d4E6245a1517EbE430F0057e")
+			m.BlocksByHash(fmt.Sprintf("0x%064x", i))
+		}
+	}()
+	wg.Wait()
+	blocks, err := m.Blocks()
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(blocks))
+	txs, _ := m.TxsByTo("0xA090e606E30bD747d4E6245a1517EbE430F0057e")
+	assert.Equal(t, 500, len(txs))
+}
+
+func TestMemoryStoreFilters(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreFilter(Filters{Id: 0, TxTo: "0xA090e606E30bD747d4E6245a1517EbE430F0057e"})
+	m.StoreFilter(Filters{Id: 1, Deployer: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"})
+	n, _ := m.NumFilters()
+	assert.Equal(t, 2, n)
+	filters, _ := m.FiltersByTxTo("")
+	assert.Equal(t, 0, len(filters))
+	assert.Nil(t, m.DeleteFilter(1))
+	assert.Nil(t, m.DeleteFilter(7))
+	filters, _ = m.FiltersByDeployer("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	assert.Equal(t, 0, len(filters))
+}
+
+func TestMemoryStoreReorg(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}, []Tx{{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}})
+	m.StoreBlockTxs(Block{Id: 2, BlockHash: "0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1", BlockNumber: 12232753}, []Tx{{Id: 2, TxBlockId: 2, TxBlockNumber: 12232753, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}})
+	deleted, err := m.DeleteBlocksFrom(12232753)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(deleted))
+	blocks, _ := m.BlocksByHash("0xe441ec0412436c460e4430881ba24a6b1fc8cdb35e3d462a77bfd616021b79b1")
+	assert.Equal(t, 0, len(blocks))
+	block, _ := m.BlockById(2)
+	assert.Nil(t, block)
+	txs, _ := m.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 1, len(txs))
+	tx, _ := m.TxByHash("0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2")
+	assert.Nil(t, tx)
+	tx, _ = m.TxById(1)
+	assert.Equal(t, uint64(12232752), tx.TxBlockNumber)
+}
+
+func TestMemoryStoreTxByHash(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreTx(Tx{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	m.StoreTx(Tx{Id: 2, TxBlockId: 1, TxBlockNumber: 12232752, TxIndex: 1, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	// Storing the same hash again replaces the transaction
+	m.StoreTx(Tx{Id: 3, TxBlockId: 2, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	tx, _ := m.TxByHash("0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533")
+	assert.Equal(t, 3, tx.Id)
+	tx, _ = m.TxById(1)
+	assert.Nil(t, tx)
+	txs, _ := m.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 2, len(txs))
+	txs, _ = m.TxsByBlockId(1)
+	assert.Equal(t, uint64(1), txs[0].TxIndex)
+	lastTxId, _ := m.LastTxId()
+	assert.Equal(t, 3, lastTxId)
+}
+
+func TestMemoryStoreIdempotentBlocks(t *testing.T) {
+	m := NewMemoryStore()
+	block := Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}
+	tx := Tx{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"}
+	m.StoreBlockTxs(block, []Tx{tx})
+	size := m.size
+	m.StoreBlockTxs(block, []Tx{tx})
+	blocks, _ := m.BlocksByNumber(12232752)
+	assert.Equal(t, 1, len(blocks))
+	blocks, _ = m.BlocksByHash("0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe")
+	assert.Equal(t, 1, len(blocks))
+	txs, _ := m.TxsByBlockId(1)
+	assert.Equal(t, 1, len(txs))
+	assert.Equal(t, size, m.size)
+	report, _ := m.Check(false)
+	assert.True(t, report.Clean())
+}
+
+func TestMemoryStoreCheck(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreBlockTxs(Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}, []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+	})
+	m.StoreTx(Tx{Id: 2, TxBlockId: 9, TxBlockNumber: 12232760, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"})
+	// What the old append-only writes left behind
+	block := m.blockById[1]
+	dup := *block
+	dup.Id = 2
+	m.blockById[2] = &dup
+	m.blockByHash[block.BlockHash] = append(m.blockByHash[block.BlockHash], block, &dup)
+	m.blockByNumber[block.BlockNumber] = append(m.blockByNumber[block.BlockNumber], &dup)
+	m.txByTo["0xdAC17F958D2ee523a2206206994597C13D831ec7"] = append(m.txByTo["0xdAC17F958D2ee523a2206206994597C13D831ec7"], &Tx{Id: 3, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533"})
+
+	report, err := m.Check(false)
+	assert.Nil(t, err)
+	assert.Equal(t, CheckReport{DuplicateBlocks: 1, DuplicateEntries: 1, DanglingEntries: 1, OrphanTxs: 1}, report)
+	report, _ = m.Check(true)
+	assert.True(t, report.Repaired)
+	assert.Equal(t, 2, report.OrphanTxs) // Tx 1 pointed at the dropped duplicate
+	report, _ = m.Check(false)
+	assert.True(t, report.Clean())
+	assert.Equal(t, 0, report.OrphanTxs)
+	blocks, _ := m.BlocksByHash("0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe")
+	assert.Equal(t, 1, len(blocks))
+	assert.Equal(t, 2, blocks[0].Id)
+	txs, _ := m.TxsByTo("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	assert.Equal(t, 0, len(txs)) // Both were orphans
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tokenBalanceDrift = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "snoopy_token_balance_drift",
+		Help: "Difference between balanceOf and the ledger balance at the last reconciliation, in token base units",
+	}, []string{"address", "token"})
+	tokenDriftsFound = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_token_balance_drifts_total",
+		Help: "The total number of ledger balances found drifting from balanceOf",
+	})
+	tokenTransfersProcessed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "snoopy_processed_token_transfers_total",
+		Help: "The total number of processed ERC-20 transfers touching watched addresses",
+	})
+)
+
+var transferTopic = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+var balanceOfSelector = []byte{0x70, 0xa0, 0x82, 0x31} // balanceOf(address)
+
+type TokenTransfer struct {
+	Token    string
+	From     string
+	To       string
+	Value    *big.Int
+	TxHash   string
+	LogIndex uint
+}
+
+type TokenBalance struct {
+	Address     string `json:"Address,omitempty"`
+	Token       string `json:"Token,omitempty"`
+	BlockNumber uint64 `json:"BlockNumber,omitempty"`
+	Balance     string `json:"Balance,omitempty"` // Token base units in decimal
+	Source      string `json:"Source,omitempty"`  // seed, transfer or reconcile
+}
+
+type tokenKey struct {
+	Address string
+	Token   string
+}
+
+// A transfer event, applied to the ledger once
+type tokenLogKey struct {
+	TxHash   string
+	LogIndex uint
+}
+
+// A transfer applied to the ledger at a block, undone when a reorg drops it
+type tokenApplied struct {
+	Transfer    TokenTransfer
+	Sides       []string // Watched, their balances changed
+	BlockNumber uint64
+}
+
+// Blocks below the last applied one whose transfers are remembered, a block
+// processed again or reorged out deeper than this is not caught
+const tokenReorgDepth = 1024
+
+// The ledger is written by the ingestion and the reconciliation goroutines
+var tokenMu sync.RWMutex
+var tokenLedger map[tokenKey]*big.Int = make(map[tokenKey]*big.Int)
+var tokenHistory map[tokenKey][]*TokenBalance = make(map[tokenKey][]*TokenBalance)
+var tokenApplies map[tokenLogKey]tokenApplied = make(map[tokenLogKey]tokenApplied)
+var tokenLedgerBlock uint64
+
+// Picks the ERC-20 Transfer events out of a receipt, ERC-721 transfers
+// share the signature but index the token id and are skipped.
+func decodeTransfers(logs []*types.Log) []TokenTransfer {
+	var transfers []TokenTransfer
+	for _, l := range logs {
+		if len(l.Topics) != 3 || l.Topics[0] != transferTopic || len(l.Data) != 32 {
+			continue
+		}
+		transfers = append(transfers, TokenTransfer{
+			Token:    l.Address.Hex(),
+			From:     common.BytesToAddress(l.Topics[1].Bytes()).Hex(),
+			To:       common.BytesToAddress(l.Topics[2].Bytes()).Hex(),
+			Value:    new(big.Int).SetBytes(l.Data),
+			TxHash:   l.TxHash.Hex(),
+			LogIndex: l.Index,
+		})
+	}
+	return transfers
+}
+
+func balanceOf(client *ethclient.Client, token string, address string, blockNumber *big.Int) (*big.Int, error) {
+	data := append(append([]byte{}, balanceOfSelector...), common.LeftPadBytes(common.HexToAddress(address).Bytes(), 32)...)
+	to := common.HexToAddress(token)
+	res, err := client.CallContract(context.Background(), ethereum.CallMsg{To: &to, Data: data}, blockNumber)
+	apiCallsProcessed.Inc()
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(res), nil
+}
+
+func tokenRecord(key tokenKey, blockNumber uint64, source string) {
+	tokenHistory[key] = append(tokenHistory[key], &TokenBalance{Address: key.Address, Token: key.Token, BlockNumber: blockNumber, Balance: tokenLedger[key].String(), Source: source})
+}
+
+// Applies the transfers of a block to the ledger of the watched addresses.
+// Pairs seen for the first time are seeded with balanceOf at the parent block.
+// A transfer already applied, by tx hash and log index, is skipped.
+func ApplyTokenTransfers(client *ethclient.Client, transfers []TokenTransfer, watched *AddressSet, blockNumber *big.Int) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	for _, tr := range transfers {
+		logKey := tokenLogKey{TxHash: tr.TxHash, LogIndex: tr.LogIndex}
+		if _, applied := tokenApplies[logKey]; applied {
+			continue
+		}
+		var sides []string
+		for _, side := range []string{tr.From, tr.To} {
+			if !watched.Contains(side) {
+				continue
+			}
+			key := tokenKey{Address: side, Token: tr.Token}
+			if _, found := tokenLedger[key]; !found {
+				tokenLedger[key] = new(big.Int)
+				if client != nil {
+					parent := new(big.Int).Sub(blockNumber, big.NewInt(1))
+					seed, err := balanceOf(client, tr.Token, side, parent)
+					if err != nil {
+						log.Print(err) // Log error and start from zero, reconciliation will catch up
+					} else {
+						tokenLedger[key].Set(seed)
+					}
+					tokenRecord(key, parent.Uint64(), "seed")
+				}
+			}
+			if side == tr.From {
+				tokenLedger[key].Sub(tokenLedger[key], tr.Value)
+			}
+			if side == tr.To {
+				tokenLedger[key].Add(tokenLedger[key], tr.Value)
+			}
+			tokenRecord(key, blockNumber.Uint64(), "transfer")
+			sides = append(sides, side)
+		}
+		if len(sides) > 0 {
+			tokenApplies[logKey] = tokenApplied{Transfer: tr, Sides: sides, BlockNumber: blockNumber.Uint64()}
+		}
+		tokenTransfersProcessed.Inc()
+	}
+	if blockNumber.Uint64() > tokenLedgerBlock {
+		tokenLedgerBlock = blockNumber.Uint64()
+	}
+	for logKey, applied := range tokenApplies {
+		if applied.BlockNumber+tokenReorgDepth < tokenLedgerBlock {
+			delete(tokenApplies, logKey)
+		}
+	}
+}
+
+// Takes the transfers of the blocks at and above number back out of the
+// ledger when a reorg drops them, with the balances recorded for those blocks
+func RevertTokenTransfers(number uint64) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	reverted := make(map[tokenKey]bool)
+	for logKey, applied := range tokenApplies {
+		if applied.BlockNumber < number {
+			continue
+		}
+		tr := applied.Transfer
+		for _, side := range applied.Sides {
+			key := tokenKey{Address: side, Token: tr.Token}
+			balance, found := tokenLedger[key]
+			if !found {
+				continue
+			}
+			if side == tr.From {
+				balance.Add(balance, tr.Value)
+			}
+			if side == tr.To {
+				balance.Sub(balance, tr.Value)
+			}
+			reverted[key] = true
+		}
+		delete(tokenApplies, logKey)
+	}
+	for key := range reverted {
+		history := tokenHistory[key]
+		for len(history) > 0 && history[len(history)-1].BlockNumber >= number {
+			history = history[:len(history)-1]
+		}
+		tokenHistory[key] = history
+	}
+	if number > 0 && tokenLedgerBlock >= number {
+		tokenLedgerBlock = number - 1
+	}
+}
+
+// Compares every ledger balance with balanceOf at the last applied block,
+// records any drift and corrects the ledger. The balances are copied and
+// balanceOf called without the lock, so ingestion goes on meanwhile.
+func ReconcileTokenBalances(client *ethclient.Client) {
+	tokenMu.RLock()
+	block := tokenLedgerBlock
+	ledger := make(map[tokenKey]*big.Int, len(tokenLedger))
+	for key, balance := range tokenLedger {
+		ledger[key] = new(big.Int).Set(balance)
+	}
+	tokenMu.RUnlock()
+	if block == 0 {
+		return
+	}
+	blockNumber := new(big.Int).SetUint64(block)
+	drifts := make(map[tokenKey]*big.Int)
+	for key, balance := range ledger {
+		onChain, err := balanceOf(client, key.Token, key.Address, blockNumber)
+		if err != nil {
+			log.Print(err) // Log error and continue
+			continue
+		}
+		drift := new(big.Int).Sub(onChain, balance)
+		driftValue, _ := new(big.Float).SetInt(drift).Float64()
+		tokenBalanceDrift.WithLabelValues(key.Address, key.Token).Set(driftValue)
+		if drift.Sign() != 0 {
+			log.Println("Token drift: " + key.Address + " " + key.Token + " ledger " + balance.String() + " balanceOf " + onChain.String())
+			tokenDriftsFound.Inc()
+			drifts[key] = drift
+		}
+	}
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if tokenLedgerBlock < block {
+		return // A reorg took blocks back out since, check again next time
+	}
+	// Transfers applied since are deltas on top of the corrected balance
+	for key, drift := range drifts {
+		balance := tokenLedger[key]
+		balance.Add(balance, drift)
+		tokenRecord(key, tokenLedgerBlock, "reconcile")
+	}
+}
+
+func reconcileTokenBalancesRun(client *ethclient.Client) {
+	interval := 10 * time.Minute
+	if v := os.Getenv("SNOOPY_TOKEN_RECONCILE_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Print(err) // Log error and use the default
+		} else {
+			interval = d
+		}
+	}
+	for range time.Tick(interval) {
+		ReconcileTokenBalances(client)
+	}
+}
+
+// Current ledger balances of every watched address
+func TokenBalances() []*TokenBalance {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	var balances []*TokenBalance
+	for _, history := range tokenHistory {
+		if len(history) > 0 {
+			balances = append(balances, history[len(history)-1])
+		}
+	}
+	return balances
+}
+
+// Ledger balance of address in token as of blockNumber, nil if unknown
+func TokenBalanceAt(address string, token string, blockNumber uint64) *TokenBalance {
+	tokenMu.RLock()
+	defer tokenMu.RUnlock()
+	var at *TokenBalance
+	for _, entry := range tokenHistory[tokenKey{Address: address, Token: token}] {
+		if entry.BlockNumber > blockNumber {
+			break
+		}
+		at = entry
+	}
+	return at
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecodeTransfers(t *testing.T) {
+	token := common.HexToAddress("0xdAC17F958D2ee523a2206206994597C13D831ec7")
+	from := common.HexToAddress("0x70997970C51812dc3A010C7d01b50e0d17dc79C8")
+	to := common.HexToAddress("0x3C44CdDdB6a900fa2b585dd299e03d12FA4293BC")
+	logs := []*types.Log{
+		{Address: token, Topics: []common.Hash{transferTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes())}, Data: common.LeftPadBytes(big.NewInt(500).Bytes(), 32)},
+		// ERC-721, token id indexed
+		{Address: token, Topics: []common.Hash{transferTopic, common.BytesToHash(from.Bytes()), common.BytesToHash(to.Bytes()), common.BigToHash(big.NewInt(7))}},
+	}
+	transfers := decodeTransfers(logs)
+	assert.Equal(t, 1, len(transfers))
+	assert.Equal(t, to.Hex(), transfers[0].To)
+	assert.Equal(t, "500", transfers[0].Value.String())
+
+	watched := NewAddressSet([]string{to.Hex()})
+	transfers[0].TxHash = "0x01"
+	ApplyTokenTransfers(nil, transfers, watched, big.NewInt(100))
+	later := transfers[0]
+	later.TxHash = "0x02"
+	ApplyTokenTransfers(nil, []TokenTransfer{later}, watched, big.NewInt(102))
+	assert.Equal(t, "500", TokenBalanceAt(to.Hex(), token.Hex(), 101).Balance)
+	assert.Equal(t, "1000", TokenBalanceAt(to.Hex(), token.Hex(), 102).Balance)
+	assert.Nil(t, TokenBalanceAt(to.Hex(), token.Hex(), 99))
+	assert.Nil(t, TokenBalanceAt(from.Hex(), token.Hex(), 102))
+
+	// A block processed again applies its transfers once
+	ApplyTokenTransfers(nil, []TokenTransfer{later}, watched, big.NewInt(102))
+	assert.Equal(t, "1000", TokenBalanceAt(to.Hex(), token.Hex(), 102).Balance)
+
+	// A reorg takes them back out
+	RevertTokenTransfers(102)
+	assert.Equal(t, "500", TokenBalanceAt(to.Hex(), token.Hex(), 102).Balance)
+	tokenMu.RLock()
+	assert.Equal(t, "500", tokenLedger[tokenKey{Address: to.Hex(), Token: token.Hex()}].String())
+	assert.Equal(t, uint64(101), tokenLedgerBlock)
+	tokenMu.RUnlock()
+	ApplyTokenTransfers(nil, []TokenTransfer{later}, watched, big.NewInt(102))
+	assert.Equal(t, "1000", TokenBalanceAt(to.Hex(), token.Hex(), 102).Balance)
+}
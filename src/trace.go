@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type InternalTx struct {
+	Id            int    `json:"Id,omitempty"`
+	TxHash        string `json:"TxHash,omitempty"`
+	TxBlockId     int    `json:"TxBlockId,omitempty"`
+	TxBlockNumber uint64 `json:"TxBlockNumber,omitempty"`
+	// Position among the internal transfers of the transaction in the trace
+	TraceIndex int    `json:"TraceIndex"`
+	Type       string `json:"Type,omitempty"`
+	From       string `json:"From,omitempty"`
+	To         string `json:"To,omitempty"`
+	Value      string `json:"Value,omitempty"` // Wei in decimal, internal transfers easily exceed uint64
+	Depth      int    `json:"Depth,omitempty"`
+}
+
+type internalTxKey struct {
+	TxHash     string
+	TraceIndex int
+}
+
+// Internal transfers are kept in memory by the ingesting instance only, they
+// are not part of the store and start out empty after a restart
+var internalTxMu sync.RWMutex
+var lastInternalTxId int
+var internalTxById map[int]*InternalTx = make(map[int]*InternalTx)
+var internalTxByKey map[internalTxKey]*InternalTx = make(map[internalTxKey]*InternalTx)
+var internalTxByTxHash map[string][]*InternalTx = make(map[string][]*InternalTx)
+var internalTxByTo map[string][]*InternalTx = make(map[string][]*InternalTx)
+var internalTxByFrom map[string][]*InternalTx = make(map[string][]*InternalTx)
+
+// Stores the internal transfer by tx hash and trace index, one stored again
+// (a block processed twice) keeps its id and replaces the one stored
+func InternalTxStore(itx InternalTx) {
+	internalTxMu.Lock()
+	defer internalTxMu.Unlock()
+	key := internalTxKey{itx.TxHash, itx.TraceIndex}
+	if existing, found := internalTxByKey[key]; found {
+		itx.Id = existing.Id
+		removeInternalTx(existing)
+	} else {
+		lastInternalTxId++
+		itx.Id = lastInternalTxId
+	}
+	internalTxById[itx.Id] = &itx
+	internalTxByKey[key] = &itx
+	internalTxByTxHash[itx.TxHash] = append(internalTxByTxHash[itx.TxHash], &itx)
+	internalTxByTo[itx.To] = append(internalTxByTo[itx.To], &itx)
+	internalTxByFrom[itx.From] = append(internalTxByFrom[itx.From], &itx)
+}
+
+func removeInternalTx(itx *InternalTx) {
+	delete(internalTxById, itx.Id)
+	delete(internalTxByKey, internalTxKey{itx.TxHash, itx.TraceIndex})
+	memoryIndexRemove(internalTxByTxHash, itx.TxHash, itx)
+	memoryIndexRemove(internalTxByTo, itx.To, itx)
+	memoryIndexRemove(internalTxByFrom, itx.From, itx)
+}
+
+// Drops the internal transfers of blocks from number on, for a reorg.
+// Returns how many were dropped.
+func DeleteInternalTxsFrom(number uint64) int {
+	internalTxMu.Lock()
+	defer internalTxMu.Unlock()
+	var dropped int
+	for _, itx := range internalTxById {
+		if itx.TxBlockNumber >= number {
+			removeInternalTx(itx)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+func InternalTxs() map[int]*InternalTx {
+	internalTxMu.RLock()
+	defer internalTxMu.RUnlock()
+	internalTxs := make(map[int]*InternalTx, len(internalTxById))
+	for id, itx := range internalTxById {
+		internalTxs[id] = itx
+	}
+	return internalTxs
+}
+
+func InternalTxsByTxHash(hash string) []*InternalTx {
+	internalTxMu.RLock()
+	defer internalTxMu.RUnlock()
+	return append([]*InternalTx(nil), internalTxByTxHash[hash]...)
+}
+
+// Tracing needs the debug namespace, which Infura does not serve,
+// so it is opt-in and meant for self-hosted nodes via SNOOPY_NODE_URL.
+func traceEnabled() bool {
+	return os.Getenv("SNOOPY_TRACE_INTERNAL") == "true"
+}
+
+// Frame as returned by the geth callTracer
+type callFrame struct {
+	Type  string         `json:"type"`
+	From  common.Address `json:"from"`
+	To    common.Address `json:"to"`
+	Value *hexutil.Big   `json:"value"`
+	Error string         `json:"error"`
+	Calls []callFrame    `json:"calls"`
+}
+
+type txTraceResult struct {
+	TxHash string    `json:"txHash"`
+	Result callFrame `json:"result"`
+	Error  string    `json:"error"`
+}
+
+var callTracer = map[string]string{"tracer": "callTracer"}
+
+// Traces every transaction in the block and returns the internal value
+// transfers keyed by tx hash. Falls back to tracing transaction by
+// transaction if the node refuses the block trace.
+func traceBlock(rpcClient *rpc.Client, blockHash common.Hash, txHashes []common.Hash) map[string][]InternalTx {
+	internal := make(map[string][]InternalTx)
+	var results []txTraceResult
+	err := rpcClient.CallContext(context.Background(), &results, "debug_traceBlockByHash", blockHash, callTracer)
+	apiCallsProcessed.Inc()
+	if err == nil && len(results) == len(txHashes) {
+		for n, res := range results {
+			if res.Error != "" {
+				log.Print("Trace failed for " + txHashes[n].Hex() + ": " + res.Error)
+				continue
+			}
+			internal[txHashes[n].Hex()] = indexTransfers(flattenCallFrame(res.Result, 0))
+		}
+		return internal
+	}
+	if err != nil {
+		log.Print(err) // Log error and trace per transaction instead
+	}
+	for _, txHash := range txHashes {
+		var frame callFrame
+		err := rpcClient.CallContext(context.Background(), &frame, "debug_traceTransaction", txHash, callTracer)
+		apiCallsProcessed.Inc()
+		if err != nil {
+			log.Print(err) // Log error and continue
+			continue
+		}
+		internal[txHash.Hex()] = indexTransfers(flattenCallFrame(frame, 0))
+	}
+	return internal
+}
+
+// Numbers the transfers of a transaction in trace order
+func indexTransfers(transfers []InternalTx) []InternalTx {
+	for n := range transfers {
+		transfers[n].TraceIndex = n
+	}
+	return transfers
+}
+
+// Walks the call tree and collects nested calls that moved value,
+// depth 0 is the transaction itself and is already covered by Tx.
+func flattenCallFrame(frame callFrame, depth int) []InternalTx {
+	var transfers []InternalTx
+	if depth > 0 && frame.Error == "" && frame.Value != nil && frame.Value.ToInt().Sign() > 0 {
+		switch frame.Type {
+		case "CALL", "CALLCODE", "CREATE", "CREATE2", "SELFDESTRUCT":
+			transfers = append(transfers, InternalTx{Type: frame.Type, From: frame.From.Hex(), To: frame.To.Hex(), Value: frame.Value.ToInt().String(), Depth: depth})
+		}
+	}
+	if frame.Error != "" {
+		// Reverted subtrees did not move anything
+		return transfers
+	}
+	for _, call := range frame.Calls {
+		transfers = append(transfers, flattenCallFrame(call, depth+1)...)
+	}
+	return transfers
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenCallFrame(t *testing.T) {
+	trace := `{"type":"CALL","from":"0xf39fd6e51aad88f6f4ce6ab8827279cfffb92266","to":"0x5fbdb2315678afecb367f032d93f642f64180aa3","value":"0x0","calls":[
+		{"type":"CALL","from":"0x5fbdb2315678afecb367f032d93f642f64180aa3","to":"0x70997970c51812dc3a010c7d01b50e0d17dc79c8","value":"0xde0b6b3a7640000"},
+		{"type":"STATICCALL","from":"0x5fbdb2315678afecb367f032d93f642f64180aa3","to":"0x3c44cdddb6a900fa2b585dd299e03d12fa4293bc"},
+		{"type":"CALL","from":"0x5fbdb2315678afecb367f032d93f642f64180aa3","to":"0x90f79bf6eb2c4f870365e785982e1f101e93b906","value":"0x1","error":"execution reverted"},
+		{"type":"DELEGATECALL","from":"0x5fbdb2315678afecb367f032d93f642f64180aa3","to":"0x15d34aaf54267db7d7c367839aaf71a00a2c6a65","calls":[
+			{"type":"CALL","from":"0x5fbdb2315678afecb367f032d93f642f64180aa3","to":"0x9965507d1a55bcc2695c58ba16fb37d819b0a4dc","value":"0x2"}
+		]}
+	]}`
+	var frame callFrame
+	assert.Nil(t, json.Unmarshal([]byte(trace), &frame))
+	transfers := indexTransfers(flattenCallFrame(frame, 0))
+	assert.Equal(t, 2, len(transfers))
+	assert.Equal(t, 1, transfers[1].TraceIndex)
+	assert.Equal(t, "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", transfers[0].To)
+	assert.Equal(t, "1000000000000000000", transfers[0].Value)
+	assert.Equal(t, 2, transfers[1].Depth)
+
+	assert.Equal(t, false, matchStoredFilters(FilterSubject{Internal: transfers}))
+	AddFilter("0x9965507D1a55bcC2695C58ba16FB37d819B0A4dc")
+	assert.Equal(t, true, matchStoredFilters(FilterSubject{Internal: transfers}))
+}
+
+func TestInternalTxStore(t *testing.T) {
+	hash := "0x2bd5c3e4f4e8c1a9e0b7d9f8e6c5b4a3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7"
+	itx := InternalTx{TxHash: hash, TxBlockNumber: 12232780, From: "0x5FbDB2315678afecb367f032d93F642f64180aa3", To: "0x70997970C51812dc3A010C7d01b50e0d17dc79C8", Value: "1"}
+	InternalTxStore(itx)
+	// Stored again when its block is processed twice, listed once
+	InternalTxStore(itx)
+	itx.TraceIndex = 1
+	InternalTxStore(itx)
+	stored := InternalTxsByTxHash(hash)
+	assert.Equal(t, 2, len(stored))
+	assert.Equal(t, stored[0].Id+1, stored[1].Id)
+
+	// Internal transfers of reorged blocks are dropped
+	assert.Equal(t, 0, DeleteInternalTxsFrom(12232781))
+	assert.Equal(t, 2, DeleteInternalTxsFrom(12232780))
+	assert.Equal(t, 0, len(InternalTxsByTxHash(hash)))
+}
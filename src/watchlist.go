@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A named group of addresses, e.g. treasury, hot wallets or exchanges
+type Watchlist struct {
+	Name        string `json:"Name,omitempty"`
+	Description string `json:"Description,omitempty"`
+	// Checksummed address to its label, e.g. Binance 14, the label may be empty
+	Addresses map[string]string `json:"Addresses,omitempty"`
+	// Changes with every edit, the address set built from the watchlist is
+	// reused until it does
+	Revision int64       `json:"Revision,omitempty"`
+	set      *AddressSet // Of the addresses when loaded for matching
+}
+
+// An address to add to a watchlist
+type WatchlistAddress struct {
+	Address string `json:"address"`
+	Label   string `json:"label,omitempty"`
+}
+
+// A watchlist address the transaction touched
+type WatchlistMatch struct {
+	Watchlist string `json:"Watchlist"`
+	Label     string `json:"Label,omitempty"`
+	Address   string `json:"Address"`
+}
+
+func (m WatchlistMatch) String() string {
+	if m.Label == "" {
+		return m.Watchlist + " " + m.Address
+	}
+	return m.Watchlist + " " + m.Label
+}
+
+// An invalid watchlist name or address
+type WatchlistError struct {
+	Msg string
+}
+
+func (e *WatchlistError) Error() string {
+	return e.Msg
+}
+
+var watchlistName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+func checkWatchlistName(name string) error {
+	if !watchlistName.MatchString(name) {
+		return &WatchlistError{Msg: fmt.Sprintf("invalid watchlist name %q, use letters, digits, _, . and -", name)}
+	}
+	return nil
+}
+
+func normalizeWatchlistAddress(address string) (string, error) {
+	normalized, err := normalizeAddress(address)
+	if err != nil {
+		return "", &WatchlistError{Msg: err.Error()}
+	}
+	return normalized, nil
+}
+
+// The form addresses are kept in, anything not an address as it is
+func canonicalAddress(address string) string {
+	if a, ok := parseAddress(address); ok {
+		return a.Hex()
+	}
+	return address
+}
+
+func (w *Watchlist) clone() *Watchlist {
+	c := *w
+	c.Addresses = make(map[string]string, len(w.Addresses))
+	for address, label := range w.Addresses {
+		c.Addresses[address] = label
+	}
+	return &c
+}
+
+// Whether the address is on the watchlist, in any case
+func (w *Watchlist) Contains(address string) bool {
+	if w == nil {
+		return false
+	}
+	if w.set != nil {
+		return w.set.Contains(address)
+	}
+	_, ok := w.Addresses[canonicalAddress(address)]
+	return ok
+}
+
+// Address sets of the watchlists by name, with the revision they were built from
+var (
+	watchlistSetsMu sync.Mutex
+	watchlistSets   = make(map[string]*Watchlist)
+)
+
+// The watchlists of the store for matching, each with the address set of its
+// revision. Sets are built once per revision, the watchlists are copies.
+func loadWatchlists() (map[string]*Watchlist, error) {
+	watchlists, err := store.Watchlists()
+	if err != nil {
+		return nil, err
+	}
+	watchlistSetsMu.Lock()
+	defer watchlistSetsMu.Unlock()
+	loaded := make(map[string]*Watchlist, len(watchlists))
+	for name, watchlist := range watchlists {
+		built := watchlistSets[name]
+		if built == nil || built.Revision != watchlist.Revision || built.set.Len() != len(watchlist.Addresses) {
+			addresses := make([]string, 0, len(watchlist.Addresses))
+			for address := range watchlist.Addresses {
+				addresses = append(addresses, address)
+			}
+			built = &Watchlist{Revision: watchlist.Revision, set: NewAddressSet(addresses)}
+			built.set.report("watchlist/" + name)
+			watchlistSets[name] = built
+		}
+		c := *watchlist
+		c.set = built.set
+		loaded[name] = &c
+	}
+	for name := range watchlistSets {
+		if watchlists[name] == nil {
+			delete(watchlistSets, name)
+			forgetAddressSet("watchlist/" + name)
+		}
+	}
+	return loaded, nil
+}
+
+// Watchlist addresses among the sender, recipient, created contract and
+// internal transfers of the subject, ordered by watchlist and address
+func WatchlistMatches(watchlists map[string]*Watchlist, s *FilterSubject) []WatchlistMatch {
+	if len(watchlists) == 0 || s.Tx == nil {
+		return nil
+	}
+	addresses := []string{s.Tx.TxFrom, s.Tx.TxTo, s.Tx.TxContractAddress}
+	for _, itx := range s.Internal {
+		addresses = append(addresses, itx.From, itx.To)
+	}
+	seen := make(map[WatchlistMatch]bool)
+	var matches []WatchlistMatch
+	for name, watchlist := range watchlists {
+		for _, address := range addresses {
+			if !watchlist.Contains(address) {
+				continue
+			}
+			address = canonicalAddress(address)
+			label, ok := watchlist.Addresses[address]
+			if !ok {
+				continue
+			}
+			m := WatchlistMatch{Watchlist: name, Label: label, Address: address}
+			if !seen[m] {
+				seen[m] = true
+				matches = append(matches, m)
+			}
+		}
+	}
+	sort.Slice(matches, func(a, b int) bool {
+		if matches[a].Watchlist != matches[b].Watchlist {
+			return matches[a].Watchlist < matches[b].Watchlist
+		}
+		return matches[a].Address < matches[b].Address
+	})
+	return matches
+}
+
+// Reads address,label lines, the label column and a header line are optional
+func ParseWatchlistCSV(r io.Reader) ([]WatchlistAddress, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	var entries []WatchlistAddress
+	for first := true; ; first = false {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+		if first && strings.EqualFold(strings.TrimSpace(record[0]), "address") {
+			continue
+		}
+		entry := WatchlistAddress{Address: strings.TrimSpace(record[0])}
+		if len(record) > 1 {
+			entry.Label = strings.TrimSpace(record[1])
+		}
+		if _, err := normalizeWatchlistAddress(entry.Address); err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Serializes the read, change and store of watchlists through the API
+var watchlistMu sync.Mutex
+
+// Adds addresses to the watchlist, creating it if needed. An address already
+// on it gets the new label, a description replaces the one it had.
+func AddWatchlistAddresses(name string, description string, entries []WatchlistAddress) (*Watchlist, error) {
+	if err := checkWatchlistName(name); err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		address, err := normalizeWatchlistAddress(entry.Address)
+		if err != nil {
+			return nil, err
+		}
+		addresses[address] = strings.TrimSpace(entry.Label)
+	}
+	watchlistMu.Lock()
+	defer watchlistMu.Unlock()
+	watchlists, err := store.Watchlists()
+	if err != nil {
+		return nil, err
+	}
+	watchlist := &Watchlist{Name: name, Addresses: make(map[string]string)}
+	if existing := watchlists[name]; existing != nil {
+		watchlist = existing.clone()
+	}
+	if description != "" {
+		watchlist.Description = description
+	}
+	for address, label := range addresses {
+		watchlist.Addresses[address] = label
+	}
+	watchlist.Revision = time.Now().UnixNano()
+	if err := store.StoreWatchlist(*watchlist); err != nil {
+		return nil, err
+	}
+	return watchlist, nil
+}
+
+// Takes addresses off the watchlist, nil if there is no such watchlist
+func RemoveWatchlistAddresses(name string, entries []WatchlistAddress) (*Watchlist, error) {
+	watchlistMu.Lock()
+	defer watchlistMu.Unlock()
+	watchlists, err := store.Watchlists()
+	if err != nil || watchlists[name] == nil {
+		return nil, err
+	}
+	watchlist := watchlists[name].clone()
+	for _, entry := range entries {
+		delete(watchlist.Addresses, canonicalAddress(strings.TrimSpace(entry.Address)))
+	}
+	watchlist.Revision = time.Now().UnixNano()
+	if err := store.StoreWatchlist(*watchlist); err != nil {
+		return nil, err
+	}
+	return watchlist, nil
+}
+
+// Ids of the filters naming the watchlist, a watchlist in use is not deleted
+func filtersUsingWatchlist(name string) ([]int, error) {
+	filters, err := store.Filters()
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, id := range sortedIds(filters) {
+		for _, used := range filters[id].watchlists() {
+			if used == name {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (m *MemoryStore) StoreWatchlist(watchlist Watchlist) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchlists[watchlist.Name] = &watchlist
+	return nil
+}
+
+func (m *MemoryStore) DeleteWatchlist(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.watchlists, name)
+	return nil
+}
+
+func (m *MemoryStore) Watchlists() (map[string]*Watchlist, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	watchlists := make(map[string]*Watchlist, len(m.watchlists))
+	for name, watchlist := range m.watchlists {
+		watchlists[name] = watchlist
+	}
+	return watchlists, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	treasury = "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+	exchange = "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"
+)
+
+func testWatchlists(t *testing.T) func() {
+	saved := store
+	store = NewMemoryStore()
+	_, err := AddWatchlistAddresses("treasury", "Company wallets", []WatchlistAddress{{Address: treasury, Label: "Cold wallet"}})
+	assert.Nil(t, err)
+	return func() { store = saved }
+}
+
+func TestWatchlistStores(t *testing.T) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "snoopy.db"))
+	assert.Nil(t, err)
+	defer bolt.Close()
+	journaled, err := NewJournaledStore(NewMemoryStore(), t.TempDir(), JournalOptions{})
+	assert.Nil(t, err)
+	defer journaled.Close()
+	for _, s := range []Store{NewMemoryStore(), bolt, journaled} {
+		assert.Nil(t, s.StoreWatchlist(Watchlist{Name: "treasury", Description: "Company wallets", Addresses: map[string]string{treasury: "Cold wallet"}}))
+		assert.Nil(t, s.StoreWatchlist(Watchlist{Name: "exchanges"}))
+		watchlists, err := s.Watchlists()
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(watchlists))
+		assert.Equal(t, "Cold wallet", watchlists["treasury"].Addresses[treasury])
+		assert.Nil(t, s.DeleteWatchlist("exchanges"))
+		watchlists, _ = s.Watchlists()
+		assert.Equal(t, 1, len(watchlists))
+	}
+}
+
+func TestWatchlistSnapshot(t *testing.T) {
+	m := NewMemoryStore()
+	m.StoreWatchlist(Watchlist{Name: "treasury", Addresses: map[string]string{treasury: "Cold wallet"}})
+	var buf bytes.Buffer
+	cp, err := ExportSnapshot(m, &buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cp.Watchlists)
+	restored := NewMemoryStore()
+	_, err = ImportSnapshot(restored, &buf)
+	assert.Nil(t, err)
+	watchlists, _ := restored.Watchlists()
+	assert.True(t, watchlists["treasury"].Contains(treasury))
+}
+
+func TestParseWatchlistCSV(t *testing.T) {
+	entries, err := ParseWatchlistCSV(strings.NewReader("address,label\n# Cold storage\n" + treasury + ", Cold wallet\n\n" + exchange + "\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []WatchlistAddress{{Address: treasury, Label: "Cold wallet"}, {Address: exchange}}, entries)
+
+	_, err = ParseWatchlistCSV(strings.NewReader(treasury + "\n0x123,Short\n"))
+	assert.EqualError(t, err, `line 2: invalid address "0x123", use 0x and 40 hex digits`)
+
+	// Mixed case has to be a valid checksum
+	_, err = ParseWatchlistCSV(strings.NewReader("0xF39Fd6e51aad88F6F4ce6aB8827279cffFb92266\n"))
+	assert.EqualError(t, err, `line 1: address "0xF39Fd6e51aad88F6F4ce6aB8827279cffFb92266" fails its EIP-55 checksum, check it for typos or give it in lower case`)
+}
+
+func TestAddWatchlistAddresses(t *testing.T) {
+	defer testWatchlists(t)()
+	watchlist, err := AddWatchlistAddresses("treasury", "", []WatchlistAddress{{Address: treasury, Label: "Safe"}, {Address: exchange}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Company wallets", watchlist.Description)
+	assert.Equal(t, map[string]string{treasury: "Safe", exchange: ""}, watchlist.Addresses)
+
+	watchlist, err = RemoveWatchlistAddresses("treasury", []WatchlistAddress{{Address: exchange}})
+	assert.Nil(t, err)
+	assert.False(t, watchlist.Contains(exchange))
+	watchlist, err = RemoveWatchlistAddresses("exchanges", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, watchlist)
+
+	_, err = AddWatchlistAddresses("hot wallets", "", nil)
+	assert.IsType(t, &WatchlistError{}, err)
+	_, err = AddWatchlistAddresses("treasury", "", []WatchlistAddress{{Address: "vitalik.eth"}})
+	assert.IsType(t, &WatchlistError{}, err)
+}
+
+func TestWatchlistFilters(t *testing.T) {
+	defer testWatchlists(t)()
+	watchlists, _ := store.Watchlists()
+	s := FilterSubject{
+		Tx:         &Tx{TxFrom: exchange, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7", TxValueWei: ether(12)},
+		Internal:   []InternalTx{{From: "0xdAC17F958D2ee523a2206206994597C13D831ec7", To: treasury}},
+		Watchlists: watchlists,
+	}
+	assert.Equal(t, []WatchlistMatch{{Watchlist: "treasury", Label: "Cold wallet", Address: treasury}}, WatchlistMatches(watchlists, &s))
+	assert.True(t, (&Filters{Watchlist: "treasury"}).Matches(s))
+	assert.False(t, (&Filters{Watchlist: "exchanges"}).Matches(s))
+
+	e, err := CompileFilterExpr(`tx.value > 10e18 && tx.from in watchlist("treasury")`)
+	assert.Nil(t, err)
+	assert.False(t, e.Matches(&s))
+	s.Tx.TxFrom = treasury
+	assert.True(t, e.Matches(&s))
+	assert.Equal(t, []string{"treasury"}, e.watchlists)
+	_, err = CompileFilterExpr(`tx.to in watchlist(tx.from)`)
+	assert.EqualError(t, err, "expression: watchlist takes a name in quotes at column 10")
+	_, err = CompileFilterExpr(`watchlist("treasury") == watchlist("treasury")`)
+	assert.NotNil(t, err)
+
+	// Filters only name watchlists that exist, and keep them from being deleted
+	_, err = AddFilterCriteria(Filters{Expression: `tx.to in watchlist("exchanges")`})
+	assert.EqualError(t, err, `unknown watchlist "exchanges"`)
+	added, err := AddFilterCriteria(Filters{Expression: `tx.to in watchlist("treasury")`})
+	assert.Nil(t, err)
+	ids, _ := filtersUsingWatchlist("treasury")
+	assert.Equal(t, []int{added.Id}, ids)
+}
+
+func TestWatchlistFilterMatchStored(t *testing.T) {
+	defer testWatchlists(t)()
+	assert.Nil(t, store.StoreFilter(Filters{Id: 1, Watchlist: "treasury"}))
+	filters, _ := store.Filters()
+	watchlists, _ := loadWatchlists()
+	schedule := NewFilterSchedule(filters, 12232752, 1651499015)
+	index := NewFilterIndex(schedule.Active)
+
+	block := Block{Id: 1, BlockHash: "0x547bd8bd5f9c8eee5d2be941f275ee95672632159b8981df7917335963642fbe", BlockNumber: 12232752}
+	var kept []Tx
+	for _, tx := range []Tx{
+		{Id: 1, TxBlockId: 1, TxBlockNumber: 12232752, TxHash: "0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533", TxFrom: treasury, TxTo: exchange},
+		{Id: 2, TxBlockId: 1, TxBlockNumber: 12232752, TxIndex: 1, TxHash: "0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2", TxFrom: exchange, TxTo: "0xdAC17F958D2ee523a2206206994597C13D831ec7"},
+	} {
+		subject := FilterSubject{Tx: &tx, Watchlists: watchlists}
+		tx.TxWatchlists = WatchlistMatches(watchlists, &subject)
+		if matchBlockTx(schedule, index, filters, &block, &tx, subject) {
+			kept = append(kept, tx)
+		}
+	}
+	assert.Equal(t, 1, len(kept))
+	assert.Nil(t, store.StoreBlockTxs(block, kept))
+	assert.Equal(t, map[int]int{1: 1}, block.BlockFilterMatches)
+	tx, _ := store.TxByHash("0x55bcc6f4fdf880ff81612da123c1795e798cc82cb559bdd8a70a347100820533")
+	assert.NotNil(t, tx)
+	assert.Equal(t, []WatchlistMatch{{Watchlist: "treasury", Label: "Cold wallet", Address: treasury}}, tx.TxWatchlists)
+	tx, _ = store.TxByHash("0x5d49fcaa394c97ec8a9c3e7bd9e8388d420fb050a52083ca52ff24b3b65bc9c2")
+	assert.Nil(t, tx)
+}
+
+func TestWatchlistRequests(t *testing.T) {
+	defer testWatchlists(t)()
+	a := App{}
+	w := httptest.NewRecorder()
+	a.snoopWatchlistAddRequest(w, httptest.NewRequest("POST", "/watchlistadd", strings.NewReader(`{"name": "exchanges", "description": "Hot wallets", "addresses": [{"address": "`+exchange+`", "label": "Binance 14"}]}`)))
+	assert.Equal(t, 200, w.Code)
+	var watchlist Watchlist
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &watchlist))
+	assert.Equal(t, "Binance 14", watchlist.Addresses[exchange])
+
+	w = httptest.NewRecorder()
+	a.snoopWatchlistAddRequest(w, httptest.NewRequest("POST", "/watchlistadd", strings.NewReader(`{"name": "exchanges", "addresses": [{"address": "0x123"}]}`)))
+	assert.Equal(t, 400, w.Code)
+
+	w = httptest.NewRecorder()
+	a.snoopWatchlistCSVRequest(w, httptest.NewRequest("POST", "/watchlistcsv?name=exchanges", strings.NewReader(treasury+",Coinbase 10\n")))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopWatchlistCSVRequest(w, httptest.NewRequest("POST", "/watchlistcsv?name=exchanges&remove=true", strings.NewReader(exchange+"\n")))
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	a.snoopWatchlistsRequest(w, httptest.NewRequest("GET", "/watchlists", nil))
+	var watchlists map[string]Watchlist
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &watchlists))
+	assert.Equal(t, map[string]string{treasury: "Coinbase 10"}, watchlists["exchanges"].Addresses)
+	assert.Equal(t, "Hot wallets", watchlists["exchanges"].Description)
+
+	w = httptest.NewRecorder()
+	a.snoopWatchlistRemoveRequest(w, httptest.NewRequest("POST", "/watchlistremove", strings.NewReader(`{"name": "cex"}`)))
+	assert.Equal(t, 404, w.Code)
+
+	_, err := AddFilterCriteria(Filters{Watchlist: "exchanges"})
+	assert.Nil(t, err)
+	w = httptest.NewRecorder()
+	a.snoopWatchlistDeleteRequest(w, httptest.NewRequest("POST", "/watchlistdelete", strings.NewReader(`{"name": "exchanges"}`)))
+	assert.Equal(t, 409, w.Code)
+	w = httptest.NewRecorder()
+	a.snoopWatchlistDeleteRequest(w, httptest.NewRequest("POST", "/watchlistdelete", strings.NewReader(`{"name": "treasury"}`)))
+	assert.Equal(t, 200, w.Code)
+	watchlists2, _ := store.Watchlists()
+	assert.Nil(t, watchlists2["treasury"])
+}